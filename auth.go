@@ -1,8 +1,12 @@
 package auth
 
 import (
+	"context"
+	"encoding/json"
 	"fmt"
 	"net/http"
+	"net/url"
+	"regexp"
 	"strings"
 	"time"
 
@@ -10,50 +14,390 @@ import (
 	"github.com/pkg/errors"
 )
 
+const (
+	// maxErrorBody is the most of an error response body kept in AuthError
+	maxErrorBody = 4096
+	// maxBodySnippet is the most of an unexpected body quoted in errors
+	maxBodySnippet = 512
+)
+
+// AuthError is returned when the auth server replies with a non 2xx
+// status
+//
+// Title, Message and Code are read from a Keystone fault body if there
+// is one.
+type AuthError struct {
+	StatusCode int
+	Status     string
+	Body       string // the start of the response body
+	Title      string // title of the fault
+	Message    string // message of the fault
+	Code       int    // code of the fault
+}
+
+func (e *AuthError) Error() string {
+	if e.Message != "" {
+		return fmt.Sprintf("HTTP Error: %d: %s: %s", e.StatusCode, e.Status, e.Message)
+	}
+	return fmt.Sprintf("HTTP Error: %d: %s", e.StatusCode, e.Status)
+}
+
+// parseFault fills in the fault fields from a Keystone fault body
+//
+// Bodies of other shapes are ignored.
+func (e *AuthError) parseFault() {
+	var fault struct {
+		Error struct {
+			Code    int    `json:"code"`
+			Title   string `json:"title"`
+			Message string `json:"message"`
+		} `json:"error"`
+	}
+	if json.Unmarshal([]byte(e.Body), &fault) != nil {
+		return
+	}
+	e.Title = fault.Error.Title
+	e.Message = fault.Error.Message
+	e.Code = fault.Error.Code
+}
+
+// Scoper is an optional interface to find out whether the token is
+// scoped and so usable for storage operations
+type Scoper interface {
+	IsScoped() bool
+}
+
+// RegionSetter is an optional interface to override the region used
+// for endpoint selection without changing the connection
+type RegionSetter interface {
+	SetRegion(region string)
+}
+
+// RegionBinder is an optional interface to make authenticators bound
+// to other regions which share the credentials and options but keep
+// their own tokens
+type RegionBinder interface {
+	ForRegion(region string) swift.Authenticator
+}
+
+// RegionSelector is an optional interface to read the region of the
+// storage endpoint selected, useful when no region is configured
+type RegionSelector interface {
+	SelectedRegion() string
+}
+
+// DefaultRegionReader is an optional interface to read the default
+// region of the user given by the auth server, for example by
+// Rackspace, to show it or to configure the region with
+type DefaultRegionReader interface {
+	DefaultRegion() string
+}
+
+// Warner is an optional interface to read warnings about the
+// configuration found by the last auth request, such as credentials
+// for more than one auth method
+type Warner interface {
+	Warnings() []string
+}
+
+// StorageURLSelector is an optional interface to read both the
+// internal and public storage urls from one auth so each operation
+// can pick one
+type StorageURLSelector interface {
+	StorageURLInternal() string
+	StorageURLPublic() string
+}
+
+// CatalogRefresher is an optional interface to reread the catalog
+// while the token is still valid
+type CatalogRefresher interface {
+	RefreshCatalog(ctx context.Context, c *swift.Connection) error
+}
+
+// TokenURLer is an optional interface to read the exact url the auth
+// request is sent to
+type TokenURLer interface {
+	TokenURL(c *swift.Connection) (string, error)
+}
+
+// Auditor is an optional interface to read the audit ids of the token
+// for tracing token derivation
+type Auditor interface {
+	AuditID() string
+	ParentAuditID() string
+}
+
+// RawResponder is an optional interface to read the last auth
+// response as generic JSON for fields not otherwise exposed
+type RawResponder interface {
+	RawResponse() (map[string]interface{}, error)
+}
+
+// CredentialsReader is an optional interface to read the token and
+// urls of the last auth together so they are from the same response
+// even during a concurrent reauth
+type CredentialsReader interface {
+	Credentials() (token, storageURL, cdnURL string, expires time.Time)
+}
+
+// ResponseHeaderReader is an optional interface to read a copy of the
+// headers of the last auth response, safe to use during a concurrent
+// reauth
+type ResponseHeaderReader interface {
+	ResponseHeaders() http.Header
+}
+
+// AuthVersion is a version of the auth protocol
+//
+// It is an alias of int so plain ints can still be used.
+type AuthVersion = int
+
+// Supported auth versions
+const (
+	AuthV1 AuthVersion = 1
+	AuthV2 AuthVersion = 2
+	AuthV3 AuthVersion = 3
+)
+
+// supportedVersion returns an error if authVersion isn't supported
+func supportedVersion(authVersion AuthVersion) error {
+	switch authVersion {
+	case AuthV1, AuthV2, AuthV3:
+		return nil
+	}
+	return fmt.Errorf("auth Version %d not supported - use AuthV1, AuthV2 or AuthV3", authVersion)
+}
+
 // Create a new Authenticator
 //
-// A hint for AuthVersion can be provided
-func New(authUrl, apiKey string, authVersion int, connTimeout time.Duration) (swift.Authenticator, error) {
+// A hint for AuthVersion can be provided, 0 to guess from a version
+// segment of the path of authUrl such as "/v3" or "/v2.0"
+func New(authUrl, apiKey string, authVersion AuthVersion, connTimeout time.Duration, opts ...Option) (swift.Authenticator, error) {
+	o := newOptions(opts...)
+	if o.authTimeout > 0 {
+		connTimeout = o.authTimeout
+	}
+
+	if authUrl != "" {
+		if err := checkAuthUrl(authUrl); err != nil {
+			return nil, err
+		}
+	}
+
+	if authVersion != 0 {
+		if err := supportedVersion(authVersion); err != nil {
+			return nil, err
+		}
+	}
+
+	urlVersion := urlAuthVersion(authUrl)
 	if authVersion == 0 {
-		if strings.Contains(authUrl, "v3") {
-			authVersion = 3
-		} else if strings.Contains(authUrl, "v2") {
-			authVersion = 2
-		} else if strings.Contains(authUrl, "v1") {
-			authVersion = 1
-		} else {
-			return nil, fmt.Errorf("can't find authVersion in AuthUrl - set explicitly")
+		if urlVersion == 0 {
+			if !o.probe {
+				return nil, fmt.Errorf("can't find authVersion in AuthUrl - set explicitly")
+			}
+			// Probing finds the v3 url from the root
+			urlVersion = AuthV3
+		}
+		authVersion = urlVersion
+	} else if urlVersion != 0 && urlVersion != authVersion {
+		if !o.allowVersionMismatch {
+			return nil, fmt.Errorf("auth Version %d contradicts v%d in AuthUrl - use WithVersionMismatch to allow", authVersion, urlVersion)
 		}
+		o.logf("auth Version %d used with v%d AuthUrl %q", authVersion, urlVersion, authUrl)
 	}
 
 	switch authVersion {
-	case 1:
-		return &v1Auth{timeout: connTimeout}, nil
-	case 2:
+	case AuthV1:
+		return &v1Auth{options: o, timeout: connTimeout}, nil
+	case AuthV2:
 		return &v2Auth{
+			options: o,
 			// Guess as to whether using API key or
 			// password it will try both eventually so
 			// this is just an optimization.
 			useApiKey: len(apiKey) >= 32,
 			timeout:   connTimeout,
 		}, nil
-	case 3:
-		return &v3Auth{timeout: connTimeout}, nil
+	case AuthV3:
+		return &v3Auth{options: o, timeout: connTimeout}, nil
+	}
+	return nil, supportedVersion(authVersion)
+}
+
+// AuthResult is the outcome of a successful Authenticate
+type AuthResult struct {
+	Token      string
+	StorageURL string // chosen from Internal and EndpointType as swift.Connection does
+	CdnURL     string
+	Expires    time.Time // zero if the token has no expiry
+}
+
+// Authenticate authenticates c with a, an Authenticator made by New,
+// and returns the result in one go
+//
+// It is for callers using the Authenticator directly rather than
+// through swift.Connection. The result comes from a single response
+// like that of Credentials.
+func Authenticate(ctx context.Context, a swift.Authenticator, c *swift.Connection) (AuthResult, error) {
+	reader, ok := a.(connectionCredentialsReader)
+	if !ok {
+		return AuthResult{}, errors.New("authenticator wasn't made by New")
+	}
+	req, err := a.Request(ctx, c)
+	if err != nil {
+		return AuthResult{}, err
+	}
+	if req != nil {
+		return AuthResult{}, errors.New("authenticator returned a request to send - use swift.Connection")
+	}
+	var result AuthResult
+	result.Token, result.StorageURL, result.CdnURL, result.Expires = reader.connectionCredentials(c)
+	return result, nil
+}
+
+// connectionCredentialsReader reads the credentials like Credentials
+// but with the storage url swift.Connection would use for c
+type connectionCredentialsReader interface {
+	connectionCredentials(c *swift.Connection) (token, storageURL, cdnURL string, expires time.Time)
+}
+
+// connectionEndpointType returns the interface swift.Connection reads
+// the storage url of c for from v2 and v3 auth
+func connectionEndpointType(c *swift.Connection) swift.EndpointType {
+	switch {
+	case c.EndpointType != "":
+		return c.EndpointType
+	case c.Internal:
+		return swift.EndpointTypeInternal
+	}
+	return swift.EndpointTypePublic
+}
+
+// checkTokenUrl returns the url made by tokenUrl from c checking it
+// parses
+func checkTokenUrl(c *swift.Connection, tokenUrl func(*swift.Connection) string) (string, error) {
+	if c.AuthUrl == "" {
+		return "", errors.New("AuthUrl should be provided")
+	}
+	u := tokenUrl(c)
+	if _, err := url.Parse(u); err != nil {
+		return "", errors.Wrap(err, "bad AuthUrl")
+	}
+	return u, nil
+}
+
+// checkAuthUrl returns an error if authUrl isn't an absolute http or
+// https url
+func checkAuthUrl(authUrl string) error {
+	u, err := url.Parse(authUrl)
+	if err != nil {
+		return errors.Wrap(err, "bad AuthUrl")
+	}
+	switch strings.ToLower(u.Scheme) {
+	case "http", "https":
+	case "":
+		return fmt.Errorf("AuthUrl %q should have an http or https scheme", authUrl)
+	default:
+		return fmt.Errorf("AuthUrl %q has scheme %q - use http or https", authUrl, u.Scheme)
+	}
+	if u.Host == "" {
+		return fmt.Errorf("AuthUrl %q should have a host", authUrl)
+	}
+	return nil
+}
+
+// versionSegment matches a path segment naming an auth version such
+// as "v3", "v2.0" or "v1.0"
+var versionSegment = regexp.MustCompile(`^v([123])(\.[0-9]+)?$`)
+
+// urlAuthVersion returns the auth version named by a segment of the
+// path of authUrl or 0
+//
+// Only path segments are looked at so hosts like "kv3.example.com"
+// don't count. If segments name different versions the url is
+// ambiguous and 0 is returned.
+func urlAuthVersion(authUrl string) AuthVersion {
+	u, err := url.Parse(authUrl)
+	if err != nil {
+		return 0
+	}
+	var version AuthVersion
+	for _, segment := range strings.Split(u.Path, "/") {
+		match := versionSegment.FindStringSubmatch(strings.ToLower(segment))
+		if match == nil {
+			continue
+		}
+		found := AuthVersion(match[1][0] - '0')
+		if version != 0 && version != found {
+			return 0
+		}
+		version = found
 	}
-	return nil, fmt.Errorf("auth Version %d not supported", authVersion)
+	return version
+}
+
+// doRequest sends r with transport and returns the response, or an
+// *AuthError if the status isn't 2xx
+func (o *options) doRequest(r *http.Request, transport http.RoundTripper) (*http.Response, error) {
+	resp, _, err := o.doTimedRequest(r, transport)
+	return resp, err
 }
 
-func doRequest(r *http.Request, transport http.RoundTripper) (*http.Response, error) {
-	cli := http.Client{Transport: transport}
-	resp, err := cli.Do(r)
+// doTokenRequest is doRequest for the request issuing the token,
+// recording how long it took for LastAuthDuration on success
+func (o *options) doTokenRequest(r *http.Request, transport http.RoundTripper) (*http.Response, error) {
+	resp, elapsed, err := o.doTimedRequest(r, transport)
 	if err != nil {
-		return resp, errors.Wrap(err, "do request")
+		return resp, err
+	}
+	o.setAuthDuration(elapsed)
+	return resp, nil
+}
+
+// doTimedRequest is doRequest also returning how long it took
+func (o *options) doTimedRequest(r *http.Request, transport http.RoundTripper) (*http.Response, time.Duration, error) {
+	resp, elapsed, err := o.send(r, transport)
+	if err != nil {
+		return resp, elapsed, err
 	}
 	if err = parseHeaders(resp); err != nil {
 		// Try again for a limited number of times on
 		// AuthorizationFailed or BadRequest. This allows us
 		// to try some alternate forms of the request
-		return resp, err
+		return resp, elapsed, err
 	}
-	return resp, nil
+	return resp, elapsed, nil
+}
+
+// send sends r with transport whatever the status of the response,
+// returning how long it took
+//
+// It waits for a slot for the host, tries the fallback transports and
+// captures the exchange if debugging. The slot is released when the
+// body of the response is closed.
+func (o *options) send(r *http.Request, transport http.RoundTripper) (*http.Response, time.Duration, error) {
+	var exchange *Exchange
+	if o.debug {
+		exchange = o.dumpRequest(r)
+	}
+	release, err := o.acquireHost(r.Context(), r.URL.Host)
+	if err != nil {
+		return nil, 0, errors.Wrap(err, "wait for auth request slot")
+	}
+	r, traced := o.traceRequest(r)
+	start := o.now()
+	resp, err := o.roundTrip(r, transport)
+	elapsed := o.now().Sub(start)
+	traced()
+	if err != nil {
+		release()
+		return resp, elapsed, errors.Wrap(err, "do request")
+	}
+	if exchange != nil {
+		o.dumpResponse(exchange, resp)
+		o.saveExchange(exchange)
+	}
+	resp.Body = &releaseBody{ReadCloser: resp.Body, release: release}
+	return resp, elapsed, nil
 }
@@ -0,0 +1,369 @@
+package auth
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"regexp"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ncw/swift/v2"
+	"github.com/pkg/errors"
+)
+
+func TestUrlAuthVersion(t *testing.T) {
+	for _, test := range []struct {
+		url  string
+		want AuthVersion
+	}{
+		{"https://auth.example.com/v3", AuthV3},
+		{"https://auth.example.com/v3/", AuthV3},
+		{"https://auth.example.com/identity/v3", AuthV3},
+		{"https://auth.example.com/v2.0", AuthV2},
+		{"https://auth.example.com/v2.0/tokens", AuthV2},
+		{"https://auth.example.com/auth/v1.0", AuthV1},
+		{"https://auth.example.com/V1", AuthV1},
+		{"https://kv3.example.com/v2.0", AuthV2},
+		{"https://v1.example.com/v3", AuthV3},
+		{"https://auth.example.com/", 0},
+		{"https://auth.example.com/v3api", 0},
+		{"https://auth.example.com/keystone-v2", 0},
+		{"https://auth.example.com/v2.0/v3", 0},
+		{"https://auth.example.com/?version=v3", 0},
+	} {
+		if got := urlAuthVersion(test.url); got != test.want {
+			t.Errorf("%q: want %d got %d", test.url, test.want, got)
+		}
+	}
+}
+
+func TestNewVersionFromUrl(t *testing.T) {
+	for _, test := range []struct {
+		url     string
+		version AuthVersion
+		wantErr bool
+	}{
+		{"https://kv3.example.com/v2.0", AuthV2, false},
+		{"https://kv3.example.com/v2.0", 0, false},
+		{"https://kv3.example.com/", AuthV2, false},
+		{"https://kv3.example.com/", 0, true},
+		{"https://auth.example.com/v2.0/v3", AuthV3, false},
+		{"https://auth.example.com/v2.0", AuthV3, true},
+	} {
+		_, err := New(test.url, "key", test.version, 0)
+		if gotErr := err != nil; gotErr != test.wantErr {
+			t.Errorf("New(%q, %d): want error %v got %v", test.url, test.version, test.wantErr, err)
+		}
+	}
+}
+
+func TestNewVersions(t *testing.T) {
+	for _, test := range []struct {
+		version AuthVersion
+		want    string // type of the authenticator, "" for an error
+	}{
+		{AuthV1, "*auth.v1Auth"},
+		{AuthV2, "*auth.v2Auth"},
+		{AuthV3, "*auth.v3Auth"},
+		{3, "*auth.v3Auth"},
+		{4, ""},
+		{-1, ""},
+	} {
+		a, err := New("https://auth.example.com/", "key", test.version, time.Second)
+		if test.want == "" {
+			if err == nil || !strings.Contains(err.Error(), fmt.Sprintf("auth Version %d not supported", test.version)) {
+				t.Errorf("New(%d): err = %v, want version not supported", test.version, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("New(%d): %v", test.version, err)
+		} else if got := fmt.Sprintf("%T", a); got != test.want {
+			t.Errorf("New(%d) made %s, want %s", test.version, got, test.want)
+		}
+	}
+}
+
+// userAgentTransport sets a User-Agent on requests without one
+type userAgentTransport string
+
+func (t userAgentTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	if r.Header.Get("User-Agent") == "" {
+		r = r.Clone(r.Context())
+		r.Header.Set("User-Agent", string(t))
+	}
+	return http.DefaultTransport.RoundTrip(r)
+}
+
+func TestUserAgent(t *testing.T) {
+	for _, test := range []struct {
+		name      string
+		userAgent string
+		opts      []Option
+		want      string
+	}{
+		{"connection", "conn-agent", nil, "conn-agent"},
+		{"default", "", nil, DefaultUserAgent},
+		{"suppressed", "conn-agent", []Option{WithUserAgent(false)}, "transport-agent"},
+		{"default suppressed", "", []Option{WithUserAgent(false)}, "transport-agent"},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			s := newFakeServer(t, func(w http.ResponseWriter, r *http.Request, body string) {
+				writeV3Token(w, "token", v3TokenBody)
+			})
+			c := v3Connection(s)
+			c.UserAgent = test.userAgent
+			c.Transport = userAgentTransport("transport-agent")
+			if err := authenticate(newAuth(t, c, AuthV3, test.opts...), c); err != nil {
+				t.Fatal(err)
+			}
+			requests := s.recorded()
+			if len(requests) != 1 {
+				t.Fatalf("want 1 request got %d", len(requests))
+			}
+			if got := requests[0].Header.Get("User-Agent"); got != test.want {
+				t.Errorf("User-Agent = %q, want %q", got, test.want)
+			}
+		})
+	}
+}
+
+func TestDefaultUserAgentFormat(t *testing.T) {
+	want := regexp.MustCompile(`^swift-auth/\S+ \(.+; ` + regexp.QuoteMeta(runtime.GOOS+"/"+runtime.GOARCH) + `\)$`)
+	if !want.MatchString(DefaultUserAgent) {
+		t.Errorf("DefaultUserAgent = %q, want it to match %s", DefaultUserAgent, want)
+	}
+	if !strings.Contains(DefaultUserAgent, runtime.Version()) {
+		t.Errorf("DefaultUserAgent = %q, want it to name %s", DefaultUserAgent, runtime.Version())
+	}
+}
+
+func TestTokenURL(t *testing.T) {
+	for _, test := range []struct {
+		version AuthVersion
+		authUrl string
+		want    string
+		wantErr bool
+	}{
+		{AuthV2, "https://auth.example.com/v2.0", "https://auth.example.com/v2.0/tokens", false},
+		{AuthV2, "https://auth.example.com/v2.0/", "https://auth.example.com/v2.0/tokens", false},
+		{AuthV2, "https://auth.example.com/identity/v2.0", "https://auth.example.com/identity/v2.0/tokens", false},
+		{AuthV2, "", "", true},
+		{AuthV3, "https://auth.example.com/v3", "https://auth.example.com/v3/auth/tokens", false},
+		{AuthV3, "https://auth.example.com/v3/", "https://auth.example.com/v3/auth/tokens", false},
+		{AuthV3, "https://auth.example.com/identity/v3", "https://auth.example.com/identity/v3/auth/tokens", false},
+		{AuthV3, "https://auth.example.com/v3/%zz", "", true},
+		{AuthV3, "", "", true},
+	} {
+		a, err := New("https://auth.example.com/", "key", test.version, time.Second)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := a.(TokenURLer).TokenURL(&swift.Connection{AuthUrl: test.authUrl})
+		if gotErr := err != nil; gotErr != test.wantErr || got != test.want {
+			t.Errorf("v%d %q: got %q, %v want %q (error %v)", test.version, test.authUrl, got, err, test.want, test.wantErr)
+		}
+	}
+}
+
+func TestTokenURLIsWhereAuthPosts(t *testing.T) {
+	for _, version := range []AuthVersion{AuthV2, AuthV3} {
+		s := newFakeServer(t, func(w http.ResponseWriter, r *http.Request, body string) {
+			if version == AuthV3 {
+				writeV3Token(w, "token", v3TokenBody)
+			} else {
+				writeJson(w, http.StatusOK, v2TokenBody)
+			}
+		})
+		c := v3Connection(s)
+		if version == AuthV2 {
+			c = v2Connection(s)
+		}
+		a := newAuth(t, c, version)
+		tokenUrl, err := a.(TokenURLer).TokenURL(c)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := authenticate(a, c); err != nil {
+			t.Fatal(err)
+		}
+		requests := s.recorded()
+		if len(requests) != 1 {
+			t.Fatalf("v%d: want 1 request got %d", version, len(requests))
+		}
+		if posted := s.URL + requests[0].Path; posted != tokenUrl {
+			t.Errorf("v%d: posted to %q, TokenURL is %q", version, posted, tokenUrl)
+		}
+	}
+}
+
+func TestAuthErrorFault(t *testing.T) {
+	const fault = `{"error": {"code": 401, "title": "Unauthorized", "message": "The request you have made requires authentication."}}`
+	for _, test := range []struct {
+		name string
+		body string
+		want AuthError
+	}{
+		{"fault", fault, AuthError{
+			StatusCode: http.StatusUnauthorized,
+			Code:       401,
+			Title:      "Unauthorized",
+			Message:    "The request you have made requires authentication.",
+		}},
+		{"other json", `{"message": "nope"}`, AuthError{StatusCode: http.StatusUnauthorized}},
+		{"html", `<html><body>Unauthorized</body></html>`, AuthError{StatusCode: http.StatusUnauthorized}},
+	} {
+		for _, version := range []AuthVersion{2, 3} {
+			t.Run(fmt.Sprintf("%s/v%d", test.name, version), func(t *testing.T) {
+				s := newFakeServer(t, func(w http.ResponseWriter, r *http.Request, _ string) {
+					writeJson(w, http.StatusUnauthorized, test.body)
+				})
+				c := v3Connection(s)
+				if version == 2 {
+					c = v2Connection(s)
+				}
+				err := authenticate(newAuth(t, c, version), c)
+				var authErr *AuthError
+				if !errors.As(err, &authErr) {
+					t.Fatalf("want an AuthError got %v", err)
+				}
+				got := AuthError{StatusCode: authErr.StatusCode, Code: authErr.Code, Title: authErr.Title, Message: authErr.Message}
+				if got != test.want {
+					t.Errorf("fault = %+v, want %+v", got, test.want)
+				}
+				if test.want.Message != "" && !strings.Contains(err.Error(), test.want.Message) {
+					t.Errorf("error %q doesn't include the message", err)
+				}
+			})
+		}
+	}
+}
+
+func TestNewChecksAuthUrl(t *testing.T) {
+	for _, test := range []struct {
+		url     string
+		wantErr string // "" if valid
+	}{
+		{"https://auth.example.com/v3", ""},
+		{"HTTPS://auth.example.com/v3", ""},
+		{"http://localhost:5000/v3", ""},
+		{"http://127.0.0.1:5000/v2.0", ""},
+		{"auth.example.com/v3", "should have an http or https scheme"},
+		{"ftp://auth.example.com/v3", `has scheme "ftp"`},
+		{"https:///v3", "should have a host"},
+		{"http://[::1/v3", "bad AuthUrl"},
+	} {
+		_, err := New(test.url, "key", 0, time.Second)
+		switch {
+		case test.wantErr == "" && err != nil:
+			t.Errorf("%q: unexpected error %v", test.url, err)
+		case test.wantErr != "" && (err == nil || !strings.Contains(err.Error(), test.wantErr)):
+			t.Errorf("%q: err = %v, want it to contain %q", test.url, err, test.wantErr)
+		}
+	}
+}
+
+func TestAuthenticateResult(t *testing.T) {
+	s := newFakeServer(t, func(w http.ResponseWriter, r *http.Request, _ string) {
+		switch r.URL.Path {
+		case "/auth/v1.0":
+			w.Header().Set("X-Auth-Token", "v1token")
+			w.Header().Set("X-Storage-Url", "http://storage.example.com/v1/AUTH_a")
+			w.WriteHeader(http.StatusNoContent)
+		case "/v2.0/tokens":
+			writeJson(w, http.StatusOK, v2TokenBody)
+		default:
+			writeV3Token(w, "token", v3TokenBody)
+		}
+	})
+	v1 := func() *swift.Connection {
+		return &swift.Connection{AuthUrl: s.URL + "/auth/v1.0", UserName: "user", ApiKey: "key"}
+	}
+	v2 := func() *swift.Connection { return v2Connection(s) }
+	v3 := func() *swift.Connection { return v3Connection(s) }
+	expires := time.Date(2099, 11, 7, 2, 58, 43, 0, time.UTC)
+	for _, test := range []struct {
+		name         string
+		version      AuthVersion
+		c            func() *swift.Connection
+		internal     bool
+		endpointType swift.EndpointType
+		want         AuthResult
+	}{
+		{"v1 public", 1, v1, false, "", AuthResult{Token: "v1token", StorageURL: "http://storage.example.com/v1/AUTH_a"}},
+		{"v1 internal", 1, v1, true, "", AuthResult{Token: "v1token", StorageURL: "http://snet-storage.example.com/v1/AUTH_a"}},
+		{"v2 public", 2, v2, false, "", AuthResult{Token: "v2token", StorageURL: "http://public.example.com/v1/AUTH_t1", Expires: expires}},
+		{"v2 internal", 2, v2, true, "", AuthResult{Token: "v2token", StorageURL: "http://internal.example.com/v1/AUTH_t1", Expires: expires}},
+		{"v2 endpoint type", 2, v2, true, swift.EndpointTypeAdmin, AuthResult{Token: "v2token", StorageURL: "http://admin.example.com/v1/AUTH_t1", Expires: expires}},
+		{"v3 public", 3, v3, false, "", AuthResult{Token: "token", StorageURL: "http://public.example.com/v1/AUTH_p", Expires: expires.Add(578887 * time.Microsecond)}},
+		{"v3 internal", 3, v3, true, "", AuthResult{Token: "token", StorageURL: "http://internal.example.com/v1/AUTH_p", Expires: expires.Add(578887 * time.Microsecond)}},
+		{"v3 endpoint type", 3, v3, false, swift.EndpointTypeInternal, AuthResult{Token: "token", StorageURL: "http://internal.example.com/v1/AUTH_p", Expires: expires.Add(578887 * time.Microsecond)}},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			c := test.c()
+			c.Internal, c.EndpointType = test.internal, test.endpointType
+			got, err := Authenticate(context.Background(), newAuth(t, c, test.version), c)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !got.Expires.Equal(test.want.Expires) {
+				t.Errorf("expires = %v, want %v", got.Expires, test.want.Expires)
+			}
+			got.Expires = test.want.Expires
+			if got != test.want {
+				t.Errorf("result = %+v, want %+v", got, test.want)
+			}
+
+			// The same storage url as the connection picks
+			c.Auth = newAuth(t, c, test.version)
+			if err := c.Authenticate(context.Background()); err != nil {
+				t.Fatal(err)
+			}
+			if c.StorageUrl != got.StorageURL {
+				t.Errorf("storage url %q, connection picked %q", got.StorageURL, c.StorageUrl)
+			}
+		})
+	}
+}
+
+func TestNonAuthoritativeStatus(t *testing.T) {
+	for _, test := range []struct {
+		name    string
+		version AuthVersion
+		token   string // the token in the header for v3 or body for v2
+		wantErr error
+	}{
+		{"v2", 2, "v2token", nil},
+		{"v2 no token", 2, "", ErrNoToken},
+		{"v3", 3, "token", nil},
+		{"v3 no token", 3, "", ErrNoToken},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			// A caching proxy answers 203 rather than 200 or 201
+			s := newFakeServer(t, func(w http.ResponseWriter, r *http.Request, _ string) {
+				body := v3TokenBody
+				if test.version == 2 {
+					body = strings.Replace(v2TokenBody, `"v2token"`, fmt.Sprintf("%q", test.token), 1)
+				} else if test.token != "" {
+					w.Header().Set("X-Subject-Token", test.token)
+				}
+				writeJson(w, http.StatusNonAuthoritativeInfo, body)
+			})
+			c := v3Connection(s)
+			if test.version == 2 {
+				c = v2Connection(s)
+			}
+			a := newAuth(t, c, test.version)
+			err := authenticate(a, c)
+			if !errors.Is(err, test.wantErr) {
+				t.Fatalf("err = %v, want %v", err, test.wantErr)
+			}
+			if got := a.Token(); got != test.token {
+				t.Errorf("token = %q, want %q", got, test.token)
+			}
+		})
+	}
+}
@@ -2,8 +2,11 @@ package auth
 
 import (
 	"context"
+	"encoding/json"
 	"net/http"
 	"net/url"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/ncw/swift/v2"
@@ -12,60 +15,349 @@ import (
 
 // v1 auth
 type v1Auth struct {
-	timeout time.Duration
-	headers http.Header // V1 auth: the authentication headers so extensions can access them
+	*options
+	timeout  time.Duration
+	headers  http.Header  // V1 auth: the authentication headers so extensions can access them
+	catalog  []Endpoint   // catalog fetched with WithV1Catalog
+	obtained time.Time    // when the last response was read
+	respMu   sync.RWMutex // protects headers, catalog and obtained
+}
+
+// Default v1 response headers
+const (
+	v1DefaultTokenHeader      = "X-Auth-Token"
+	v1DefaultStorageUrlHeader = "X-Storage-Url"
+)
+
+// WithV1Headers sets the response headers v1 auth reads the token and
+// storage url from for gateways which don't use the standard ones
+//
+// An empty name leaves the default (X-Auth-Token, X-Storage-Url).
+func WithV1Headers(tokenHeader, storageUrlHeader string) Option {
+	return func(o *options) {
+		o.v1TokenHeaderName = tokenHeader
+		o.v1StorageUrlHeaderName = storageUrlHeader
+	}
+}
+
+// v1TokenHeader returns the header holding the token
+func (o *options) v1TokenHeader() string {
+	if o.v1TokenHeaderName == "" {
+		return v1DefaultTokenHeader
+	}
+	return o.v1TokenHeaderName
+}
+
+// v1StorageUrlHeader returns the header holding the storage url
+func (o *options) v1StorageUrlHeader() string {
+	if o.v1StorageUrlHeaderName == "" {
+		return v1DefaultStorageUrlHeader
+	}
+	return o.v1StorageUrlHeaderName
+}
+
+// WithV1Catalog makes v1 auth fetch a service catalog with the v1
+// token from the Keystone v3 identityUrl after authenticating
+//
+// This is a hybrid mode for clouds whose v1 tokens are valid in
+// Keystone. The catalog can be read with StorageEndpoints and
+// DiagnoseEndpoint but the storage url still comes from the v1
+// headers. It is off by default.
+func WithV1Catalog(identityUrl string) Option {
+	return func(o *options) {
+		o.v1CatalogUrl = identityUrl
+	}
 }
 
 // v1 Authentication - make request
 func (auth *v1Auth) Request(ctx context.Context, c *swift.Connection) (*http.Request, error) {
-	ctx, cancel := context.WithTimeout(context.Background(), auth.timeout)
+	creds, err := auth.credentials(ctx, c)
+	if err != nil {
+		return nil, err
+	}
+	apiKey := creds.Secret
+	if err = auth.checkSecret(apiKey, "API key"); err != nil {
+		return nil, err
+	}
+
+	err = auth.withRetries(ctx, func(ctx context.Context) error {
+		return auth.redact(auth.authenticate(ctx, c, apiKey), apiKey)
+	})
+	if err != nil {
+		return nil, err
+	}
+	auth.setEffective(c, AuthV1)
+
+	return nil, nil
+}
+
+// v1 Authentication - read the url the auth request is sent to
+func (auth *v1Auth) TokenURL(c *swift.Connection) (string, error) {
+	return checkTokenUrl(c, func(c *swift.Connection) string {
+		return c.AuthUrl
+	})
+}
+
+// v1 Authentication - send the request and read the response
+func (auth *v1Auth) authenticate(ctx context.Context, c *swift.Connection, apiKey string) error {
+	ctx, cancel := context.WithTimeout(ctx, requestTimeout(ctx, auth.timeout))
 	defer cancel()
 	req, err := http.NewRequestWithContext(ctx, "GET", c.AuthUrl, nil)
 	if err != nil {
-		return nil, err
+		return err
 	}
-	req.Header.Set("User-Agent", c.UserAgent)
-	req.Header.Set("X-Auth-Key", c.ApiKey)
+	auth.setUserAgent(req, c)
+	req.Header.Set("X-Auth-Key", apiKey)
 	req.Header.Set("X-Auth-User", c.UserName)
 
-	resp, err := doRequest(req, c.Transport)
+	if err = auth.sign(req, nil); err != nil {
+		return err
+	}
+
+	transport, err := auth.transport(c)
+	if err != nil {
+		return err
+	}
+	resp, err := auth.doTokenRequest(req, transport)
 	if err != nil {
-		return nil, errors.Wrapf(err, "do auth request")
+		return errors.Wrapf(err, "do auth request")
 	}
+	// Only the headers are read
+	drainAndClose(resp.Body, nil)
 	err = auth.Response(ctx, resp)
 	if err != nil {
-		return nil, errors.Wrapf(err, "read response")
+		return errors.Wrapf(err, "read response")
+	}
+	if auth.v1CatalogUrl != "" {
+		if err = auth.fetchCatalog(ctx, c); err != nil {
+			return errors.Wrap(err, "fetch catalog")
+		}
 	}
 
-	return nil, nil
+	return nil
+}
+
+// v1 Authentication - fetch the catalog with the v1 token
+func (auth *v1Auth) fetchCatalog(ctx context.Context, c *swift.Connection) error {
+	url := auth.v1CatalogUrl
+	if !strings.HasSuffix(url, "/") {
+		url += "/"
+	}
+	url += "auth/catalog"
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "application/json")
+	req.Header.Set("X-Auth-Token", auth.Token())
+	auth.setUserAgent(req, c)
+
+	if err = auth.sign(req, nil); err != nil {
+		return err
+	}
+
+	transport, err := auth.transport(c)
+	if err != nil {
+		return err
+	}
+	resp, err := auth.doRequest(req, transport)
+	if err != nil {
+		return err
+	}
+	var result struct {
+		Catalog []struct {
+			Id, Name, Type string
+			Endpoints      []struct {
+				Id, Region, Region_Id, Url, Interface string
+				Enabled                               *bool
+				Links                                 json.RawMessage
+			}
+			Links json.RawMessage
+		}
+		Links json.RawMessage
+	}
+	if _, err = auth.readJson(resp, &result); err != nil {
+		return err
+	}
+	var endpoints []Endpoint
+	for _, catalog := range result.Catalog {
+		for _, endpoint := range catalog.Endpoints {
+			endpoints = append(endpoints, Endpoint{
+				ServiceType: catalog.Type,
+				Id:          endpoint.Id,
+				Region:      endpoint.Region,
+				RegionId:    endpoint.Region_Id,
+				Interface:   auth.catalogInterface(endpoint.Interface),
+				Url:         endpoint.Url,
+				Enabled:     isEnabled(endpoint.Enabled),
+			})
+		}
+	}
+	auth.respMu.Lock()
+	auth.catalog = endpoints
+	auth.respMu.Unlock()
+	return nil
+}
+
+// v1 Authentication - list the storage endpoints in the catalog
+// fetched with WithV1Catalog
+func (auth *v1Auth) StorageEndpoints() []Endpoint {
+	return auth.firstEndpoints(auth.endpoints)
+}
+
+// v1 Authentication - list the storage interfaces in region of the
+// catalog fetched with WithV1Catalog
+func (auth *v1Auth) AvailableInterfaces(region string) []swift.EndpointType {
+	return availableInterfaces(auth.StorageEndpoints(), region)
+}
+
+// v1 Authentication - explain the endpoint selection from the catalog
+// fetched with WithV1Catalog
+func (auth *v1Auth) DiagnoseEndpoint(serviceType, region string, endpointType swift.EndpointType) EndpointReport {
+	auth.respMu.RLock()
+	defer auth.respMu.RUnlock()
+	return auth.diagnoseEndpoint(auth.catalog, serviceType, region, endpointType)
+}
+
+// v1 Authentication - list the endpoints of all services in the
+// catalog fetched with WithV1Catalog
+func (auth *v1Auth) AllEndpoints() map[string][]Endpoint {
+	auth.respMu.RLock()
+	defer auth.respMu.RUnlock()
+	return groupByType(auth.catalog)
+}
+
+// v1 Authentication - list the endpoints of "type" in the catalog
+func (auth *v1Auth) endpoints(Type string) []Endpoint {
+	auth.respMu.RLock()
+	defer auth.respMu.RUnlock()
+	return endpointsOfType(auth.catalog, Type)
 }
 
 // v1 Authentication - read response
 func (auth *v1Auth) Response(_ context.Context, resp *http.Response) error {
+	auth.respMu.Lock()
 	auth.headers = resp.Header
-	return nil
+	auth.obtained = auth.now()
+	auth.respMu.Unlock()
+	if auth.Token() == "" {
+		return ErrNoToken
+	}
+	return auth.validate(auth.TokenInfo())
+}
+
+// v1 Authentication - read a copy of the response headers
+func (auth *v1Auth) ResponseHeaders() http.Header {
+	auth.respMu.RLock()
+	defer auth.respMu.RUnlock()
+	return auth.headers.Clone()
 }
 
 // v1 Authentication - read storage url
 func (auth *v1Auth) StorageUrl(Internal bool) string {
-	storageUrl := auth.headers.Get("X-Storage-Url")
+	auth.respMu.RLock()
+	defer auth.respMu.RUnlock()
+	return auth.storageUrl(Internal)
+}
+
+// v1 Authentication - read storage url with respMu held
+func (auth *v1Auth) storageUrl(Internal bool) string {
+	for _, Type := range auth.storageTypes() {
+		if url, ok := auth.endpointOverride(Type, ""); ok {
+			return auth.rewriteStorageUrl(url)
+		}
+	}
+	storageUrl := auth.headers.Get(auth.v1StorageUrlHeader())
 	if Internal {
 		newUrl, err := url.Parse(storageUrl)
 		if err != nil {
-			return storageUrl
+			return auth.rewriteStorageUrl(storageUrl)
 		}
 		newUrl.Host = "snet-" + newUrl.Host
 		storageUrl = newUrl.String()
 	}
-	return storageUrl
+	return auth.rewriteStorageUrl(storageUrl)
+}
+
+// v1 Authentication - read the internal storage url
+func (auth *v1Auth) StorageURLInternal() string {
+	return auth.StorageUrl(true)
+}
+
+// v1 Authentication - read the public storage url
+func (auth *v1Auth) StorageURLPublic() string {
+	return auth.StorageUrl(false)
 }
 
 // v1 Authentication - read auth token
 func (auth *v1Auth) Token() string {
-	return auth.headers.Get("X-Auth-Token")
+	auth.respMu.RLock()
+	defer auth.respMu.RUnlock()
+	return auth.token()
+}
+
+// v1 Authentication - read auth token with respMu held
+func (auth *v1Auth) token() string {
+	return auth.headers.Get(auth.v1TokenHeader())
+}
+
+// v1 Authentication - authenticate c again reporting whether the
+// token changed
+func (auth *v1Auth) Refresh(ctx context.Context, c *swift.Connection) (bool, error) {
+	return refresh(ctx, c, auth)
+}
+
+// v1 Authentication - read the token information
+//
+// v1 auth doesn't report the expiry or scope of the token.
+func (auth *v1Auth) TokenInfo() TokenInfo {
+	return TokenInfo{
+		Token: auth.Token(),
+		Scope: auth.Scope(),
+	}
+}
+
+// v1 Authentication - read what the token is scoped to
+//
+// v1 tokens are always reported as unscoped.
+func (auth *v1Auth) Scope() Scope {
+	return Scope{Kind: ScopeUnscoped}
+}
+
+// v1 Authentication - should the token be renewed
+//
+// v1 tokens have no expiry so only a missing token needs reauth.
+func (auth *v1Auth) NeedsReauth(buffer time.Duration) bool {
+	auth.respMu.RLock()
+	defer auth.respMu.RUnlock()
+	return auth.needsReauth(auth.token(), time.Time{}, auth.obtained, buffer)
+}
+
+// v1 Authentication - read the token and urls of the last auth
+//
+// The storage url is the public one and expires is always zero.
+func (auth *v1Auth) Credentials() (token, storageURL, cdnURL string, expires time.Time) {
+	auth.respMu.RLock()
+	defer auth.respMu.RUnlock()
+	return auth.token(), auth.storageUrl(false), auth.cdnUrl(), time.Time{}
+}
+
+// v1 Authentication - read the credentials with the storage url c
+// uses, which only depends on Internal for v1
+func (auth *v1Auth) connectionCredentials(c *swift.Connection) (token, storageURL, cdnURL string, expires time.Time) {
+	auth.respMu.RLock()
+	defer auth.respMu.RUnlock()
+	return auth.token(), auth.storageUrl(c.Internal), auth.cdnUrl(), time.Time{}
 }
 
 // v1 Authentication - read cdn url
 func (auth *v1Auth) CdnUrl() string {
+	auth.respMu.RLock()
+	defer auth.respMu.RUnlock()
+	return auth.cdnUrl()
+}
+
+// v1 Authentication - read cdn url with respMu held
+func (auth *v1Auth) cdnUrl() string {
 	return auth.headers.Get("X-CDN-Management-Url")
 }
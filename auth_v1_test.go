@@ -0,0 +1,42 @@
+package auth
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/ncw/swift/v2"
+)
+
+func TestV1Headers(t *testing.T) {
+	for _, test := range []struct {
+		name          string
+		opts          []Option
+		tokenHeader   string
+		storageHeader string
+	}{
+		{"default", nil, "X-Auth-Token", "X-Storage-Url"},
+		{"custom", []Option{WithV1Headers("X-Gateway-Token", "X-Gateway-Storage")}, "X-Gateway-Token", "X-Gateway-Storage"},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			s := newFakeServer(t, func(w http.ResponseWriter, r *http.Request, body string) {
+				// Decoys in the default headers for the custom case
+				w.Header().Set("X-Auth-Token", "decoy")
+				w.Header().Set("X-Storage-Url", "http://decoy.example.com/v1/AUTH_a")
+				w.Header().Set(test.tokenHeader, "v1token")
+				w.Header().Set(test.storageHeader, "http://storage.example.com/v1/AUTH_a")
+				w.WriteHeader(http.StatusOK)
+			})
+			c := &swift.Connection{AuthUrl: s.URL + "/auth/v1.0", UserName: "user", ApiKey: "key"}
+			a := newAuth(t, c, AuthV1, test.opts...)
+			if err := authenticate(a, c); err != nil {
+				t.Fatal(err)
+			}
+			if got := a.Token(); got != "v1token" {
+				t.Errorf("token = %q, want v1token", got)
+			}
+			if got, want := a.StorageUrl(false), "http://storage.example.com/v1/AUTH_a"; got != want {
+				t.Errorf("storage url = %q, want %q", got, want)
+			}
+		})
+	}
+}
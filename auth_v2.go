@@ -6,6 +6,7 @@ import (
 	"encoding/json"
 	"net/http"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/ncw/swift/v2"
@@ -14,17 +15,79 @@ import (
 
 // v2 Authentication
 type v2Auth struct {
+	*options
 	Auth        *v2AuthResponse
 	Region      string
+	mu          sync.Mutex // protects Region, regionSet and selected
+	regionSet   string     // region set with SetRegion
+	selected    string     // region of the last storage endpoint selected
 	timeout     time.Duration
-	useApiKey   bool // if set will use API key not Password
-	useApiKeyOk bool // if set won't change useApiKey any more
-	notFirst    bool // set after first run
+	useApiKey   bool               // if set will use API key not Password
+	useApiKeyOk bool               // if set won't change useApiKey any more
+	notFirst    bool               // set after first run
+	credKey     credentialKey      // the credentials being tried
+	okKey       credentialKey      // the credentials useApiKey is OK for
+	restored    *Snapshot          // snapshot to apply on the next request
+	raw         []byte             // body of the last response
+	obtained    time.Time          // when the last response was read
+	respMu      sync.RWMutex       // protects Auth, raw and obtained
+	regions     map[string]*v2Auth // views made by ForRegion
+}
+
+// WithV2CredentialForm makes v2 auth send only the given credential
+// form, CredentialFormPassword or CredentialFormApiKey
+//
+// By default v2 auth guesses the form from the length of the key and
+// tries the other form after a failure, so the secret may be sent
+// twice, once in the wrong form, to a server which may log request
+// bodies. Choosing the form avoids this at the cost of failing
+// outright if it is wrong. A form from the CredentialProvider takes
+// precedence.
+func WithV2CredentialForm(form string) Option {
+	return func(o *options) {
+		o.v2CredentialForm = form
+	}
 }
 
 // v2 Authentication - make request
 func (auth *v2Auth) Request(ctx context.Context, c *swift.Connection) (*http.Request, error) {
+	auth.mu.Lock()
 	auth.Region = c.Region
+	if auth.regionSet != "" {
+		auth.Region = auth.regionSet
+	}
+	auth.mu.Unlock()
+	creds, err := auth.credentials(ctx, c)
+	if err != nil {
+		return nil, err
+	}
+	apiKey := creds.Secret
+	if err = auth.checkSecret(apiKey, "password or API key"); err != nil {
+		return nil, err
+	}
+	auth.credKey = credentialKey{userName: c.UserName, authUrl: c.AuthUrl}
+	// Use the restored credential form if it is for these credentials
+	if auth.restored != nil {
+		if auth.restored.key() == auth.credKey {
+			auth.useApiKey = auth.restored.CredentialForm == CredentialFormApiKey
+			auth.useApiKeyOk = true
+			auth.okKey = auth.credKey
+		}
+		auth.restored = nil
+	}
+	// Use the configured credential form if set
+	if auth.v2CredentialForm != "" {
+		if auth.v2CredentialForm != CredentialFormPassword && auth.v2CredentialForm != CredentialFormApiKey {
+			return nil, errors.Errorf("v2 credential form %q not supported - use CredentialFormPassword or CredentialFormApiKey", auth.v2CredentialForm)
+		}
+		auth.useApiKey = auth.v2CredentialForm == CredentialFormApiKey
+		auth.useApiKeyOk = true
+	}
+	// Use the credential form from the provider if it says
+	if creds.Form != "" {
+		auth.useApiKey = creds.Form == CredentialFormApiKey
+		auth.useApiKeyOk = true
+	}
 	// Toggle useApiKey if not first run and not OK yet
 	if auth.notFirst && !auth.useApiKeyOk {
 		auth.useApiKey = !auth.useApiKey
@@ -36,7 +99,7 @@ func (auth *v2Auth) Request(ctx context.Context, c *swift.Connection) (*http.Req
 		// Normal swift authentication
 		v2 := v2AuthRequest{}
 		v2.Auth.PasswordCredentials.UserName = c.UserName
-		v2.Auth.PasswordCredentials.Password = c.ApiKey
+		v2.Auth.PasswordCredentials.Password = apiKey
 		v2.Auth.Tenant = c.Tenant
 		v2.Auth.TenantId = c.TenantId
 		v2i = v2
@@ -44,7 +107,7 @@ func (auth *v2Auth) Request(ctx context.Context, c *swift.Connection) (*http.Req
 		// Rackspace special with API Key
 		v2 := v2AuthRequestRackspace{}
 		v2.Auth.ApiKeyCredentials.UserName = c.UserName
-		v2.Auth.ApiKeyCredentials.ApiKey = c.ApiKey
+		v2.Auth.ApiKeyCredentials.ApiKey = apiKey
 		v2.Auth.Tenant = c.Tenant
 		v2.Auth.TenantId = c.TenantId
 		v2i = v2
@@ -53,68 +116,336 @@ func (auth *v2Auth) Request(ctx context.Context, c *swift.Connection) (*http.Req
 	if err != nil {
 		return nil, err
 	}
-	url := c.AuthUrl
+	if err = auth.probeVersion(ctx, c, AuthV2, requestTimeout(ctx, auth.timeout)); err != nil {
+		return nil, err
+	}
+	url := auth.v2TokensUrl(c)
+
+	err = auth.withMinTTL(ctx, func(ctx context.Context) error {
+		return auth.redact(auth.authenticate(ctx, c, url, body), apiKey)
+	})
+	if err != nil {
+		return nil, err
+	}
+	auth.setEffective(c, AuthV2)
+
+	return nil, nil
+}
+
+// v2TokensUrl returns the url of the tokens resource
+func (o *options) v2TokensUrl(c *swift.Connection) string {
+	url := o.authUrl(c)
 	if !strings.HasSuffix(url, "/") {
 		url += "/"
 	}
-	url += "tokens"
+	return url + "tokens"
+}
+
+// v2 Authentication - read the url the auth request is sent to
+func (auth *v2Auth) TokenURL(c *swift.Connection) (string, error) {
+	return checkTokenUrl(c, auth.v2TokensUrl)
+}
 
-	ctx, cancel := context.WithTimeout(ctx, auth.timeout)
+// v2 Authentication - send the request and read the response
+func (auth *v2Auth) authenticate(ctx context.Context, c *swift.Connection, url string, body []byte) error {
+	ctx, cancel := context.WithTimeout(ctx, requestTimeout(ctx, auth.timeout))
 	defer cancel()
 	req, err := http.NewRequestWithContext(ctx, "POST", url, bytes.NewBuffer(body))
 	if err != nil {
-		return nil, err
+		return err
 	}
 	req.Header.Set("Content-Type", "application/json")
-	req.Header.Set("User-Agent", c.UserAgent)
+	req.Header.Set("Accept", "application/json")
+	auth.setUserAgent(req, c)
+
+	if err = auth.sign(req, body); err != nil {
+		return err
+	}
 
-	resp, err := doRequest(req, c.Transport)
+	transport, err := auth.transport(c)
+	if err != nil {
+		return err
+	}
+	resp, err := auth.doTokenRequest(req, transport)
 	if err != nil {
-		return nil, errors.Wrapf(err, "do auth request")
+		return errors.Wrapf(err, "do auth request")
 	}
 	err = auth.Response(ctx, resp)
 	if err != nil {
-		return nil, errors.Wrapf(err, "read response")
+		return errors.Wrapf(err, "read response")
 	}
 
-	return nil, nil
+	return nil
 }
 
 // v2 Authentication - read response
+//
+// The response is only stored once it passes the checks so a rejected
+// token is never returned.
 func (auth *v2Auth) Response(_ context.Context, resp *http.Response) error {
-	auth.Auth = new(v2AuthResponse)
-	err := readJson(resp, auth.Auth)
+	response := new(v2AuthResponse)
+	raw, err := auth.readJson(resp, response)
+	auth.truncateCatalog(response)
+	if err == nil && response.Access.Token.Id == "" {
+		err = ErrNoToken
+	}
+	if err != nil {
+		return err
+	}
 	// If successfully read Auth then no need to toggle useApiKey any more
-	if err == nil {
-		auth.useApiKeyOk = true
+	auth.useApiKeyOk = true
+	auth.okKey = auth.credKey
+	// next is checked in place of auth until it is stored
+	next := &v2Auth{
+		options:  auth.options,
+		Auth:     response,
+		Region:   auth.region(),
+		raw:      raw,
+		obtained: auth.now(),
+	}
+	if err = next.checkResponse(); err != nil {
+		return err
+	}
+	auth.respMu.Lock()
+	auth.Auth = next.Auth
+	auth.raw = next.raw
+	auth.obtained = next.obtained
+	auth.respMu.Unlock()
+	return nil
+}
+
+// v2 Authentication - check the token, its expiry, catalog and region
+// of a response not yet stored
+func (auth *v2Auth) checkResponse() error {
+	auth.logDefaultTTL(auth.Auth.Access.Token.Expires)
+	if err := auth.validate(auth.tokenInfo()); err != nil {
+		return err
+	}
+	if err := auth.checkTTL(auth.expires()); err != nil {
+		return err
+	}
+	if err := auth.checkRegion(auth.StorageEndpoints(), auth.Region); err != nil {
+		return err
+	}
+	return auth.checkDuplicates(auth.StorageEndpoints(), auth.Region)
+}
+
+// v2 Authentication - cap the catalog of response
+func (auth *v2Auth) truncateCatalog(response *v2AuthResponse) {
+	services := response.Access.ServiceCatalog
+	types := make([]string, len(services))
+	counts := make([]int, len(services))
+	for i, service := range services {
+		types[i] = service.Type
+		counts[i] = len(service.Endpoints)
+	}
+	limits := auth.catalogLimits(types, counts)
+	if limits == nil {
+		return
+	}
+	kept := services[:0]
+	for i, service := range services {
+		if limits[i] > 0 {
+			service.Endpoints = service.Endpoints[:limits[i]]
+			kept = append(kept, service)
+		}
+	}
+	response.Access.ServiceCatalog = kept
+}
+
+// v2 Authentication - save the credential form known to work
+func (auth *v2Auth) Snapshot() Snapshot {
+	if !auth.useApiKeyOk {
+		return Snapshot{}
+	}
+	form := CredentialFormPassword
+	if auth.useApiKey {
+		form = CredentialFormApiKey
+	}
+	return Snapshot{
+		CredentialForm: form,
+		UserName:       auth.okKey.userName,
+		AuthUrl:        auth.okKey.authUrl,
+	}
+}
+
+// v2 Authentication - restore the credential form known to work
+//
+// It is checked against the user name and auth url of the connection
+// on the next request and ignored if they differ.
+func (auth *v2Auth) Restore(snapshot Snapshot) {
+	if snapshot.CredentialForm == "" {
+		return
+	}
+	auth.restored = &snapshot
+}
+
+// v2 Authentication - set the region
+//
+// This takes precedence over the connection's region for endpoint
+// selection. Set to "" to use the connection's region again.
+func (auth *v2Auth) SetRegion(region string) {
+	auth.mu.Lock()
+	defer auth.mu.Unlock()
+	auth.regionSet = region
+	auth.Region = region
+}
+
+// v2 Authentication - make a view bound to region
+//
+// The view shares the options but keeps its own token and endpoints
+// so it is refreshed independently. The same view is returned for the
+// same region.
+func (auth *v2Auth) ForRegion(region string) swift.Authenticator {
+	auth.mu.Lock()
+	defer auth.mu.Unlock()
+	if view, ok := auth.regions[region]; ok {
+		return view
+	}
+	view := &v2Auth{
+		options:     auth.options,
+		Region:      region,
+		regionSet:   region,
+		timeout:     auth.timeout,
+		useApiKey:   auth.useApiKey,
+		useApiKeyOk: auth.useApiKeyOk,
+		notFirst:    auth.notFirst,
+		okKey:       auth.okKey,
 	}
-	return err
+	if auth.regions == nil {
+		auth.regions = make(map[string]*v2Auth)
+	}
+	auth.regions[region] = view
+	return view
+}
+
+// v2 Authentication - read the region used for endpoint selection
+func (auth *v2Auth) region() string {
+	auth.mu.Lock()
+	defer auth.mu.Unlock()
+	return auth.Region
 }
 
 // Finds the Endpoint Url of "type" from the v2AuthResponse using the
-// Region if set or defaulting to the first one if not
+// Region if set or defaulting to the first one in region order if not
 //
 // Returns "" if not found
 func (auth *v2Auth) endpointUrl(Type string, endpointType swift.EndpointType) string {
+	if url, ok := auth.endpointOverride(Type, auth.region()); ok {
+		return url
+	}
+	endpoint, _ := selectEndpoint(auth.endpoints(Type), auth.region(), endpointType)
+	return endpoint.Url
+}
+
+// v2 Authentication - list all the endpoints in the catalog
+//
+// Endpoints either carry a url per interface or a single url with an
+// interface marker.
+func (auth *v2Auth) catalogEndpoints() []Endpoint {
+	var endpoints []Endpoint
+	if auth.Auth == nil {
+		return endpoints
+	}
 	for _, catalog := range auth.Auth.Access.ServiceCatalog {
-		if catalog.Type == Type {
-			for _, endpoint := range catalog.Endpoints {
-				if auth.Region == "" || (auth.Region == endpoint.Region) {
-					switch endpointType {
-					case swift.EndpointTypeInternal:
-						return endpoint.InternalUrl
-					case swift.EndpointTypePublic:
-						return endpoint.PublicUrl
-					case swift.EndpointTypeAdmin:
-						return endpoint.AdminUrl
-					default:
-						return ""
-					}
+		for _, endpoint := range catalog.Endpoints {
+			if endpoint.Url != "" && endpoint.Interface != "" {
+				// Interface marker shape
+				endpoints = append(endpoints, Endpoint{
+					ServiceType: catalog.Type,
+					Id:          endpoint.Id,
+					Region:      endpoint.Region,
+					Interface:   auth.catalogInterface(endpoint.Interface),
+					Url:         endpoint.Url,
+					Enabled:     isEnabled(endpoint.Enabled),
+				})
+				continue
+			}
+			for _, e := range []struct {
+				endpointType swift.EndpointType
+				url          string
+			}{
+				{swift.EndpointTypePublic, endpoint.PublicUrl},
+				{swift.EndpointTypeInternal, endpoint.InternalUrl},
+				{swift.EndpointTypeAdmin, endpoint.AdminUrl},
+			} {
+				if e.url == "" {
+					continue
 				}
+				endpoints = append(endpoints, Endpoint{
+					ServiceType: catalog.Type,
+					Id:          endpoint.Id,
+					Region:      endpoint.Region,
+					Interface:   e.endpointType,
+					Url:         e.url,
+					Enabled:     isEnabled(endpoint.Enabled),
+				})
 			}
 		}
 	}
-	return ""
+	return endpoints
+}
+
+// v2 Authentication - list the endpoints of "type" in the catalog
+func (auth *v2Auth) endpoints(Type string) []Endpoint {
+	return endpointsOfType(auth.catalogEndpoints(), Type)
+}
+
+// v2 Authentication - list the endpoints of all services
+func (auth *v2Auth) AllEndpoints() map[string][]Endpoint {
+	return groupByType(auth.catalogEndpoints())
+}
+
+// v2 Authentication - explain the endpoint selection
+func (auth *v2Auth) DiagnoseEndpoint(serviceType, region string, endpointType swift.EndpointType) EndpointReport {
+	return auth.diagnoseEndpoint(auth.catalogEndpoints(), serviceType, region, endpointType)
+}
+
+// v2 Authentication - list the storage endpoints
+func (auth *v2Auth) StorageEndpoints() []Endpoint {
+	return auth.firstEndpoints(auth.endpoints)
+}
+
+// v2 Authentication - find the storage endpoint url noting its region
+func (auth *v2Auth) storageEndpointUrl(Type string, endpointType swift.EndpointType) string {
+	if url, ok := auth.endpointOverride(Type, auth.region()); ok {
+		return url
+	}
+	endpoint, found := auth.selectStorageEndpoint(auth.endpoints(Type), auth.region(), endpointType)
+	if found {
+		auth.mu.Lock()
+		auth.selected = endpoint.Region
+		auth.mu.Unlock()
+	}
+	return endpoint.Url
+}
+
+// v2 Authentication - read the default region of the user
+//
+// It is only given by Rackspace so is "" otherwise.
+func (auth *v2Auth) DefaultRegion() string {
+	auth.respMu.RLock()
+	defer auth.respMu.RUnlock()
+	if auth.Auth == nil {
+		return ""
+	}
+	return auth.Auth.Access.User.DefaultRegion
+}
+
+// v2 Authentication - read the region of the storage endpoint selected
+//
+// It is set when the storage url is read and "" before.
+func (auth *v2Auth) SelectedRegion() string {
+	auth.mu.Lock()
+	defer auth.mu.Unlock()
+	return auth.selected
+}
+
+// v2 Authentication - list the storage interfaces in region
+//
+// All regions are included if region is "".
+func (auth *v2Auth) AvailableInterfaces(region string) []swift.EndpointType {
+	return availableInterfaces(auth.StorageEndpoints(), region)
 }
 
 // v2 Authentication - read storage url
@@ -133,21 +464,185 @@ func (auth *v2Auth) StorageUrl(Internal bool) string {
 //
 // Use the indicated endpointType to choose a URL.
 func (auth *v2Auth) StorageUrlForEndpoint(endpointType swift.EndpointType) string {
-	return auth.endpointUrl("object-store", endpointType)
+	return auth.firstEndpointUrl(auth.storageEndpointUrl, endpointType)
+}
+
+// v2 Authentication - read the internal storage url
+func (auth *v2Auth) StorageURLInternal() string {
+	return auth.StorageUrlForEndpoint(swift.EndpointTypeInternal)
+}
+
+// v2 Authentication - read the public storage url
+func (auth *v2Auth) StorageURLPublic() string {
+	return auth.StorageUrlForEndpoint(swift.EndpointTypePublic)
+}
+
+// v2 Authentication - read storage url with fallback
+//
+// If pref isn't in the catalog another interface is used and
+// returned.
+func (auth *v2Auth) StorageUrlForEndpointWithFallback(pref swift.EndpointType) (string, swift.EndpointType, error) {
+	return storageUrlWithFallback(auth.StorageUrlForEndpoint, pref)
 }
 
 // v2 Authentication - read auth token
 func (auth *v2Auth) Token() string {
+	auth.respMu.RLock()
+	defer auth.respMu.RUnlock()
+	return auth.token()
+}
+
+// v2 Authentication - read auth token with respMu held
+func (auth *v2Auth) token() string {
+	if auth.Auth == nil {
+		return ""
+	}
 	return auth.Auth.Access.Token.Id
 }
 
+// v2 Authentication - authenticate c again reporting whether the
+// token changed
+func (auth *v2Auth) Refresh(ctx context.Context, c *swift.Connection) (bool, error) {
+	return refresh(ctx, c, auth)
+}
+
+// v2 Authentication - compare the local clock to the token times
+func (auth *v2Auth) DetectClockSkew() (time.Duration, error) {
+	auth.respMu.RLock()
+	defer auth.respMu.RUnlock()
+	info := auth.tokenInfo()
+	return clockSkew(info.IssuedAt, info.ExpiresAt, auth.obtained)
+}
+
+// v2 Authentication - should the token be renewed
+func (auth *v2Auth) NeedsReauth(buffer time.Duration) bool {
+	auth.respMu.RLock()
+	defer auth.respMu.RUnlock()
+	return auth.needsReauth(auth.token(), auth.expires(), auth.obtained, buffer)
+}
+
 // v2 Authentication - read expires
 func (auth *v2Auth) Expires() time.Time {
-	t, err := time.Parse(time.RFC3339, auth.Auth.Access.Token.Expires)
-	if err != nil {
-		return time.Time{} // return Zero if not parsed
+	auth.respMu.RLock()
+	defer auth.respMu.RUnlock()
+	return auth.expires()
+}
+
+// v2 Authentication - read expires with respMu held
+func (auth *v2Auth) expires() time.Time {
+	if auth.Auth == nil {
+		return time.Time{}
 	}
-	return t
+	// Zero if not parsed and no default TTL
+	return auth.expiresOrDefault(parseTime(auth.Auth.Access.Token.Expires), auth.obtained)
+}
+
+// v2 Authentication - read expires in UTC
+func (auth *v2Auth) ExpiresUTC() time.Time {
+	return inLocation(auth.Expires(), time.UTC)
+}
+
+// v2 Authentication - read expires in loc
+func (auth *v2Auth) ExpiresInLocation(loc *time.Location) time.Time {
+	return inLocation(auth.Expires(), loc)
+}
+
+// v2 Authentication - read the time left before the token expires
+func (auth *v2Auth) ExpiresIn() time.Duration {
+	return auth.ttl(auth.Expires())
+}
+
+// v2 Authentication - has the token expired
+func (auth *v2Auth) IsExpired() bool {
+	return auth.expired(auth.Expires())
+}
+
+// v2 Authentication - read the token information
+func (auth *v2Auth) TokenInfo() TokenInfo {
+	auth.respMu.RLock()
+	defer auth.respMu.RUnlock()
+	return auth.tokenInfo()
+}
+
+// v2 Authentication - read the token information with respMu held
+func (auth *v2Auth) tokenInfo() TokenInfo {
+	if auth.Auth == nil {
+		return TokenInfo{Scope: Scope{Kind: ScopeUnscoped}}
+	}
+	token := &auth.Auth.Access.Token
+	var roles []string
+	for _, role := range auth.Auth.Access.User.Roles {
+		roles = append(roles, role.Name)
+	}
+	return auth.newTokenInfo(token.Id, token.IssuedAt, auth.expires(), auth.scope(), roles)
+}
+
+// v2 Authentication - read the tenant the token is scoped to
+func (auth *v2Auth) Scope() Scope {
+	auth.respMu.RLock()
+	defer auth.respMu.RUnlock()
+	return auth.scope()
+}
+
+// v2 Authentication - read the tenant with respMu held
+func (auth *v2Auth) scope() Scope {
+	if auth.Auth == nil || auth.Auth.Access.Token.Tenant.Id == "" {
+		return Scope{Kind: ScopeUnscoped}
+	}
+	tenant := auth.Auth.Access.Token.Tenant
+	return Scope{
+		Kind: ScopeProject,
+		Id:   tenant.Id,
+		Name: tenant.Name,
+	}
+}
+
+// v2 Authentication - is the token scoped to a tenant
+func (auth *v2Auth) IsScoped() bool {
+	return auth.Scope().Kind != ScopeUnscoped
+}
+
+// v2 Authentication - check the token is scoped to the tenant
+//
+// expectedProject may be the tenant name or id.
+func (auth *v2Auth) VerifyScope(expectedProject string) error {
+	auth.respMu.RLock()
+	defer auth.respMu.RUnlock()
+	if auth.Auth == nil {
+		return verifyProject(expectedProject, "", "")
+	}
+	tenant := auth.Auth.Access.Token.Tenant
+	return verifyProject(expectedProject, tenant.Id, tenant.Name)
+}
+
+// v2 Authentication - read the last response as generic JSON
+func (auth *v2Auth) RawResponse() (map[string]interface{}, error) {
+	auth.respMu.RLock()
+	raw := auth.raw
+	auth.respMu.RUnlock()
+	return decodeRaw(raw)
+}
+
+// v2 Authentication - read the token and urls of the last auth
+//
+// They are read under one lock so come from the same response. The
+// storage url is the public one.
+func (auth *v2Auth) Credentials() (token, storageURL, cdnURL string, expires time.Time) {
+	return auth.credentialsFor(swift.EndpointTypePublic)
+}
+
+// v2 Authentication - read the credentials with the storage url for
+// the interface c uses
+func (auth *v2Auth) connectionCredentials(c *swift.Connection) (token, storageURL, cdnURL string, expires time.Time) {
+	return auth.credentialsFor(connectionEndpointType(c))
+}
+
+// v2 Authentication - read the credentials with the storage url for
+// endpointType
+func (auth *v2Auth) credentialsFor(endpointType swift.EndpointType) (token, storageURL, cdnURL string, expires time.Time) {
+	auth.respMu.RLock()
+	defer auth.respMu.RUnlock()
+	return auth.token(), auth.StorageUrlForEndpoint(endpointType), auth.CdnUrl(), auth.expires()
 }
 
 // v2 Authentication - read cdn url
@@ -198,33 +693,50 @@ type v2AuthResponse struct {
 	Access struct {
 		ServiceCatalog []struct {
 			Endpoints []struct {
+				Id          string
 				InternalUrl string
 				PublicUrl   string
 				AdminUrl    string
 				Region      string
 				TenantId    string
+				VersionId   string
+				VersionInfo string
+				VersionList string
+				// Some catalogs use a single url with an interface marker
+				Url       string
+				Interface string
+				Enabled   *bool
 			}
-			Name string
-			Type string
+			Endpoints_Links json.RawMessage
+			Name            string
+			Type            string
 		}
 		Token struct {
-			Expires string
-			Id      string
-			Tenant  struct {
-				Id   string
-				Name string
+			Expires         string
+			IssuedAt        string `json:"issued_at"`
+			Id              string
+			Audit_Ids       []string
+			AuthenticatedBy json.RawMessage `json:"RAX-AUTH:authenticatedBy"`
+			Tenant          struct {
+				Id          string
+				Name        string
+				Description string
+				Enabled     bool
 			}
 		}
 		User struct {
 			DefaultRegion string `json:"RAX-AUTH:defaultRegion"`
 			Id            string
 			Name          string
+			Username      string
 			Roles         []struct {
 				Description string
 				Id          string
 				Name        string
 				TenantId    string
 			}
+			Roles_Links json.RawMessage
 		}
+		Metadata json.RawMessage
 	}
 }
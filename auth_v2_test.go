@@ -0,0 +1,79 @@
+package auth
+
+import (
+	"encoding/json"
+	"net/http"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestV2DefaultRegion(t *testing.T) {
+	for _, test := range []struct {
+		name string
+		body string
+		want string
+	}{
+		{"rackspace", v2TokenBody, "DFW"},
+		{"keystone", strings.Replace(v2TokenBody, `"RAX-AUTH:defaultRegion": "DFW"`, `"enabled": true`, 1), ""},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			s := newFakeServer(t, func(w http.ResponseWriter, r *http.Request, body string) {
+				writeJson(w, http.StatusOK, test.body)
+			})
+			c := v2Connection(s)
+			a := newAuth(t, c, 2)
+			reader := a.(DefaultRegionReader)
+			if got := reader.DefaultRegion(); got != "" {
+				t.Errorf("want no default region before auth got %q", got)
+			}
+			if err := authenticate(a, c); err != nil {
+				t.Fatalf("auth failed: %v", err)
+			}
+			if got := reader.DefaultRegion(); got != test.want {
+				t.Errorf("want default region %q got %q", test.want, got)
+			}
+		})
+	}
+}
+
+func TestV2CredentialFormSendsOneForm(t *testing.T) {
+	for _, test := range []struct {
+		name string
+		opts []Option
+		want []string // the credential form of each request
+	}{
+		{"guessed", nil, []string{"passwordCredentials", "RAX-KSKEY:apiKeyCredentials", "passwordCredentials"}},
+		{"password", []Option{WithV2CredentialForm(CredentialFormPassword)}, []string{"passwordCredentials", "passwordCredentials", "passwordCredentials"}},
+		{"api key", []Option{WithV2CredentialForm(CredentialFormApiKey)}, []string{"RAX-KSKEY:apiKeyCredentials", "RAX-KSKEY:apiKeyCredentials", "RAX-KSKEY:apiKeyCredentials"}},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			s := newFakeServer(t, func(w http.ResponseWriter, r *http.Request, body string) {
+				writeJson(w, http.StatusUnauthorized, `{"error": {"code": 401, "title": "Unauthorized", "message": "bad credentials"}}`)
+			})
+			c := v2Connection(s)
+			a := newAuth(t, c, AuthV2, test.opts...)
+			// swift.Connection authenticates again after a failure
+			for range test.want {
+				if err := authenticate(a, c); err == nil {
+					t.Fatal("expected auth to fail")
+				}
+			}
+			var got []string
+			for _, r := range s.recorded() {
+				var req struct{ Auth map[string]json.RawMessage }
+				if err := json.Unmarshal([]byte(r.Body), &req); err != nil {
+					t.Fatalf("bad request body %q: %v", r.Body, err)
+				}
+				for key := range req.Auth {
+					if strings.HasSuffix(key, "Credentials") {
+						got = append(got, key)
+					}
+				}
+			}
+			if !reflect.DeepEqual(got, test.want) {
+				t.Errorf("sent credential forms %q, want %q", got, test.want)
+			}
+		})
+	}
+}
@@ -7,8 +7,10 @@ import (
 	"fmt"
 	"io"
 	"io/ioutil"
+	"mime"
 	"net/http"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/ncw/swift/v2"
@@ -19,7 +21,8 @@ const (
 	v3AuthMethodToken                 = "token"
 	v3AuthMethodPassword              = "password"
 	v3AuthMethodApplicationCredential = "application_credential"
-	v3CatalogTypeObjectStore          = "object-store"
+	v3AuthMethodTotp                  = "totp"
+	v3DefaultDomain                   = "Default"
 )
 
 // V3 Authentication request
@@ -32,9 +35,12 @@ type v3AuthRequest struct {
 			Password              *v3AuthPassword              `json:"password,omitempty"`
 			Token                 *v3AuthToken                 `json:"token,omitempty"`
 			ApplicationCredential *v3AuthApplicationCredential `json:"application_credential,omitempty"`
+			Totp                  *v3AuthTotp                  `json:"totp,omitempty"`
 		} `json:"identity"`
 		Scope *v3Scope `json:"scope,omitempty"`
 	} `json:"auth"`
+	receipt  string // if set sent to continue multi-factor auth
+	unscoped bool   // the token is rescoped by auto project so isn't checked
 }
 
 type v3Scope struct {
@@ -63,6 +69,7 @@ type v3User struct {
 	Id       string    `json:"id,omitempty"`
 	Name     string    `json:"name,omitempty"`
 	Password string    `json:"password,omitempty"`
+	Passcode string    `json:"passcode,omitempty"`
 }
 
 type v3AuthToken struct {
@@ -73,6 +80,10 @@ type v3AuthPassword struct {
 	User v3User `json:"user"`
 }
 
+type v3AuthTotp struct {
+	User v3User `json:"user"`
+}
+
 type v3AuthApplicationCredential struct {
 	Id     string  `json:"id,omitempty"`
 	Name   string  `json:"name,omitempty"`
@@ -81,132 +92,170 @@ type v3AuthApplicationCredential struct {
 }
 
 // V3 Authentication response
+//
+// All the documented fields are modelled so strict decoding accepts
+// real responses. Those which aren't used are kept as raw JSON.
 type v3AuthResponse struct {
 	Token struct {
 		ExpiresAt string `json:"expires_at"`
 		IssuedAt  string `json:"issued_at"`
 		Methods   []string
 		Roles     []struct {
-			Id, Name string
-			Links    struct {
-				Self string
-			}
+			Id, Name  string
+			Domain_Id string
+			Links     json.RawMessage
 		}
 
 		Project struct {
 			Domain struct {
 				Id, Name string
+				Links    json.RawMessage
 			}
 			Id, Name string
+			Links    json.RawMessage
 		}
+		Is_Domain bool
 
-		Catalog []struct {
-			Id, Namem, Type string
-			Endpoints       []struct {
-				Id, Region_Id, Url, Region string
-				Interface                  swift.EndpointType
-			}
+		Domain struct {
+			Id, Name string
+			Links    json.RawMessage
 		}
 
+		System map[string]interface{}
+
+		Trust struct {
+			Id            string
+			Impersonation bool
+			Trustee_User  json.RawMessage
+			Trustor_User  json.RawMessage
+			Links         json.RawMessage
+		} `json:"OS-TRUST:trust"`
+
+		Application_Credential json.RawMessage
+
+		Catalog []v3CatalogEntry
+
 		User struct {
 			Id, Name string
 			Domain   struct {
 				Id, Name string
-				Links    struct {
-					Self string
-				}
+				Links    json.RawMessage
 			}
+			Password_Expires_At *string
+			Federation          json.RawMessage `json:"OS-FEDERATION"`
+			Links               json.RawMessage
 		}
 
 		Audit_Ids []string
+		Links     json.RawMessage
 	}
 }
 
+// v3CatalogEntry is a service in the catalog of a v3 response
+type v3CatalogEntry struct {
+	Id, Name, Type string
+	Endpoints      []v3CatalogEndpoint
+	Links          json.RawMessage
+}
+
+// v3CatalogEndpoint is an endpoint of a service in the catalog
+type v3CatalogEndpoint struct {
+	Id, Region_Id, Url, Region string
+	Interface                  swift.EndpointType
+	Enabled                    *bool
+	Links                      json.RawMessage
+}
+
 type v3Auth struct {
-	timeout time.Duration
-	Region  string
-	Auth    *v3AuthResponse
-	Headers http.Header
+	*options
+	timeout   time.Duration
+	Region    string
+	mu        sync.Mutex // protects Region, regionSet, selected and warnings
+	regionSet string     // region set with SetRegion
+	selected  string     // region of the last storage endpoint selected
+	warnings  []string   // found by the last request
+	Auth      *v3AuthResponse
+	Headers   http.Header        // replaced by reauth - read with ResponseHeaders
+	raw       []byte             // body of the last response
+	obtained  time.Time          // when the last response was read
+	respMu    sync.RWMutex       // protects Auth, Headers, raw and obtained
+	regions   map[string]*v3Auth // views made by ForRegion
 }
 
 func (auth *v3Auth) Request(ctx context.Context, c *swift.Connection) (*http.Request, error) {
+	auth.mu.Lock()
 	auth.Region = c.Region
+	if auth.regionSet != "" {
+		auth.Region = auth.regionSet
+	}
+	auth.mu.Unlock()
 
-	var v3i interface{}
+	creds, err := auth.credentials(ctx, c)
+	if err != nil {
+		return nil, err
+	}
+	apiKey := creds.Secret
+	secret, err := auth.applicationCredentialSecret(c)
+	if err != nil {
+		return nil, err
+	}
+	auth.warn(c, apiKey, secret)
 
 	v3 := v3AuthRequest{}
 
-	if (c.ApplicationCredentialId != "" || c.ApplicationCredentialName != "") && c.ApplicationCredentialSecret != "" {
-		var user *v3User
-
-		if c.ApplicationCredentialId != "" {
-			c.ApplicationCredentialName = ""
-			user = &v3User{}
+	if auth.totpPasscode != nil {
+		passcode, err := auth.totpPasscode(ctx)
+		if err != nil {
+			return nil, errors.Wrap(err, "totp passcode")
 		}
-
-		if user == nil && c.UserId != "" {
-			// UserID could be used without the domain information
-			user = &v3User{
-				Id: c.UserId,
-			}
+		// Make sure that the passcode and a user are provided
+		if passcode == "" {
+			return nil, fmt.Errorf("TOTP passcode should be provided")
 		}
-
-		if user == nil && c.UserName == "" {
-			// Make sure that Username or UserID are provided
-			return nil, fmt.Errorf("UserID or Name should be provided")
+		user, err := buildV3User(c)
+		if err != nil {
+			return nil, err
 		}
-
-		if user == nil && c.DomainId != "" {
-			user = &v3User{
-				Name: c.UserName,
-				Domain: &v3Domain{
-					Id: c.DomainId,
-				},
-			}
-		}
-
-		if user == nil && c.Domain != "" {
-			user = &v3User{
-				Name: c.UserName,
-				Domain: &v3Domain{
-					Name: c.Domain,
-				},
-			}
+		user.Passcode = passcode
+		v3.Auth.Identity.Methods = []string{v3AuthMethodTotp}
+		v3.Auth.Identity.Totp = &v3AuthTotp{User: *user}
+	} else if (c.ApplicationCredentialId != "" || c.ApplicationCredentialName != "") && secret != "" {
+		if c.ApplicationCredentialId != "" {
+			c.ApplicationCredentialName = ""
 		}
-
-		// Make sure that DomainID or DomainName are provided among Username
-		if user == nil {
-			return nil, fmt.Errorf("DomainID or Domain should be provided")
+		user, err := v3ApplicationCredentialUser(c, auth.appCredUserDomain)
+		if err != nil {
+			return nil, err
 		}
 
 		v3.Auth.Identity.Methods = []string{v3AuthMethodApplicationCredential}
 		v3.Auth.Identity.ApplicationCredential = &v3AuthApplicationCredential{
 			Id:     c.ApplicationCredentialId,
 			Name:   c.ApplicationCredentialName,
-			Secret: c.ApplicationCredentialSecret,
+			Secret: secret,
 			User:   user,
 		}
 	} else if c.UserName == "" && c.UserId == "" {
+		// Make sure there is a token to exchange
+		if err = auth.checkSecret(apiKey, "token"); err != nil {
+			return nil, err
+		}
+		// The token is rescoped below like the other methods so an
+		// unscoped token with TenantId gets a project token and
+		// catalog
 		v3.Auth.Identity.Methods = []string{v3AuthMethodToken}
-		v3.Auth.Identity.Token = &v3AuthToken{Id: c.ApiKey}
+		v3.Auth.Identity.Token = &v3AuthToken{Id: apiKey}
 	} else {
-		v3.Auth.Identity.Methods = []string{v3AuthMethodPassword}
-		v3.Auth.Identity.Password = &v3AuthPassword{
-			User: v3User{
-				Name:     c.UserName,
-				Id:       c.UserId,
-				Password: c.ApiKey,
-			},
+		if err = auth.checkSecret(apiKey, "password"); err != nil {
+			return nil, err
 		}
-
-		var domain *v3Domain
-
-		if c.Domain != "" {
-			domain = &v3Domain{Name: c.Domain}
-		} else if c.DomainId != "" {
-			domain = &v3Domain{Id: c.DomainId}
+		user, err := buildV3User(c)
+		if err != nil {
+			return nil, err
 		}
-		v3.Auth.Identity.Password.User.Domain = domain
+		user.Password = apiKey
+		v3.Auth.Identity.Methods = []string{v3AuthMethodPassword}
+		v3.Auth.Identity.Password = &v3AuthPassword{User: *user}
 	}
 
 	if v3.Auth.Identity.Methods[0] != v3AuthMethodApplicationCredential {
@@ -218,77 +267,595 @@ func (auth *v3Auth) Request(ctx context.Context, c *swift.Connection) (*http.Req
 
 			if c.TenantId != "" {
 				v3.Auth.Scope.Project.Id = c.TenantId
+				if auth.projectIdDomain {
+					v3.Auth.Scope.Project.Domain, err = auth.projectDomain(c)
+					if err != nil {
+						return nil, err
+					}
+				}
 			} else if c.Tenant != "" {
 				v3.Auth.Scope.Project.Name = c.Tenant
-				switch {
-				case c.TenantDomain != "":
-					v3.Auth.Scope.Project.Domain = &v3Domain{Name: c.TenantDomain}
-				case c.TenantDomainId != "":
-					v3.Auth.Scope.Project.Domain = &v3Domain{Id: c.TenantDomainId}
-				case c.Domain != "":
-					v3.Auth.Scope.Project.Domain = &v3Domain{Name: c.Domain}
-				case c.DomainId != "":
-					v3.Auth.Scope.Project.Domain = &v3Domain{Id: c.DomainId}
-				default:
-					v3.Auth.Scope.Project.Domain = &v3Domain{Name: "Default"}
+				v3.Auth.Scope.Project.Domain, err = auth.projectDomain(c)
+				if err != nil {
+					return nil, err
 				}
 			}
+		} else if v3.Auth.Identity.Methods[0] == v3AuthMethodToken && auth.tokenDomainScope {
+			// Rescope the token to the domain if one is set
+			if c.DomainId != "" {
+				v3.Auth.Scope = &v3Scope{Domain: &v3Domain{Id: c.DomainId}}
+			} else if c.Domain != "" {
+				v3.Auth.Scope = &v3Scope{Domain: &v3Domain{Name: c.Domain}}
+			}
 		}
 	}
 
-	v3i = v3
-
-	body, err := json.Marshal(v3i)
+	if err = auth.probeVersion(ctx, c, AuthV3, requestTimeout(ctx, auth.timeout)); err != nil {
+		return nil, err
+	}
 
+	autoProject := auth.autoProject && v3.Auth.Scope == nil && v3.Auth.Identity.Methods[0] != v3AuthMethodApplicationCredential
+	v3.unscoped = autoProject
+	err = auth.withMinTTL(ctx, func(ctx context.Context) error {
+		err := auth.redact(auth.authenticate(ctx, c, &v3), apiKey, secret)
+		if err != nil && isDefaultDomainError(err) && v3.setDefaultDomain() {
+			auth.logf("v3 auth: retrying with %q user domain after: %v", v3DefaultDomain, err)
+			err = auth.redact(auth.authenticate(ctx, c, &v3), apiKey, secret)
+		}
+		var receiptErr *ReceiptError
+		if auth.totpSecret != "" && v3.Auth.Identity.Password != nil && errors.As(err, &receiptErr) {
+			err = auth.redact(auth.continueReceipt(ctx, c, &v3, receiptErr), apiKey, secret)
+		}
+		return err
+	})
 	if err != nil {
 		return nil, err
 	}
+	if autoProject {
+		if err = auth.scopeToOnlyProject(ctx, c); err != nil {
+			return nil, err
+		}
+	}
+	auth.setEffective(c, AuthV3)
+
+	return nil, nil
+}
+
+// Domain is a Keystone domain given by Id or Name
+type Domain struct {
+	Id   string
+	Name string
+}
+
+// EffectiveProjectDomain returns the domain v3 auth with the default
+// options uses to scope to the project of c by name
+//
+// The domain is the first set of TenantDomain, TenantDomainId, Domain
+// and DomainId, otherwise "Default". It is zero if the project isn't
+// scoped by name.
+func EffectiveProjectDomain(c *swift.Connection) Domain {
+	if c.TrustId != "" || c.TenantId != "" || c.Tenant == "" {
+		return Domain{}
+	}
+	domain, _ := newOptions().projectDomain(c)
+	if domain == nil {
+		return Domain{}
+	}
+	return Domain{Id: domain.Id, Name: domain.Name}
+}
+
+// projectDomain returns the domain to scope to the project of c by
+// name or nil to leave it to Keystone
+//
+// It is chosen separately from the user domain so a user domain Id
+// can be combined with a project domain name.
+func (o *options) projectDomain(c *swift.Connection) (*v3Domain, error) {
+	switch {
+	case c.TenantDomain != "":
+		return &v3Domain{Name: c.TenantDomain}, nil
+	case c.TenantDomainId != "":
+		return &v3Domain{Id: c.TenantDomainId}, nil
+	case c.Domain != "":
+		return &v3Domain{Name: c.Domain}, nil
+	case c.DomainId != "":
+		return &v3Domain{Id: c.DomainId}, nil
+	case o.requireProjectDomain && (!o.defaultProjectDomainSet || o.noDefaultProjectDomain):
+		// Project names are only unique within a domain
+		if c.TenantId != "" {
+			return nil, fmt.Errorf("TenantDomain or TenantDomainId should be provided to scope to project %q", c.TenantId)
+		}
+		return nil, fmt.Errorf("TenantDomain or TenantDomainId should be provided to scope to project %q by name", c.Tenant)
+	case !o.noDefaultProjectDomain:
+		return &v3Domain{Name: v3DefaultDomain}, nil
+	}
+	return nil, nil
+}
+
+// warn notes credentials of c for more than one auth method and
+// which is used
+func (auth *v3Auth) warn(c *swift.Connection, apiKey, secret string) {
+	var warnings []string
+	appCred := (c.ApplicationCredentialId != "" || c.ApplicationCredentialName != "") && secret != ""
+	password := (c.UserName != "" || c.UserId != "") && apiKey != ""
+	if auth.totpPasscode != nil {
+		if appCred {
+			warnings = append(warnings, "application credential is set but TOTP auth is used")
+		}
+		if password {
+			warnings = append(warnings, "password is set but TOTP auth is used")
+		}
+	} else if appCred && password {
+		warnings = append(warnings, "password is set but application credential auth is used")
+	}
+	for _, warning := range warnings {
+		auth.logf("v3 auth: %s", warning)
+	}
+	auth.mu.Lock()
+	auth.warnings = warnings
+	auth.mu.Unlock()
+}
+
+// Warnings reads the warnings about the configuration found by the
+// last request
+func (auth *v3Auth) Warnings() []string {
+	auth.mu.Lock()
+	defer auth.mu.Unlock()
+	return append([]string(nil), auth.warnings...)
+}
 
-	url := c.AuthUrl
+// authenticate sends the v3 auth request and reads the response
+func (auth *v3Auth) authenticate(ctx context.Context, c *swift.Connection, v3 *v3AuthRequest) error {
+	body, err := json.Marshal(v3)
+
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, requestTimeout(ctx, auth.timeout))
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, "POST", auth.v3TokensUrl(c), bytes.NewBuffer(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Accept", "application/json")
+	if v3.receipt != "" {
+		req.Header.Set(v3ReceiptHeader, v3.receipt)
+	}
+	auth.setUserAgent(req, c)
+
+	if err = auth.sign(req, body); err != nil {
+		return err
+	}
+
+	transport, err := auth.transport(c)
+	if err != nil {
+		return err
+	}
+	resp, err := auth.doTokenRequest(req, transport)
+	if err != nil {
+		return errors.Wrapf(receiptError(resp, err), "do auth request")
+	}
+	err = auth.readResponse(resp, !v3.unscoped)
+	if err != nil {
+		return errors.Wrapf(err, "read response")
+	}
+
+	return nil
+}
+
+// Rescope exchanges the current token for one scoped to project using
+// the token method so the credentials aren't sent again
+//
+// If project has a Name but no domain the domain is chosen as for the
+// project of c. On success the project of c is set to project, so
+// reauth keeps the new scope, and its token and storage url are
+// updated. It shouldn't be called while c is authenticating.
+func (auth *v3Auth) Rescope(ctx context.Context, c *swift.Connection, project ProjectRef) error {
+	token := auth.Token()
+	if token == "" {
+		return errors.New("no token to rescope")
+	}
+	if auth.expired(auth.Expires()) {
+		return errors.New("token to rescope has expired")
+	}
+
+	scope := &v3Project{Id: project.Id}
+	switch {
+	case project.Id != "":
+	case project.Name == "":
+		return errors.New("project Id or Name should be provided to rescope")
+	case project.DomainId != "" || project.DomainName != "":
+		scope.Name = project.Name
+		scope.Domain = &v3Domain{Id: project.DomainId, Name: project.DomainName}
+	default:
+		var err error
+		scope.Name = project.Name
+		scope.Domain, err = auth.projectDomain(c)
+		if err != nil {
+			return err
+		}
+	}
+	v3 := v3AuthRequest{}
+	v3.Auth.Identity.Methods = []string{v3AuthMethodToken}
+	v3.Auth.Identity.Token = &v3AuthToken{Id: token}
+	v3.Auth.Scope = &v3Scope{Project: scope}
+
+	err := auth.withRetries(ctx, func(ctx context.Context) error {
+		return auth.redact(auth.authenticate(ctx, c, &v3), token)
+	})
+	if err != nil {
+		return errors.Wrap(err, "rescope")
+	}
+
+	c.TenantId = project.Id
+	c.Tenant = project.Name
+	if project.DomainId != "" || project.DomainName != "" {
+		c.TenantDomainId = project.DomainId
+		c.TenantDomain = project.DomainName
+	}
+	c.AuthToken = auth.Token()
+	if c.EndpointType != "" {
+		c.StorageUrl = auth.StorageUrlForEndpoint(c.EndpointType)
+	} else {
+		c.StorageUrl = auth.StorageUrl(c.Internal)
+	}
+	return nil
+}
+
+// v3TokensUrl returns the url of the tokens resource
+func (o *options) v3TokensUrl(c *swift.Connection) string {
+	url := o.authUrl(c)
 	if !strings.HasSuffix(url, "/") {
 		url += "/"
 	}
-	url += "auth/tokens"
+	return url + "auth/tokens"
+}
+
+// TokenURL returns the url the auth request is sent to
+func (auth *v3Auth) TokenURL(c *swift.Connection) (string, error) {
+	return checkTokenUrl(c, auth.v3TokensUrl)
+}
+
+// RefreshCatalog validates the current token and rereads the catalog
+// from the validation response without reauthenticating
+//
+// The storage url of c is updated from the new catalog. It shouldn't
+// be called while c is authenticating.
+func (auth *v3Auth) RefreshCatalog(ctx context.Context, c *swift.Connection) error {
+	token := auth.Token()
+	if token == "" {
+		return errors.New("no token to refresh the catalog with")
+	}
 
-	ctx, cancel := context.WithTimeout(context.Background(), auth.timeout)
+	ctx, cancel := context.WithTimeout(ctx, requestTimeout(ctx, auth.timeout))
 	defer cancel()
-	req, err := http.NewRequestWithContext(ctx, "POST", url, bytes.NewBuffer(body))
+	req, err := http.NewRequestWithContext(ctx, "GET", auth.v3TokensUrl(c), nil)
 	if err != nil {
-		return nil, err
+		return err
 	}
-	req.Header.Set("Content-Type", "application/json")
-	req.Header.Set("User-Agent", c.UserAgent)
+	req.Header.Set("Accept", "application/json")
+	req.Header.Set("X-Auth-Token", token)
+	req.Header.Set("X-Subject-Token", token)
+	auth.setUserAgent(req, c)
 
-	resp, err := doRequest(req, c.Transport)
+	if err = auth.sign(req, nil); err != nil {
+		return err
+	}
+
+	transport, err := auth.transport(c)
+	if err != nil {
+		return err
+	}
+	resp, err := auth.doRequest(req, transport)
 	if err != nil {
-		return nil, errors.Wrapf(err, "do auth request")
+		return auth.redact(errors.Wrap(err, "do validate request"), token)
 	}
 	err = auth.Response(ctx, resp)
 	if err != nil {
-		return nil, errors.Wrapf(err, "read response")
+		return auth.redact(errors.Wrap(err, "read response"), token)
 	}
 
-	return nil, nil
+	if c.EndpointType != "" {
+		c.StorageUrl = auth.StorageUrlForEndpoint(c.EndpointType)
+	} else {
+		c.StorageUrl = auth.StorageUrl(c.Internal)
+	}
+	return nil
+}
+
+// buildV3User builds the user block of a v3 request from c
+//
+// A user Id is sent alone as Keystone ignores the domain for it and
+// strict clouds reject it. A user name is sent with the connection's
+// domain name, or failing that domain Id, if set. Application
+// credentials override this to prefer the domain Id, see
+// v3ApplicationCredentialUser.
+func buildV3User(c *swift.Connection) (*v3User, error) {
+	switch {
+	case c.UserId != "":
+		return &v3User{Id: c.UserId}, nil
+	case c.UserName == "":
+		// Make sure that Username or UserID are provided
+		return nil, fmt.Errorf("UserID or Name should be provided")
+	case c.Domain != "":
+		return &v3User{Name: c.UserName, Domain: &v3Domain{Name: c.Domain}}, nil
+	case c.DomainId != "":
+		return &v3User{Name: c.UserName, Domain: &v3Domain{Id: c.DomainId}}, nil
+	}
+	return &v3User{Name: c.UserName}, nil
+}
+
+// v3ApplicationCredentialUser builds the user block of an application
+// credential
+//
+// A credential Id needs no user. A credential name needs the user Id
+// or the user name with the user's domain Id or name, the Id taking
+// precedence if both are set. The user's domain is userDomain if set,
+// otherwise the connection's.
+func v3ApplicationCredentialUser(c *swift.Connection, userDomain *v3Domain) (*v3User, error) {
+	if userDomain != nil {
+		// Make sure the user domain is used and unambiguous
+		if userDomain.Id != "" && userDomain.Name != "" {
+			return nil, fmt.Errorf("application credential user domain Id or Name should be provided, not both")
+		}
+		if c.ApplicationCredentialId != "" || c.UserId != "" || c.UserName == "" {
+			return nil, fmt.Errorf("application credential user domain needs ApplicationCredentialName and Name")
+		}
+		return &v3User{Name: c.UserName, Domain: userDomain}, nil
+	}
+	if c.ApplicationCredentialId != "" {
+		return nil, nil
+	}
+	user, err := buildV3User(c)
+	if err != nil {
+		return nil, err
+	}
+	if user.Id == "" && c.DomainId != "" {
+		// Application credentials have always preferred the domain
+		// Id to the name, unlike passwords
+		user.Domain = &v3Domain{Id: c.DomainId}
+	}
+	if user.Id == "" && user.Domain == nil {
+		// Make sure that DomainID or DomainName are provided among Username
+		return nil, fmt.Errorf("DomainID or Domain should be provided")
+	}
+	return user, nil
+}
+
+// setDefaultDomain fills in the "Default" user domain if Keystone
+// needs one but none was configured
+//
+// Returns false if the request was left unchanged
+func (v3 *v3AuthRequest) setDefaultDomain() bool {
+	password := v3.Auth.Identity.Password
+	if password == nil || password.User.Id != "" || password.User.Domain != nil {
+		return false
+	}
+	password.User.Domain = &v3Domain{Name: v3DefaultDomain}
+	return true
+}
+
+// isDefaultDomainError returns true if err is a 400 or 401 from
+// Keystone complaining about a missing domain
+func isDefaultDomainError(err error) bool {
+	var authErr *AuthError
+	if !errors.As(err, &authErr) || (authErr.StatusCode != http.StatusBadRequest && authErr.StatusCode != http.StatusUnauthorized) {
+		return false
+	}
+	body := strings.ToLower(authErr.Body)
+	return strings.Contains(body, "default domain") || strings.Contains(body, "find domain")
 }
 
 func (auth *v3Auth) Response(_ context.Context, resp *http.Response) error {
-	auth.Auth = &v3AuthResponse{}
-	auth.Headers = resp.Header
-	err := readJson(resp, auth.Auth)
-	return err
+	return auth.readResponse(resp, true)
+}
+
+// readResponse reads resp checking the token, its expiry, catalog and
+// region if check is set
+//
+// The response is only stored once it passes the checks so a rejected
+// token is never returned. The unscoped token of auto project isn't
+// checked as the rescoped one replacing it is.
+func (auth *v3Auth) readResponse(resp *http.Response, check bool) error {
+	response := &v3AuthResponse{}
+	var raw []byte
+	var err error
+	if auth.streamingCatalog {
+		err = auth.readStreamed(resp, response)
+	} else {
+		raw, err = auth.readJson(resp, response)
+	}
+	auth.truncateCatalog(response)
+	// next is checked in place of auth until it is stored
+	next := &v3Auth{
+		options:  auth.options,
+		Region:   auth.region(),
+		Auth:     response,
+		Headers:  resp.Header,
+		raw:      raw,
+		obtained: auth.now(),
+	}
+	if err == io.EOF && next.token() != "" {
+		// Some Keystone configurations return an empty body
+		// since the token is in the header
+		err = nil
+	}
+	if err == nil && next.token() == "" {
+		err = ErrNoToken
+	}
+	if err != nil {
+		return err
+	}
+	if check {
+		if err = next.checkResponse(); err != nil {
+			return err
+		}
+	}
+	auth.respMu.Lock()
+	auth.Auth = next.Auth
+	auth.Headers = next.Headers
+	auth.raw = next.raw
+	auth.obtained = next.obtained
+	auth.respMu.Unlock()
+	return nil
+}
+
+// checkResponse checks the token, its expiry, catalog and region of a
+// response not yet stored
+func (auth *v3Auth) checkResponse() error {
+	auth.logDefaultTTL(auth.Auth.Token.ExpiresAt)
+	if err := auth.validate(auth.tokenInfo()); err != nil {
+		return err
+	}
+	if err := auth.checkTTL(auth.expires()); err != nil {
+		return err
+	}
+	if err := auth.checkRegion(auth.StorageEndpoints(), auth.Region); err != nil {
+		return err
+	}
+	return auth.checkDuplicates(auth.StorageEndpoints(), auth.Region)
+}
+
+// truncateCatalog caps the catalog of response
+func (auth *v3Auth) truncateCatalog(response *v3AuthResponse) {
+	services := response.Token.Catalog
+	types := make([]string, len(services))
+	counts := make([]int, len(services))
+	for i, service := range services {
+		types[i] = service.Type
+		counts[i] = len(service.Endpoints)
+	}
+	limits := auth.catalogLimits(types, counts)
+	if limits == nil {
+		return
+	}
+	kept := services[:0]
+	for i, service := range services {
+		if limits[i] > 0 {
+			service.Endpoints = service.Endpoints[:limits[i]]
+			kept = append(kept, service)
+		}
+	}
+	response.Token.Catalog = kept
+}
+
+// SetRegion sets the region used for endpoint selection
+//
+// This takes precedence over the connection's region. Set to "" to
+// use the connection's region again.
+func (auth *v3Auth) SetRegion(region string) {
+	auth.mu.Lock()
+	defer auth.mu.Unlock()
+	auth.regionSet = region
+	auth.Region = region
+}
+
+// ForRegion returns a view bound to region
+//
+// The view shares the options but keeps its own token and endpoints
+// so it is refreshed independently. The same view is returned for the
+// same region.
+func (auth *v3Auth) ForRegion(region string) swift.Authenticator {
+	auth.mu.Lock()
+	defer auth.mu.Unlock()
+	if view, ok := auth.regions[region]; ok {
+		return view
+	}
+	view := &v3Auth{
+		options:   auth.options,
+		timeout:   auth.timeout,
+		Region:    region,
+		regionSet: region,
+	}
+	if auth.regions == nil {
+		auth.regions = make(map[string]*v3Auth)
+	}
+	auth.regions[region] = view
+	return view
+}
+
+func (auth *v3Auth) region() string {
+	auth.mu.Lock()
+	defer auth.mu.Unlock()
+	return auth.Region
 }
 
 func (auth *v3Auth) endpointUrl(Type string, endpointType swift.EndpointType) string {
+	endpoint, _ := selectEndpoint(auth.endpoints(Type), auth.region(), endpointType)
+	return endpoint.Url
+}
+
+// storageEndpointUrl finds the storage endpoint url noting its region
+func (auth *v3Auth) storageEndpointUrl(Type string, endpointType swift.EndpointType) string {
+	if url, ok := auth.endpointOverride(Type, auth.region()); ok {
+		return url
+	}
+	endpoint, found := auth.selectStorageEndpoint(auth.endpoints(Type), auth.region(), endpointType)
+	if found {
+		auth.mu.Lock()
+		auth.selected = endpoint.Region
+		auth.mu.Unlock()
+	}
+	return endpoint.Url
+}
+
+// SelectedRegion reads the region of the storage endpoint selected
+//
+// It is set when the storage url is read and "" before.
+func (auth *v3Auth) SelectedRegion() string {
+	auth.mu.Lock()
+	defer auth.mu.Unlock()
+	return auth.selected
+}
+
+func (auth *v3Auth) catalogEndpoints() []Endpoint {
+	var endpoints []Endpoint
+	if auth.Auth == nil {
+		return endpoints
+	}
 	for _, catalog := range auth.Auth.Token.Catalog {
-		if catalog.Type == Type {
-			for _, endpoint := range catalog.Endpoints {
-				if endpoint.Interface == endpointType && (auth.Region == "" || (auth.Region == endpoint.Region)) {
-					return endpoint.Url
-				}
-			}
+		for _, endpoint := range catalog.Endpoints {
+			endpoints = append(endpoints, Endpoint{
+				ServiceType: catalog.Type,
+				Id:          endpoint.Id,
+				Region:      endpoint.Region,
+				RegionId:    endpoint.Region_Id,
+				Interface:   auth.catalogInterface(string(endpoint.Interface)),
+				Url:         endpoint.Url,
+				Enabled:     isEnabled(endpoint.Enabled),
+			})
 		}
 	}
-	return ""
+	return endpoints
+}
+
+func (auth *v3Auth) endpoints(Type string) []Endpoint {
+	return endpointsOfType(auth.catalogEndpoints(), Type)
+}
+
+// AllEndpoints lists the endpoints of all services in the catalog by
+// service type
+func (auth *v3Auth) AllEndpoints() map[string][]Endpoint {
+	return groupByType(auth.catalogEndpoints())
+}
+
+// DiagnoseEndpoint explains which endpoint is selected for
+// serviceType, region and endpointType and why the others aren't
+func (auth *v3Auth) DiagnoseEndpoint(serviceType, region string, endpointType swift.EndpointType) EndpointReport {
+	return auth.diagnoseEndpoint(auth.catalogEndpoints(), serviceType, region, endpointType)
+}
+
+// StorageEndpoints lists the storage endpoints in the catalog
+func (auth *v3Auth) StorageEndpoints() []Endpoint {
+	return auth.firstEndpoints(auth.endpoints)
+}
+
+// AvailableInterfaces lists the storage interfaces in region
+//
+// All regions are included if region is "".
+func (auth *v3Auth) AvailableInterfaces(region string) []swift.EndpointType {
+	return availableInterfaces(auth.StorageEndpoints(), region)
 }
 
 func (auth *v3Auth) StorageUrl(Internal bool) string {
@@ -299,20 +866,239 @@ func (auth *v3Auth) StorageUrl(Internal bool) string {
 	return auth.StorageUrlForEndpoint(endpointType)
 }
 
+// StorageUrlForEndpoint reads the storage url for the public,
+// internal or admin interface
 func (auth *v3Auth) StorageUrlForEndpoint(endpointType swift.EndpointType) string {
-	return auth.endpointUrl("object-store", endpointType)
+	switch endpointType {
+	case swift.EndpointTypePublic, swift.EndpointTypeInternal, swift.EndpointTypeAdmin:
+		return auth.firstEndpointUrl(auth.storageEndpointUrl, endpointType)
+	default:
+		return ""
+	}
+}
+
+// StorageURLInternal reads the internal storage url
+func (auth *v3Auth) StorageURLInternal() string {
+	return auth.StorageUrlForEndpoint(swift.EndpointTypeInternal)
+}
+
+// StorageURLPublic reads the public storage url
+func (auth *v3Auth) StorageURLPublic() string {
+	return auth.StorageUrlForEndpoint(swift.EndpointTypePublic)
+}
+
+// StorageUrlForEndpointWithFallback reads the storage url for pref
+// falling back to another interface if pref isn't in the catalog
+func (auth *v3Auth) StorageUrlForEndpointWithFallback(pref swift.EndpointType) (string, swift.EndpointType, error) {
+	return storageUrlWithFallback(auth.StorageUrlForEndpoint, pref)
 }
 
 func (auth *v3Auth) Token() string {
+	auth.respMu.RLock()
+	defer auth.respMu.RUnlock()
+	return auth.token()
+}
+
+// token reads the token with respMu held
+func (auth *v3Auth) token() string {
 	return auth.Headers.Get("X-Subject-Token")
 }
 
 func (auth *v3Auth) Expires() time.Time {
-	t, err := time.Parse(time.RFC3339, auth.Auth.Token.ExpiresAt)
-	if err != nil {
-		return time.Time{} // return Zero if not parsed
+	auth.respMu.RLock()
+	defer auth.respMu.RUnlock()
+	return auth.expires()
+}
+
+// expires reads the expiry with respMu held
+func (auth *v3Auth) expires() time.Time {
+	if auth.Auth == nil {
+		return time.Time{}
 	}
-	return t
+	// Zero if not parsed and no default TTL
+	return auth.expiresOrDefault(parseTime(auth.Auth.Token.ExpiresAt), auth.obtained)
+}
+
+// Refresh authenticates c again reporting whether the token changed
+func (auth *v3Auth) Refresh(ctx context.Context, c *swift.Connection) (bool, error) {
+	return refresh(ctx, c, auth)
+}
+
+// ExpiresUTC reads expires in UTC
+func (auth *v3Auth) ExpiresUTC() time.Time {
+	return inLocation(auth.Expires(), time.UTC)
+}
+
+// ExpiresInLocation reads expires in loc
+func (auth *v3Auth) ExpiresInLocation(loc *time.Location) time.Time {
+	return inLocation(auth.Expires(), loc)
+}
+
+// ResponseHeaders returns a copy of the headers of the last auth
+// response or nil if there isn't one
+//
+// Use it rather than the Headers field which is replaced by reauth.
+func (auth *v3Auth) ResponseHeaders() http.Header {
+	auth.respMu.RLock()
+	defer auth.respMu.RUnlock()
+	return auth.Headers.Clone()
+}
+
+// DetectClockSkew returns how far the clock of the auth server was
+// ahead of the local clock when the token was obtained, judged by its
+// issue time
+//
+// An error wrapping ErrClockSkew is returned if the skew is large
+// enough to break the expiry logic.
+func (auth *v3Auth) DetectClockSkew() (time.Duration, error) {
+	auth.respMu.RLock()
+	defer auth.respMu.RUnlock()
+	info := auth.tokenInfo()
+	return clockSkew(info.IssuedAt, info.ExpiresAt, auth.obtained)
+}
+
+// NeedsReauth returns true if there is no token or it expires within
+// buffer
+func (auth *v3Auth) NeedsReauth(buffer time.Duration) bool {
+	auth.respMu.RLock()
+	defer auth.respMu.RUnlock()
+	return auth.needsReauth(auth.token(), auth.expires(), auth.obtained, buffer)
+}
+
+// ExpiresIn returns the time left before the token expires
+func (auth *v3Auth) ExpiresIn() time.Duration {
+	return auth.ttl(auth.Expires())
+}
+
+// IsExpired returns true if the token has expired
+func (auth *v3Auth) IsExpired() bool {
+	return auth.expired(auth.Expires())
+}
+
+// TokenInfo returns information about the token
+func (auth *v3Auth) TokenInfo() TokenInfo {
+	auth.respMu.RLock()
+	defer auth.respMu.RUnlock()
+	return auth.tokenInfo()
+}
+
+// tokenInfo reads the token information with respMu held
+func (auth *v3Auth) tokenInfo() TokenInfo {
+	if auth.Auth == nil {
+		return TokenInfo{Scope: Scope{Kind: ScopeUnscoped}}
+	}
+	token := &auth.Auth.Token
+	var roles []string
+	for _, role := range token.Roles {
+		roles = append(roles, role.Name)
+	}
+	return auth.newTokenInfo(auth.token(), token.IssuedAt, auth.expires(), auth.scope(), roles)
+}
+
+// Scope reads what the token is scoped to
+func (auth *v3Auth) Scope() Scope {
+	auth.respMu.RLock()
+	defer auth.respMu.RUnlock()
+	return auth.scope()
+}
+
+// scope reads what the token is scoped to with respMu held
+func (auth *v3Auth) scope() Scope {
+	if auth.Auth == nil {
+		return Scope{Kind: ScopeUnscoped}
+	}
+	token := &auth.Auth.Token
+	switch {
+	case token.Trust.Id != "":
+		return Scope{Kind: ScopeTrust, Id: token.Trust.Id}
+	case token.Project.Id != "":
+		return Scope{
+			Kind:       ScopeProject,
+			Id:         token.Project.Id,
+			Name:       token.Project.Name,
+			DomainId:   token.Project.Domain.Id,
+			DomainName: token.Project.Domain.Name,
+		}
+	case token.Domain.Id != "":
+		return Scope{Kind: ScopeDomain, Id: token.Domain.Id, Name: token.Domain.Name}
+	case len(token.System) > 0:
+		// Keystone names the system, usually "all"
+		var id string
+		for name := range token.System {
+			id = name
+		}
+		return Scope{Kind: ScopeSystem, Id: id}
+	}
+	return Scope{Kind: ScopeUnscoped}
+}
+
+// IsScoped returns true if the token is scoped to a project, domain,
+// system or trust
+func (auth *v3Auth) IsScoped() bool {
+	return auth.Scope().Kind != ScopeUnscoped
+}
+
+// VerifyScope checks the token is scoped to the project whose name or
+// id is expectedProject
+func (auth *v3Auth) VerifyScope(expectedProject string) error {
+	auth.respMu.RLock()
+	defer auth.respMu.RUnlock()
+	if auth.Auth == nil {
+		return verifyProject(expectedProject, "", "")
+	}
+	project := auth.Auth.Token.Project
+	return verifyProject(expectedProject, project.Id, project.Name)
+}
+
+// RawResponse returns the last auth response as generic JSON
+func (auth *v3Auth) RawResponse() (map[string]interface{}, error) {
+	auth.respMu.RLock()
+	raw := auth.raw
+	auth.respMu.RUnlock()
+	return decodeRaw(raw)
+}
+
+// AuditID returns the audit id of the token or "" if there isn't one
+func (auth *v3Auth) AuditID() string {
+	auth.respMu.RLock()
+	defer auth.respMu.RUnlock()
+	if auth.Auth == nil || len(auth.Auth.Token.Audit_Ids) < 1 {
+		return ""
+	}
+	return auth.Auth.Token.Audit_Ids[0]
+}
+
+// ParentAuditID returns the audit id of the token this one was
+// derived from, for example by rescoping, or "" if there isn't one
+func (auth *v3Auth) ParentAuditID() string {
+	auth.respMu.RLock()
+	defer auth.respMu.RUnlock()
+	if auth.Auth == nil || len(auth.Auth.Token.Audit_Ids) < 2 {
+		return ""
+	}
+	return auth.Auth.Token.Audit_Ids[1]
+}
+
+// Credentials reads the token and urls of the last auth
+//
+// They are read under one lock so come from the same response. The
+// storage url is the public one.
+func (auth *v3Auth) Credentials() (token, storageURL, cdnURL string, expires time.Time) {
+	return auth.credentialsFor(swift.EndpointTypePublic)
+}
+
+// connectionCredentials reads the credentials with the storage url
+// for the interface c uses
+func (auth *v3Auth) connectionCredentials(c *swift.Connection) (token, storageURL, cdnURL string, expires time.Time) {
+	return auth.credentialsFor(connectionEndpointType(c))
+}
+
+// credentialsFor reads the credentials with the storage url for
+// endpointType
+func (auth *v3Auth) credentialsFor(endpointType swift.EndpointType) (token, storageURL, cdnURL string, expires time.Time) {
+	auth.respMu.RLock()
+	defer auth.respMu.RUnlock()
+	return auth.token(), auth.StorageUrlForEndpoint(endpointType), auth.CdnUrl(), auth.expires()
 }
 
 func (auth *v3Auth) CdnUrl() string {
@@ -321,11 +1107,75 @@ func (auth *v3Auth) CdnUrl() string {
 
 // readJson reads the response into the json type passed in
 //
+// A response with a non JSON content type is an error quoting the
+// start of the body.
+//
+// Only the first JSON value is read so trailing whitespace is
+// ignored. An empty body returns io.EOF.
+//
+// If strict decoding is enabled unknown fields are an error.
+//
+// The body read is returned so it can be kept for the raw view.
+//
 // Closes the response when done
-func readJson(resp *http.Response, result interface{}) (err error) {
+func (o *options) readJson(resp *http.Response, result interface{}) (raw []byte, err error) {
 	defer drainAndClose(resp.Body, &err)
-	decoder := json.NewDecoder(resp.Body)
-	return decoder.Decode(result)
+	if err = checkJsonContentType(resp); err != nil {
+		return nil, err
+	}
+	raw, err = ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	decoder := json.NewDecoder(bytes.NewReader(raw))
+	if o.strictJson {
+		decoder.DisallowUnknownFields()
+	}
+	return raw, decoder.Decode(result)
+}
+
+// checkJsonContentType returns an error quoting the start of the body
+// if resp doesn't have a JSON content type, or io.EOF if the body is
+// empty
+func checkJsonContentType(resp *http.Response) error {
+	contentType := resp.Header.Get("Content-Type")
+	if isJsonContentType(contentType) {
+		return nil
+	}
+	snippet, _ := ioutil.ReadAll(io.LimitReader(resp.Body, maxBodySnippet))
+	if len(snippet) == 0 {
+		return io.EOF
+	}
+	return errors.Errorf("expecting JSON but got content type %q: %s", contentType, snippet)
+}
+
+// decodeRaw decodes the raw response body into generic JSON
+//
+// Numbers are decoded as json.Number so large ids keep their full
+// precision.
+func decodeRaw(raw []byte) (map[string]interface{}, error) {
+	if raw == nil {
+		return nil, errors.New("no auth response")
+	}
+	var result map[string]interface{}
+	decoder := json.NewDecoder(bytes.NewReader(raw))
+	decoder.UseNumber()
+	if err := decoder.Decode(&result); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// isJsonContentType returns true if contentType is empty or JSON
+func isJsonContentType(contentType string) bool {
+	if contentType == "" {
+		return true
+	}
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+	return mediaType == "application/json" || strings.HasSuffix(mediaType, "+json")
 }
 
 // drainAndClose discards all data from rd and closes it.
@@ -353,8 +1203,15 @@ func flushKeepaliveConnections(transport http.RoundTripper) {
 
 func parseHeaders(resp *http.Response) error {
 	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		body, _ := ioutil.ReadAll(io.LimitReader(resp.Body, maxErrorBody))
 		drainAndClose(resp.Body, nil)
-		return fmt.Errorf("HTTP Error: %d: %s", resp.StatusCode, resp.Status)
+		authErr := &AuthError{
+			StatusCode: resp.StatusCode,
+			Status:     resp.Status,
+			Body:       string(body),
+		}
+		authErr.parseFault()
+		return authErr
 	}
 	return nil
 }
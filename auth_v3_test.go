@@ -0,0 +1,861 @@
+package auth
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ncw/swift/v2"
+)
+
+// domainRef is a domain in a v3 auth request
+type domainRef struct{ Id, Name string }
+
+// projectScope is the project scope of a v3 auth request
+type projectScope struct {
+	Id, Name string
+	Domain   *domainRef
+}
+
+// v3Request is the part of a v3 auth request the tests look at
+type v3Request struct {
+	Auth struct {
+		Identity struct {
+			Methods  []string
+			Token    *struct{ Id string }
+			Password *struct {
+				User struct {
+					Id, Name, Password string
+					Domain             *domainRef
+				}
+			}
+			ApplicationCredential *struct {
+				Id, Name, Secret string
+				User             *struct {
+					Id, Name string
+					Domain   *domainRef
+				}
+			} `json:"application_credential"`
+		}
+		Scope *struct {
+			Project *projectScope
+			Domain  *domainRef
+		}
+	}
+}
+
+// decodeV3Request decodes the body of a recorded v3 auth request
+func decodeV3Request(t *testing.T, r recorded) v3Request {
+	t.Helper()
+	var req v3Request
+	if err := json.Unmarshal([]byte(r.Body), &req); err != nil {
+		t.Fatalf("bad request body %q: %v", r.Body, err)
+	}
+	return req
+}
+
+func TestV3RescopesUnscopedToken(t *testing.T) {
+	s := newFakeServer(t, func(w http.ResponseWriter, r *http.Request, body string) {
+		writeV3Token(w, "scoped", v3TokenBody)
+	})
+	c := &swift.Connection{
+		AuthUrl:  s.URL + "/v3",
+		ApiKey:   "unscoped",
+		TenantId: "a6944d763bf64ee6a275f1263fae0352",
+	}
+	a := newAuth(t, c, 3)
+	if err := authenticate(a, c); err != nil {
+		t.Fatalf("auth failed: %v", err)
+	}
+
+	requests := s.recorded()
+	if len(requests) != 1 || requests[0].Path != "/v3/auth/tokens" {
+		t.Fatalf("want one token request got %+v", requests)
+	}
+	req := decodeV3Request(t, requests[0])
+	identity := req.Auth.Identity
+	if len(identity.Methods) != 1 || identity.Methods[0] != "token" || identity.Token == nil || identity.Token.Id != "unscoped" {
+		t.Errorf("want the token method with the unscoped token got %s", requests[0].Body)
+	}
+	if identity.Password != nil {
+		t.Errorf("password sent with the token method: %s", requests[0].Body)
+	}
+	scope := req.Auth.Scope
+	if scope == nil || scope.Project == nil || scope.Project.Id != c.TenantId || scope.Project.Domain != nil {
+		t.Errorf("want project id scope got %s", requests[0].Body)
+	}
+
+	v3 := a.(*v3Auth)
+	if got := v3.Token(); got != "scoped" {
+		t.Errorf("want the scoped token got %q", got)
+	}
+	if !v3.IsScoped() {
+		t.Error("token not scoped")
+	}
+	if got := v3.Scope(); got.Kind != ScopeProject || got.Id != c.TenantId || got.Name != "project" {
+		t.Errorf("bad scope %+v", got)
+	}
+	if got, want := v3.StorageUrl(false), "http://public.example.com/v1/AUTH_p"; got != want {
+		t.Errorf("want storage url %q got %q", want, got)
+	}
+}
+
+func TestBuildV3User(t *testing.T) {
+	for _, test := range []struct {
+		name    string
+		c       *swift.Connection
+		want    *v3User
+		wantErr bool
+	}{
+		{"id", &swift.Connection{UserId: "uid"}, &v3User{Id: "uid"}, false},
+		{"id ignores name and domain", &swift.Connection{UserId: "uid", UserName: "user", Domain: "d", DomainId: "did"}, &v3User{Id: "uid"}, false},
+		{"name", &swift.Connection{UserName: "user"}, &v3User{Name: "user"}, false},
+		{"name and domain", &swift.Connection{UserName: "user", Domain: "d"}, &v3User{Name: "user", Domain: &v3Domain{Name: "d"}}, false},
+		{"name and domain id", &swift.Connection{UserName: "user", DomainId: "did"}, &v3User{Name: "user", Domain: &v3Domain{Id: "did"}}, false},
+		{"name and both domains", &swift.Connection{UserName: "user", Domain: "d", DomainId: "did"}, &v3User{Name: "user", Domain: &v3Domain{Name: "d"}}, false},
+		{"none", &swift.Connection{Domain: "d"}, nil, true},
+	} {
+		got, err := buildV3User(test.c)
+		if gotErr := err != nil; gotErr != test.wantErr {
+			t.Errorf("%s: want error %v got %v", test.name, test.wantErr, err)
+		}
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%s: want %+v got %+v", test.name, test.want, got)
+		}
+	}
+}
+
+func TestV3PasswordUserIdSendsNoDomain(t *testing.T) {
+	s := newFakeServer(t, func(w http.ResponseWriter, r *http.Request, body string) {
+		writeV3Token(w, "token", v3TokenBody)
+	})
+	c := v3Connection(s)
+	c.UserId = "uid"
+	c.DomainId = "did"
+	if err := authenticate(newAuth(t, c, 3), c); err != nil {
+		t.Fatal(err)
+	}
+	requests := s.recorded()
+	if len(requests) != 1 {
+		t.Fatalf("want 1 request got %d", len(requests))
+	}
+	password := decodeV3Request(t, requests[0]).Auth.Identity.Password
+	if password == nil || password.User.Id != "uid" || password.User.Name != "" || password.User.Domain != nil {
+		t.Errorf("id based password auth should send only the user id: %s", requests[0].Body)
+	}
+}
+
+func TestV3ApplicationCredentialUser(t *testing.T) {
+	for _, test := range []struct {
+		name       string
+		c          *swift.Connection
+		userDomain *v3Domain
+		want       *v3User
+		wantErr    bool
+	}{
+		{"credential id", &swift.Connection{ApplicationCredentialId: "cid", UserName: "user"}, nil, nil, false},
+		{"user id", &swift.Connection{ApplicationCredentialName: "cred", UserId: "uid", DomainId: "did"}, nil, &v3User{Id: "uid"}, false},
+		{"name and domain", &swift.Connection{ApplicationCredentialName: "cred", UserName: "user", Domain: "d"}, nil, &v3User{Name: "user", Domain: &v3Domain{Name: "d"}}, false},
+		{"name and domain id", &swift.Connection{ApplicationCredentialName: "cred", UserName: "user", DomainId: "did"}, nil, &v3User{Name: "user", Domain: &v3Domain{Id: "did"}}, false},
+		{"name and both domains", &swift.Connection{ApplicationCredentialName: "cred", UserName: "user", Domain: "d", DomainId: "did"}, nil, &v3User{Name: "user", Domain: &v3Domain{Id: "did"}}, false},
+		{"name without domain", &swift.Connection{ApplicationCredentialName: "cred", UserName: "user"}, nil, nil, true},
+		{"no user", &swift.Connection{ApplicationCredentialName: "cred", Domain: "d"}, nil, nil, true},
+		{"user domain", &swift.Connection{ApplicationCredentialName: "cred", UserName: "user", DomainId: "did"}, &v3Domain{Name: "ud"}, &v3User{Name: "user", Domain: &v3Domain{Name: "ud"}}, false},
+	} {
+		got, err := v3ApplicationCredentialUser(test.c, test.userDomain)
+		if gotErr := err != nil; gotErr != test.wantErr {
+			t.Errorf("%s: want error %v got %v", test.name, test.wantErr, err)
+		}
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%s: want %+v got %+v", test.name, test.want, got)
+		}
+	}
+}
+
+func TestV3UserDomainPrecedence(t *testing.T) {
+	s := newFakeServer(t, func(w http.ResponseWriter, r *http.Request, body string) {
+		writeV3Token(w, "token", v3TokenBody)
+	})
+
+	c := v3Connection(s)
+	c.DomainId = "did"
+	if err := authenticate(newAuth(t, c, 3), c); err != nil {
+		t.Fatalf("password auth failed: %v", err)
+	}
+	c = &swift.Connection{
+		AuthUrl:                     s.URL + "/v3",
+		UserName:                    "user",
+		Domain:                      "Default",
+		DomainId:                    "did",
+		ApplicationCredentialName:   "cred",
+		ApplicationCredentialSecret: "secret",
+	}
+	if err := authenticate(newAuth(t, c, 3), c); err != nil {
+		t.Fatalf("application credential auth failed: %v", err)
+	}
+
+	requests := s.recorded()
+	if len(requests) != 2 {
+		t.Fatalf("want 2 requests got %d", len(requests))
+	}
+	password := decodeV3Request(t, requests[0]).Auth.Identity.Password
+	if password == nil || password.User.Domain == nil || password.User.Domain.Name != "Default" || password.User.Domain.Id != "" {
+		t.Errorf("password user should use the domain name: %s", requests[0].Body)
+	}
+	appCred := decodeV3Request(t, requests[1]).Auth.Identity.ApplicationCredential
+	if appCred == nil || appCred.User == nil || appCred.User.Domain == nil || appCred.User.Domain.Id != "did" || appCred.User.Domain.Name != "" {
+		t.Errorf("application credential user should use the domain id: %s", requests[1].Body)
+	}
+}
+
+func TestV3SeparateUserAndProjectDomains(t *testing.T) {
+	s := newFakeServer(t, func(w http.ResponseWriter, r *http.Request, body string) {
+		writeV3Token(w, "token", v3TokenBody)
+	})
+	for _, test := range []struct {
+		name                      string
+		c                         *swift.Connection
+		userDomain, projectDomain domainRef
+	}{
+		{
+			name:          "user domain id and project domain name",
+			c:             &swift.Connection{UserName: "user", DomainId: "abc123", Tenant: "project", TenantDomain: "customers"},
+			userDomain:    domainRef{Id: "abc123"},
+			projectDomain: domainRef{Name: "customers"},
+		},
+		{
+			name:          "user domain name and project domain id",
+			c:             &swift.Connection{UserName: "user", Domain: "users", Tenant: "project", TenantDomainId: "def456"},
+			userDomain:    domainRef{Name: "users"},
+			projectDomain: domainRef{Id: "def456"},
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			c := test.c
+			c.AuthUrl = s.URL + "/v3"
+			c.ApiKey = "secret"
+			if err := authenticate(newAuth(t, c, 3), c); err != nil {
+				t.Fatalf("auth failed: %v", err)
+			}
+			requests := s.recorded()
+			last := requests[len(requests)-1]
+			req := decodeV3Request(t, last)
+			password := req.Auth.Identity.Password
+			if password == nil || password.User.Domain == nil || *password.User.Domain != test.userDomain {
+				t.Errorf("want user domain %+v got %s", test.userDomain, last.Body)
+			}
+			scope := req.Auth.Scope
+			if scope == nil || scope.Project == nil || scope.Project.Name != "project" || scope.Project.Domain == nil || *scope.Project.Domain != test.projectDomain {
+				t.Errorf("want project domain %+v got %s", test.projectDomain, last.Body)
+			}
+		})
+	}
+}
+
+func TestV3RetriesWithDefaultDomain(t *testing.T) {
+	for _, status := range []int{http.StatusBadRequest, http.StatusUnauthorized} {
+		t.Run(http.StatusText(status), func(t *testing.T) {
+			s := newFakeServer(t, func(w http.ResponseWriter, r *http.Request, body string) {
+				if !strings.Contains(body, `"domain"`) {
+					writeJson(w, status, `{"error":{"code":400,"message":"Could not find domain: None."}}`)
+					return
+				}
+				writeV3Token(w, "token", v3TokenBody)
+			})
+			c := v3Connection(s)
+			c.Domain = ""
+			c.TenantId = "p"
+			c.Tenant = ""
+			logger := &recordingLogger{}
+			if err := authenticate(newAuth(t, c, 3, WithLogger(logger)), c); err != nil {
+				t.Fatalf("auth failed: %v", err)
+			}
+			requests := s.recorded()
+			if len(requests) != 2 {
+				t.Fatalf("want 2 requests got %d", len(requests))
+			}
+			user := decodeV3Request(t, requests[1]).Auth.Identity.Password.User
+			if user.Domain == nil || user.Domain.Name != "Default" {
+				t.Errorf("want the Default user domain on retry got %s", requests[1].Body)
+			}
+			if !logger.contains("Default") {
+				t.Errorf("retry not logged: %q", logger.messages)
+			}
+		})
+	}
+}
+
+func TestV3NoDefaultDomainRetry(t *testing.T) {
+	for _, test := range []struct {
+		name  string
+		fault string
+		setup func(c *swift.Connection)
+	}{
+		{"other fault", `{"error":{"code":401,"message":"The request you have made requires authentication."}}`, func(c *swift.Connection) { c.Domain = "" }},
+		{"domain set", `{"error":{"code":401,"message":"Could not find domain: users."}}`, func(c *swift.Connection) { c.Domain = "users" }},
+		{"user id", `{"error":{"code":400,"message":"Could not find domain: None."}}`, func(c *swift.Connection) { c.Domain = ""; c.UserName = ""; c.UserId = "uid" }},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			s := newFakeServer(t, func(w http.ResponseWriter, r *http.Request, body string) {
+				writeJson(w, http.StatusUnauthorized, test.fault)
+			})
+			c := v3Connection(s)
+			c.TenantId = "p"
+			test.setup(c)
+			if err := authenticate(newAuth(t, c, 3), c); err == nil {
+				t.Fatal("expecting auth to fail")
+			}
+			if n := len(s.recorded()); n != 1 {
+				t.Errorf("want 1 request got %d", n)
+			}
+		})
+	}
+}
+
+func TestV3ReadTokenBody(t *testing.T) {
+	for _, test := range []struct {
+		name    string
+		token   string
+		body    string
+		wantErr bool
+	}{
+		{"empty body", "tok", "", false},
+		{"trailing whitespace", "tok", v3TokenBody + "\n\n  \t", false},
+		{"truncated body", "tok", v3TokenBody[:len(v3TokenBody)/2], true},
+		{"empty body without token", "", "", true},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			s := newFakeServer(t, func(w http.ResponseWriter, r *http.Request, body string) {
+				if test.token != "" {
+					w.Header().Set("X-Subject-Token", test.token)
+				}
+				writeJson(w, http.StatusCreated, test.body)
+			})
+			c := v3Connection(s)
+			a := newAuth(t, c, AuthV3)
+			err := authenticate(a, c)
+			if test.wantErr {
+				if err == nil {
+					t.Fatal("expecting auth to fail")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := a.Token(); got != test.token {
+				t.Errorf("token = %q, want %q", got, test.token)
+			}
+		})
+	}
+}
+
+func TestV3HtmlErrorPage(t *testing.T) {
+	s := newFakeServer(t, func(w http.ResponseWriter, r *http.Request, body string) {
+		w.Header().Set("Content-Type", "text/html")
+		w.Header().Set("X-Subject-Token", "token")
+		w.WriteHeader(http.StatusCreated)
+		_, _ = w.Write([]byte("<html><body>Gateway says no</body></html>"))
+	})
+	c := v3Connection(s)
+	err := authenticate(newAuth(t, c, 3), c)
+	if err == nil || !strings.Contains(err.Error(), `"text/html"`) || !strings.Contains(err.Error(), "Gateway says no") {
+		t.Errorf("err = %v, want the content type and body snippet", err)
+	}
+	requests := s.recorded()
+	if len(requests) != 1 {
+		t.Fatalf("want 1 request got %d", len(requests))
+	}
+	if got := requests[0].Header.Get("Accept"); got != "application/json" {
+		t.Errorf("Accept = %q, want application/json", got)
+	}
+}
+
+func TestV3RawResponseKeepsLargeNumbers(t *testing.T) {
+	body := strings.Replace(v3TokenBody, `"is_domain": false,`, `"is_domain": false, "extension_id": 12345678901234567890,`, 1)
+	a := authenticateWith(t, 3, body)
+	raw, err := a.(RawResponder).RawResponse()
+	if err != nil {
+		t.Fatal(err)
+	}
+	token, _ := raw["token"].(map[string]interface{})
+	if got, ok := token["extension_id"].(json.Number); !ok || got.String() != "12345678901234567890" {
+		t.Errorf("extension_id = %#v, want json.Number 12345678901234567890", token["extension_id"])
+	}
+	if a.Token() != "token" {
+		t.Errorf("typed decoding failed with a large number in the body")
+	}
+}
+
+func TestV3DefaultProjectDomain(t *testing.T) {
+	for _, test := range []struct {
+		name string
+		opts []Option
+		want *domainRef
+	}{
+		{"default", nil, &domainRef{Name: "Default"}},
+		{"disabled", []Option{WithDefaultProjectDomain(false)}, nil},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			s := newFakeServer(t, func(w http.ResponseWriter, r *http.Request, body string) {
+				writeV3Token(w, "token", v3TokenBody)
+			})
+			c := v3Connection(s)
+			c.UserName, c.UserId, c.Domain = "", "uid", ""
+			if err := authenticate(newAuth(t, c, 3, test.opts...), c); err != nil {
+				t.Fatal(err)
+			}
+			requests := s.recorded()
+			if len(requests) != 1 {
+				t.Fatalf("want 1 request got %d", len(requests))
+			}
+			project := decodeV3Request(t, requests[0]).Auth.Scope.Project
+			if project == nil || project.Name != "project" {
+				t.Fatalf("not scoped to the project: %s", requests[0].Body)
+			}
+			if !reflect.DeepEqual(project.Domain, test.want) {
+				t.Errorf("project domain = %+v, want %+v", project.Domain, test.want)
+			}
+		})
+	}
+}
+
+func TestEffectiveProjectDomain(t *testing.T) {
+	for _, test := range []struct {
+		name string
+		set  func(c *swift.Connection)
+		want Domain
+	}{
+		{"tenant domain first", func(c *swift.Connection) {
+			c.TenantDomain, c.TenantDomainId, c.Domain, c.DomainId = "td", "tdid", "d", "did"
+		}, Domain{Name: "td"}},
+		{"tenant domain id", func(c *swift.Connection) {
+			c.TenantDomainId, c.Domain, c.DomainId = "tdid", "d", "did"
+		}, Domain{Id: "tdid"}},
+		{"user domain", func(c *swift.Connection) {
+			c.Domain, c.DomainId = "d", "did"
+		}, Domain{Name: "d"}},
+		{"user domain id", func(c *swift.Connection) {
+			c.DomainId = "did"
+		}, Domain{Id: "did"}},
+		{"Default fallback", func(c *swift.Connection) {
+			c.UserName, c.UserId = "", "uid"
+		}, Domain{Name: "Default"}},
+		{"project id", func(c *swift.Connection) {
+			c.Domain, c.Tenant, c.TenantId = "d", "", "pid"
+		}, Domain{}},
+		{"trust", func(c *swift.Connection) {
+			c.Domain, c.TrustId = "d", "trust"
+		}, Domain{}},
+		{"no project", func(c *swift.Connection) {
+			c.Domain, c.Tenant = "d", ""
+		}, Domain{}},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			s := newFakeServer(t, func(w http.ResponseWriter, r *http.Request, body string) {
+				writeV3Token(w, "token", v3TokenBody)
+			})
+			c := &swift.Connection{AuthUrl: s.URL + "/v3", UserName: "user", ApiKey: "secret", Tenant: "project"}
+			test.set(c)
+			got := EffectiveProjectDomain(c)
+			if got != test.want {
+				t.Errorf("effective domain = %+v, want %+v", got, test.want)
+			}
+
+			// Request scopes with the same domain
+			if err := authenticate(newAuth(t, c, 3), c); err != nil {
+				t.Fatal(err)
+			}
+			requests := s.recorded()
+			if len(requests) != 1 {
+				t.Fatalf("want 1 request got %d", len(requests))
+			}
+			var sent Domain
+			if scope := decodeV3Request(t, requests[0]).Auth.Scope; scope != nil && scope.Project != nil && scope.Project.Domain != nil {
+				sent = Domain{Id: scope.Project.Domain.Id, Name: scope.Project.Domain.Name}
+			}
+			if sent != got {
+				t.Errorf("request scoped with domain %+v, want %+v", sent, got)
+			}
+		})
+	}
+}
+
+func TestV3TokenDomainScope(t *testing.T) {
+	for _, test := range []struct {
+		name     string
+		opts     []Option
+		domain   string
+		domainId string
+		want     *domainRef
+	}{
+		{"unscoped by default", nil, "users", "", nil},
+		{"domain name", []Option{WithTokenDomainScope(true)}, "users", "", &domainRef{Name: "users"}},
+		{"domain id", []Option{WithTokenDomainScope(true)}, "users", "did", &domainRef{Id: "did"}},
+		{"no domain", []Option{WithTokenDomainScope(true)}, "", "", nil},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			s := newFakeServer(t, func(w http.ResponseWriter, r *http.Request, body string) {
+				writeV3Token(w, "token", v3TokenBody)
+			})
+			c := &swift.Connection{
+				AuthUrl:  s.URL + "/v3",
+				ApiKey:   "existing",
+				Domain:   test.domain,
+				DomainId: test.domainId,
+			}
+			if err := authenticate(newAuth(t, c, 3, test.opts...), c); err != nil {
+				t.Fatal(err)
+			}
+			requests := s.recorded()
+			if len(requests) != 1 {
+				t.Fatalf("want 1 request got %d", len(requests))
+			}
+			req := decodeV3Request(t, requests[0])
+			if token := req.Auth.Identity.Token; token == nil || token.Id != "existing" {
+				t.Fatalf("token not sent: %s", requests[0].Body)
+			}
+			var got *domainRef
+			if req.Auth.Scope != nil {
+				got = req.Auth.Scope.Domain
+			}
+			if !reflect.DeepEqual(got, test.want) {
+				t.Errorf("domain scope = %+v, want %+v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestV3RefreshCatalog(t *testing.T) {
+	moved := v3BodyWithStorage(v3Endpoint("public", "R", "http://moved.example.com/v1/AUTH_p"))
+	s := newFakeServer(t, func(w http.ResponseWriter, r *http.Request, body string) {
+		if r.Method == "GET" {
+			w.Header().Set("X-Subject-Token", r.Header.Get("X-Subject-Token"))
+			writeJson(w, http.StatusOK, moved)
+			return
+		}
+		writeV3Token(w, "token", v3TokenBody)
+	})
+	c := v3Connection(s)
+	a := newAuth(t, c, AuthV3)
+	if err := authenticate(a, c); err != nil {
+		t.Fatal(err)
+	}
+	if err := a.(CatalogRefresher).RefreshCatalog(context.Background(), c); err != nil {
+		t.Fatal(err)
+	}
+	if want := "http://moved.example.com/v1/AUTH_p"; c.StorageUrl != want || a.StorageUrl(false) != want {
+		t.Errorf("storage url = %q (connection %q), want %q", a.StorageUrl(false), c.StorageUrl, want)
+	}
+	if a.Token() != "token" {
+		t.Errorf("token = %q, want it kept", a.Token())
+	}
+	requests := s.recorded()
+	if len(requests) != 2 {
+		t.Fatalf("want 2 requests got %d", len(requests))
+	}
+	if r := requests[1]; r.Method != "GET" || r.Path != "/v3/auth/tokens" || r.Header.Get("X-Auth-Token") != "token" || r.Header.Get("X-Subject-Token") != "token" {
+		t.Errorf("bad validate request %s %s %v", r.Method, r.Path, r.Header)
+	}
+}
+
+func TestV3ApplicationCredentialNameJson(t *testing.T) {
+	for _, test := range []struct {
+		name     string
+		domain   string
+		domainId string
+		want     string
+	}{
+		{"domain id", "", "did", `{"name":"cred","secret":"secret","user":{"domain":{"id":"did"},"name":"user"}}`},
+		{"domain name", "users", "", `{"name":"cred","secret":"secret","user":{"domain":{"name":"users"},"name":"user"}}`},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			s := newFakeServer(t, func(w http.ResponseWriter, r *http.Request, body string) {
+				writeV3Token(w, "token", v3TokenBody)
+			})
+			c := &swift.Connection{
+				AuthUrl:                     s.URL + "/v3",
+				UserName:                    "user",
+				Domain:                      test.domain,
+				DomainId:                    test.domainId,
+				ApplicationCredentialName:   "cred",
+				ApplicationCredentialSecret: "secret",
+			}
+			if err := authenticate(newAuth(t, c, 3), c); err != nil {
+				t.Fatal(err)
+			}
+			requests := s.recorded()
+			if len(requests) != 1 {
+				t.Fatalf("want 1 request got %d", len(requests))
+			}
+			var req struct {
+				Auth struct {
+					Identity struct {
+						ApplicationCredential json.RawMessage `json:"application_credential"`
+					}
+				}
+			}
+			if err := json.Unmarshal([]byte(requests[0].Body), &req); err != nil {
+				t.Fatal(err)
+			}
+			if got := string(req.Auth.Identity.ApplicationCredential); got != test.want {
+				t.Errorf("application_credential = %s, want %s", got, test.want)
+			}
+		})
+	}
+}
+
+func TestV3RequireProjectDomain(t *testing.T) {
+	for _, test := range []struct {
+		name    string
+		opts    []Option
+		setup   func(c *swift.Connection)
+		want    *domainRef
+		wantErr bool
+	}{
+		{"unset", nil, func(c *swift.Connection) {}, nil, true},
+		{"default allowed", []Option{WithDefaultProjectDomain(true)}, func(c *swift.Connection) {}, &domainRef{Name: "Default"}, false},
+		{"default disabled", []Option{WithDefaultProjectDomain(false)}, func(c *swift.Connection) {}, nil, true},
+		{"project domain", nil, func(c *swift.Connection) { c.TenantDomain = "projects" }, &domainRef{Name: "projects"}, false},
+		{"user domain", nil, func(c *swift.Connection) { c.DomainId = "did" }, &domainRef{Id: "did"}, false},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			s := newFakeServer(t, func(w http.ResponseWriter, r *http.Request, body string) {
+				writeV3Token(w, "token", v3TokenBody)
+			})
+			c := v3Connection(s)
+			c.UserName, c.UserId, c.Domain = "", "uid", ""
+			test.setup(c)
+			opts := append([]Option{WithRequireProjectDomain(true)}, test.opts...)
+			err := authenticate(newAuth(t, c, 3, opts...), c)
+			requests := s.recorded()
+			if test.wantErr {
+				if err == nil || !strings.Contains(err.Error(), `project "project" by name`) || len(requests) != 0 {
+					t.Errorf("err = %v after %d requests, want the project domain required", err, len(requests))
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(requests) != 1 {
+				t.Fatalf("want 1 request got %d", len(requests))
+			}
+			project := decodeV3Request(t, requests[0]).Auth.Scope.Project
+			if project == nil || !reflect.DeepEqual(project.Domain, test.want) {
+				t.Errorf("project scope %s, want domain %+v", requests[0].Body, test.want)
+			}
+		})
+	}
+}
+
+func TestV3ApplicationCredentialUserDomainOption(t *testing.T) {
+	for _, test := range []struct {
+		name       string
+		domainId   string
+		domainName string
+		credId     string
+		want       *domainRef
+		wantErr    bool
+	}{
+		{"domain name", "", "users", "", &domainRef{Name: "users"}, false},
+		{"domain id", "uid-domain", "", "", &domainRef{Id: "uid-domain"}, false},
+		{"both", "uid-domain", "users", "", nil, true},
+		{"credential id", "", "users", "cid", nil, true},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			s := newFakeServer(t, func(w http.ResponseWriter, r *http.Request, body string) {
+				writeV3Token(w, "token", v3TokenBody)
+			})
+			c := &swift.Connection{
+				AuthUrl:                     s.URL + "/v3",
+				UserName:                    "user",
+				Domain:                      "appcreds",
+				ApplicationCredentialId:     test.credId,
+				ApplicationCredentialName:   "cred",
+				ApplicationCredentialSecret: "secret",
+			}
+			err := authenticate(newAuth(t, c, 3, WithApplicationCredentialUserDomain(test.domainId, test.domainName)), c)
+			requests := s.recorded()
+			if test.wantErr {
+				if err == nil || len(requests) != 0 {
+					t.Errorf("err = %v after %d requests, want an error before sending", err, len(requests))
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(requests) != 1 {
+				t.Fatalf("want 1 request got %d", len(requests))
+			}
+			appCred := decodeV3Request(t, requests[0]).Auth.Identity.ApplicationCredential
+			if appCred == nil || appCred.User == nil || appCred.User.Name != "user" || !reflect.DeepEqual(appCred.User.Domain, test.want) {
+				t.Errorf("application credential %s, want user domain %+v", requests[0].Body, test.want)
+			}
+		})
+	}
+}
+
+func TestV3AmbiguousCredentialsWarning(t *testing.T) {
+	for _, test := range []struct {
+		name       string
+		appCred    bool
+		opts       []Option
+		wantMethod string
+		want       []string
+	}{
+		{"password only", false, nil, "password", nil},
+		{"application credential only", true, nil, "application_credential", nil},
+		{"both", true, nil, "application_credential", []string{"password is set but application credential auth is used"}},
+		{"TOTP", true, []Option{WithTOTP(func(ctx context.Context) (string, error) { return "123456", nil })}, "totp", []string{
+			"application credential is set but TOTP auth is used",
+			"password is set but TOTP auth is used",
+		}},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			s := newFakeServer(t, func(w http.ResponseWriter, r *http.Request, body string) {
+				writeV3Token(w, "token", v3TokenBody)
+			})
+			c := v3Connection(s)
+			if test.appCred {
+				c.ApplicationCredentialId, c.ApplicationCredentialSecret = "acid", "secret"
+				if test.want == nil {
+					c.UserName, c.ApiKey = "", ""
+				}
+			}
+			a := newAuth(t, c, 3, test.opts...)
+			if err := authenticate(a, c); err != nil {
+				t.Fatal(err)
+			}
+			requests := s.recorded()
+			if methods := decodeV3Request(t, requests[len(requests)-1]).Auth.Identity.Methods; len(methods) != 1 || methods[0] != test.wantMethod {
+				t.Errorf("methods = %q, want %q", methods, test.wantMethod)
+			}
+			if got := a.(Warner).Warnings(); !reflect.DeepEqual(got, test.want) {
+				t.Errorf("warnings = %q, want %q", got, test.want)
+			}
+		})
+	}
+}
+
+func TestV3ProjectIdDomain(t *testing.T) {
+	for _, test := range []struct {
+		name         string
+		opts         []Option
+		tenantDomain string
+		want         *domainRef
+	}{
+		{"id only by default", nil, "pd", nil},
+		{"tenant domain", []Option{WithProjectIdDomain(true)}, "pd", &domainRef{Name: "pd"}},
+		{"user domain", []Option{WithProjectIdDomain(true)}, "", &domainRef{Name: "users"}},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			s := newFakeServer(t, func(w http.ResponseWriter, r *http.Request, body string) {
+				writeV3Token(w, "token", v3TokenBody)
+			})
+			c := v3Connection(s)
+			c.Tenant, c.TenantId, c.TenantDomain, c.Domain = "", "pid", test.tenantDomain, "users"
+			if err := authenticate(newAuth(t, c, 3, test.opts...), c); err != nil {
+				t.Fatal(err)
+			}
+			requests := s.recorded()
+			if len(requests) != 1 {
+				t.Fatalf("want 1 request got %d", len(requests))
+			}
+			project := decodeV3Request(t, requests[0]).Auth.Scope.Project
+			if project == nil || project.Id != "pid" || project.Name != "" {
+				t.Fatalf("not scoped to the project by id: %s", requests[0].Body)
+			}
+			if !reflect.DeepEqual(project.Domain, test.want) {
+				t.Errorf("project domain = %+v, want %+v", project.Domain, test.want)
+			}
+		})
+	}
+}
+
+func TestV3Rescope(t *testing.T) {
+	// otherProjectBody is v3TokenBody scoped to project "other"
+	otherProjectBody := strings.NewReplacer(
+		`"id": "a6944d763bf64ee6a275f1263fae0352"`, `"id": "pid2"`,
+		`"name": "project"`, `"name": "other"`,
+		"AUTH_p", "AUTH_pid2",
+	).Replace(v3TokenBody)
+	for _, test := range []struct {
+		name    string
+		project ProjectRef
+		want    *projectScope
+	}{
+		{"id", ProjectRef{Id: "pid2"}, &projectScope{Id: "pid2"}},
+		{"name in the connection's domain", ProjectRef{Name: "other"}, &projectScope{Name: "other", Domain: &domainRef{Name: "Default"}}},
+		{"name and domain", ProjectRef{Name: "other", DomainId: "d2"}, &projectScope{Name: "other", Domain: &domainRef{Id: "d2"}}},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			s := newFakeServer(t, func(w http.ResponseWriter, r *http.Request, body string) {
+				if strings.Contains(body, `"password"`) {
+					writeV3Token(w, "token1", v3TokenBody)
+				} else {
+					writeV3Token(w, "token2", otherProjectBody)
+				}
+			})
+			c := v3Connection(s)
+			a := newAuth(t, c, 3)
+			c.Auth = a
+			if err := c.Authenticate(context.Background()); err != nil {
+				t.Fatal(err)
+			}
+			if err := a.(Rescoper).Rescope(context.Background(), c, test.project); err != nil {
+				t.Fatal(err)
+			}
+
+			requests := s.recorded()
+			if len(requests) != 2 {
+				t.Fatalf("want 2 requests got %d", len(requests))
+			}
+			req := decodeV3Request(t, requests[1])
+			identity := req.Auth.Identity
+			if len(identity.Methods) != 1 || identity.Methods[0] != "token" || identity.Token == nil || identity.Token.Id != "token1" {
+				t.Errorf("want the token method with the current token got %s", requests[1].Body)
+			}
+			if identity.Password != nil || strings.Contains(requests[1].Body, "secret") {
+				t.Errorf("rescope sent the password: %s", requests[1].Body)
+			}
+			if req.Auth.Scope == nil || !reflect.DeepEqual(req.Auth.Scope.Project, test.want) {
+				t.Errorf("scoped to %s, want %+v", requests[1].Body, test.want)
+			}
+
+			if got := a.(ScopeReader).Scope(); got.Id != "pid2" || got.Name != "other" {
+				t.Errorf("scope = %+v, want project pid2", got)
+			}
+			if c.AuthToken != "token2" || c.StorageUrl != "http://public.example.com/v1/AUTH_pid2" {
+				t.Errorf("connection has token %q and storage url %q, want the rescoped ones", c.AuthToken, c.StorageUrl)
+			}
+			if c.TenantId != test.project.Id || c.Tenant != test.project.Name {
+				t.Errorf("connection project = %q/%q, want %+v", c.TenantId, c.Tenant, test.project)
+			}
+		})
+	}
+}
+
+func TestV3RescopeExpiredToken(t *testing.T) {
+	s := newFakeServer(t, func(w http.ResponseWriter, r *http.Request, body string) {
+		writeV3Token(w, "token", shortV3Body)
+	})
+	c := v3Connection(s)
+	clock := &manualClock{now: ttlNow}
+	a := newAuth(t, c, 3, WithClock(clock))
+	if err := authenticate(a, c); err != nil {
+		t.Fatal(err)
+	}
+	clock.Advance(time.Hour)
+	if err := a.(Rescoper).Rescope(context.Background(), c, ProjectRef{Id: "pid2"}); err == nil || !strings.Contains(err.Error(), "expired") {
+		t.Errorf("err = %v, want the token to have expired", err)
+	}
+	if n := len(s.recorded()); n != 1 {
+		t.Errorf("sent %d requests, want only the auth", n)
+	}
+}
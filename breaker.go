@@ -0,0 +1,133 @@
+package auth
+
+import (
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// ErrCircuitOpen is returned without contacting the auth server while
+// the circuit breaker set with WithCircuitBreaker is open
+var ErrCircuitOpen = errors.New("auth circuit breaker open")
+
+// BreakerState is the state of the circuit breaker
+type BreakerState int
+
+// Circuit breaker states
+const (
+	BreakerClosed   BreakerState = iota // authentication allowed
+	BreakerOpen                         // authentication short circuited
+	BreakerHalfOpen                     // the next authentication is a trial
+)
+
+func (s BreakerState) String() string {
+	switch s {
+	case BreakerClosed:
+		return "closed"
+	case BreakerOpen:
+		return "open"
+	case BreakerHalfOpen:
+		return "half-open"
+	}
+	return "unknown"
+}
+
+// BreakerStater is an optional interface to read the state of the
+// circuit breaker
+type BreakerStater interface {
+	BreakerState() BreakerState
+}
+
+// WithCircuitBreaker stops authenticating for cooldown after failures
+// consecutive failures, returning ErrCircuitOpen instead
+//
+// This prevents a reauth storm hammering the auth server with known
+// bad credentials. After the cooldown one trial authentication is
+// allowed which closes the breaker if it succeeds and opens it again
+// if not.
+func WithCircuitBreaker(failures int, cooldown time.Duration) Option {
+	return func(o *options) {
+		if failures <= 0 {
+			o.breaker = nil
+			return
+		}
+		o.breaker = &circuitBreaker{
+			threshold: failures,
+			cooldown:  cooldown,
+		}
+	}
+}
+
+// circuitBreaker counts consecutive auth failures
+type circuitBreaker struct {
+	mu        sync.Mutex
+	threshold int           // failures which open the breaker
+	cooldown  time.Duration // how long the breaker stays open
+	failures  int           // consecutive failures
+	openedAt  time.Time     // when the breaker last opened
+	trial     bool          // the half-open trial is in flight
+}
+
+// state returns the state of the breaker at now
+//
+// Call with mu held
+func (b *circuitBreaker) state(now time.Time) BreakerState {
+	if b.failures < b.threshold {
+		return BreakerClosed
+	}
+	if now.Before(b.openedAt.Add(b.cooldown)) {
+		return BreakerOpen
+	}
+	return BreakerHalfOpen
+}
+
+// allow returns ErrCircuitOpen if authentication isn't allowed
+//
+// When half-open only one caller is allowed, as the trial, until its
+// result is recorded.
+func (b *circuitBreaker) allow(now time.Time) (trial bool, err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	switch b.state(now) {
+	case BreakerOpen:
+		return false, errors.Wrapf(ErrCircuitOpen, "after %d failures, retry after %v", b.failures, b.openedAt.Add(b.cooldown).Sub(now))
+	case BreakerHalfOpen:
+		if b.trial {
+			return false, errors.Wrapf(ErrCircuitOpen, "after %d failures, trial in progress", b.failures)
+		}
+		b.trial = true
+		return true, nil
+	}
+	return false, nil
+}
+
+// record notes the result of an authentication which was the
+// half-open trial if trial is set
+func (b *circuitBreaker) record(err error, now time.Time, trial bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if trial {
+		b.trial = false
+	}
+	if err == nil {
+		b.failures = 0
+		return
+	}
+	b.failures++
+	if b.failures >= b.threshold {
+		b.openedAt = now
+	}
+}
+
+// BreakerState returns the state of the circuit breaker
+//
+// It is always BreakerClosed if no breaker is set.
+func (o *options) BreakerState() BreakerState {
+	if o.breaker == nil {
+		return BreakerClosed
+	}
+	o.breaker.mu.Lock()
+	defer o.breaker.mu.Unlock()
+	return o.breaker.state(o.now())
+}
@@ -0,0 +1,88 @@
+package auth
+
+import (
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+func TestBreakerAllowsOneHalfOpenTrial(t *testing.T) {
+	var mu sync.Mutex
+	fail := true
+	trialStarted := make(chan struct{}, 1)
+	release := make(chan struct{})
+	s := newFakeServer(t, func(w http.ResponseWriter, r *http.Request, body string) {
+		mu.Lock()
+		failing := fail
+		mu.Unlock()
+		if failing {
+			writeJson(w, http.StatusInternalServerError, `{}`)
+			return
+		}
+		trialStarted <- struct{}{}
+		<-release
+		writeV3Token(w, "token", v3TokenBody)
+	})
+	a := newAuth(t, v3Connection(s), 3, WithCircuitBreaker(1, 50*time.Millisecond))
+	breaker := a.(interface{ BreakerState() BreakerState })
+
+	if err := authenticate(a, v3Connection(s)); err == nil {
+		t.Fatal("expecting the first auth to fail")
+	}
+	if got := breaker.BreakerState(); got != BreakerOpen {
+		t.Fatalf("want %v got %v", BreakerOpen, got)
+	}
+	if err := authenticate(a, v3Connection(s)); !errors.Is(err, ErrCircuitOpen) {
+		t.Fatalf("want ErrCircuitOpen got %v", err)
+	}
+	if n := len(s.recorded()); n != 1 {
+		t.Fatalf("open breaker sent a request: %d requests", n)
+	}
+
+	mu.Lock()
+	fail = false
+	mu.Unlock()
+	time.Sleep(60 * time.Millisecond)
+	if got := breaker.BreakerState(); got != BreakerHalfOpen {
+		t.Fatalf("want %v got %v", BreakerHalfOpen, got)
+	}
+
+	trialErr := make(chan error, 1)
+	go func() {
+		trialErr <- authenticate(a, v3Connection(s))
+	}()
+	<-trialStarted
+
+	var wg sync.WaitGroup
+	errs := make([]error, 5)
+	for i := range errs {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			errs[i] = authenticate(a, v3Connection(s))
+		}(i)
+	}
+	wg.Wait()
+	for i, err := range errs {
+		if !errors.Is(err, ErrCircuitOpen) {
+			t.Errorf("caller %d during the trial: want ErrCircuitOpen got %v", i, err)
+		}
+	}
+
+	close(release)
+	if err := <-trialErr; err != nil {
+		t.Fatalf("trial failed: %v", err)
+	}
+	if n := len(s.recorded()); n != 2 {
+		t.Errorf("want 2 requests got %d", n)
+	}
+	if got := breaker.BreakerState(); got != BreakerClosed {
+		t.Errorf("want %v got %v", BreakerClosed, got)
+	}
+	if err := authenticate(a, v3Connection(s)); err != nil {
+		t.Errorf("closed breaker: %v", err)
+	}
+}
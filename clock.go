@@ -0,0 +1,57 @@
+package auth
+
+import (
+	"context"
+	"time"
+)
+
+// Clock is the source of time for token expiry, the circuit breaker,
+// the rate limit and the waits between retries
+type Clock interface {
+	Now() time.Time
+	After(d time.Duration) <-chan time.Time
+}
+
+// realClock is the Clock used by default
+type realClock struct{}
+
+func (realClock) Now() time.Time {
+	return time.Now()
+}
+
+func (realClock) After(d time.Duration) <-chan time.Time {
+	return time.After(d)
+}
+
+// WithClock sets the clock used for all time dependent behaviour
+//
+// This allows reauth logic to be tested deterministically with a fake
+// clock. Deadlines of contexts still use the real time.
+func WithClock(clock Clock) Option {
+	return func(o *options) {
+		o.clock = clock
+	}
+}
+
+// getClock returns the clock to use
+func (o *options) getClock() Clock {
+	if o.clock == nil {
+		return realClock{}
+	}
+	return o.clock
+}
+
+// now returns the current time
+func (o *options) now() time.Time {
+	return o.getClock().Now()
+}
+
+// sleep waits for d returning false if ctx is done first
+func (o *options) sleep(ctx context.Context, d time.Duration) bool {
+	select {
+	case <-ctx.Done():
+		return false
+	case <-o.getClock().After(d):
+		return true
+	}
+}
@@ -0,0 +1,102 @@
+package auth
+
+import (
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// manualClock is a Clock only moved by Advance or by waiting on it
+type manualClock struct {
+	mu    sync.Mutex
+	now   time.Time
+	waits []time.Duration
+}
+
+func (c *manualClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+// After records the wait and moves the clock past it at once
+func (c *manualClock) After(d time.Duration) <-chan time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.waits = append(c.waits, d)
+	c.now = c.now.Add(d)
+	ch := make(chan time.Time, 1)
+	ch <- c.now
+	return ch
+}
+
+func (c *manualClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = c.now.Add(d)
+}
+
+func TestClockDrivesExpiry(t *testing.T) {
+	clock := &manualClock{now: ttlNow}
+	a := authenticateWith(t, AuthV3, shortV3Body, WithClock(clock))
+	expirer := a.(Expirer)
+	reauther := a.(*v3Auth)
+	for _, step := range []struct {
+		advance     time.Duration
+		wantIn      time.Duration
+		wantExpired bool
+		wantReauth  bool // with a 30s buffer
+	}{
+		{0, time.Minute, false, false},
+		{30 * time.Second, 30 * time.Second, false, true},
+		{29 * time.Second, time.Second, false, true},
+		{time.Second, 0, true, true},
+		{time.Hour, 0, true, true},
+	} {
+		clock.Advance(step.advance)
+		now := clock.Now().Format(time.RFC3339)
+		if got := expirer.ExpiresIn(); got != step.wantIn {
+			t.Errorf("at %s expires in %v, want %v", now, got, step.wantIn)
+		}
+		if got := expirer.IsExpired(); got != step.wantExpired {
+			t.Errorf("at %s expired = %v, want %v", now, got, step.wantExpired)
+		}
+		if got := reauther.NeedsReauth(30 * time.Second); got != step.wantReauth {
+			t.Errorf("at %s needs reauth = %v, want %v", now, got, step.wantReauth)
+		}
+	}
+}
+
+func TestClockDrivesRetryWaits(t *testing.T) {
+	var sent int32
+	s := newFakeServer(t, func(w http.ResponseWriter, r *http.Request, body string) {
+		if atomic.AddInt32(&sent, 1) <= 2 {
+			writeJson(w, http.StatusServiceUnavailable, `{}`)
+			return
+		}
+		writeV3Token(w, "token", v3TokenBody)
+	})
+	c := v3Connection(s)
+	clock := &manualClock{now: ttlNow}
+	a := newAuth(t, c, AuthV3, WithClock(clock), WithRetries(2), WithJitterSeed(1))
+	start := time.Now()
+	if err := authenticate(a, c); err != nil {
+		t.Fatal(err)
+	}
+	if len(clock.waits) != 2 {
+		t.Fatalf("waited on the clock %d times, want 2", len(clock.waits))
+	}
+	var waited time.Duration
+	for _, wait := range clock.waits {
+		waited += wait
+	}
+	if got := clock.Now().Sub(ttlNow); got != waited {
+		t.Errorf("clock moved %v, want the %v waited", got, waited)
+	}
+	// The waits were on the fake clock rather than real time
+	if elapsed := time.Since(start); elapsed >= waited {
+		t.Errorf("took %v, want less than the %v waited", elapsed, waited)
+	}
+}
@@ -0,0 +1,71 @@
+package auth
+
+import (
+	"context"
+	"io"
+	"sync"
+)
+
+// defaultHostConcurrency is the most auth requests in flight to one
+// host by default
+const defaultHostConcurrency = 8
+
+// WithHostConcurrency limits the auth requests in flight to each auth
+// url host to n so a fleet of goroutines can't all hit Keystone at
+// once
+//
+// Requests over the limit wait for their turn or for the context to
+// be done. A request is in flight until its response body is closed.
+// The limit is per authenticator and its views. It is 8 by default
+// and 0 removes it.
+func WithHostConcurrency(n int) Option {
+	return func(o *options) {
+		o.hostConcurrency = n
+	}
+}
+
+// hostLimiter holds a semaphore per host
+type hostLimiter struct {
+	mu   sync.Mutex
+	sems map[string]chan struct{}
+}
+
+// acquireHost waits for a slot for host returning the function to free it
+func (o *options) acquireHost(ctx context.Context, host string) (release func(), err error) {
+	if o.hostConcurrency <= 0 {
+		return func() {}, nil
+	}
+	l := &o.hostLimiter
+	l.mu.Lock()
+	if l.sems == nil {
+		l.sems = make(map[string]chan struct{})
+	}
+	sem := l.sems[host]
+	if sem == nil {
+		sem = make(chan struct{}, o.hostConcurrency)
+		l.sems[host] = sem
+	}
+	l.mu.Unlock()
+	select {
+	case sem <- struct{}{}:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	var once sync.Once
+	return func() {
+		once.Do(func() { <-sem })
+	}, nil
+}
+
+// releaseBody is a response body which frees the host slot of its
+// request when closed
+type releaseBody struct {
+	io.ReadCloser
+	release func()
+}
+
+func (b *releaseBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.release()
+	return err
+}
@@ -0,0 +1,189 @@
+package auth
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"runtime"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ncw/swift/v2"
+	"github.com/pkg/errors"
+)
+
+// tokenReader is the part of an Authenticator read concurrently
+// with reauth
+type tokenReader interface {
+	Token() string
+	Credentials() (token, storageURL, cdnURL string, expires time.Time)
+	NeedsReauth(buffer time.Duration) bool
+}
+
+func TestReadDuringReauth(t *testing.T) {
+	s := newFakeServer(t, func(w http.ResponseWriter, r *http.Request, body string) {
+		switch r.URL.Path {
+		case "/auth/v1.0":
+			w.Header().Set("X-Auth-Token", "token")
+			w.Header().Set("X-Storage-Url", "http://storage.example.com/v1/AUTH_a")
+			w.WriteHeader(http.StatusNoContent)
+		case "/v2.0/tokens":
+			writeJson(w, http.StatusOK, v2TokenBody)
+		default:
+			writeV3Token(w, "token", v3TokenBody)
+		}
+	})
+	for _, test := range []struct {
+		name    string
+		version AuthVersion
+		c       func() *swift.Connection
+	}{
+		{"v1", 1, func() *swift.Connection {
+			return &swift.Connection{AuthUrl: s.URL + "/auth/v1.0", UserName: "user", ApiKey: "key"}
+		}},
+		{"v2", 2, func() *swift.Connection { return v2Connection(s) }},
+		{"v3", 3, func() *swift.Connection { return v3Connection(s) }},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			a := newAuth(t, test.c(), test.version)
+			reader := a.(tokenReader)
+			// swift.Connection serialises reauth but reads the token
+			// from other goroutines meanwhile
+			done := make(chan struct{})
+			var wg sync.WaitGroup
+			go func() {
+				defer close(done)
+				for i := 0; i < 5; i++ {
+					if err := authenticate(a, test.c()); err != nil {
+						t.Errorf("auth failed: %v", err)
+					}
+				}
+			}()
+			for i := 0; i < 2; i++ {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					for {
+						select {
+						case <-done:
+							return
+						default:
+						}
+						_ = reader.Token()
+						_, _, _, _ = reader.Credentials()
+						_ = reader.NeedsReauth(0)
+						if headers, ok := a.(interface{ ResponseHeaders() http.Header }); ok {
+							_ = headers.ResponseHeaders()
+						}
+						if expirer, ok := a.(swift.Expireser); ok {
+							_ = expirer.Expires()
+						}
+						if scoper, ok := a.(Scoper); ok {
+							_ = scoper.IsScoped()
+						}
+						if verifier, ok := a.(ScopeVerifier); ok {
+							_ = verifier.VerifyScope("")
+						}
+						if scope, ok := a.(ScopeReader); ok {
+							_ = scope.Scope()
+						}
+						if informer, ok := a.(TokenInformer); ok {
+							_ = informer.TokenInfo()
+						}
+						if raw, ok := a.(RawResponder); ok {
+							_, _ = raw.RawResponse()
+						}
+						if auditor, ok := a.(Auditor); ok {
+							_ = auditor.AuditID()
+							_ = auditor.ParentAuditID()
+						}
+						if expirer, ok := a.(Expirer); ok {
+							_ = expirer.ExpiresIn()
+							_ = expirer.IsExpired()
+						}
+						if v1, ok := a.(*v1Auth); ok {
+							// v1 urls come from the headers too
+							_ = v1.StorageUrl(false)
+							_ = v1.CdnUrl()
+						}
+						runtime.Gosched()
+					}
+				}()
+			}
+			wg.Wait()
+			if got := reader.Token(); got == "" {
+				t.Error("no token after reauth")
+			}
+		})
+	}
+}
+
+func TestHostConcurrencyLimit(t *testing.T) {
+	const limit = 2
+	var mu sync.Mutex
+	inFlight, most := 0, 0
+	s := newFakeServer(t, func(w http.ResponseWriter, r *http.Request, body string) {
+		mu.Lock()
+		inFlight++
+		if inFlight > most {
+			most = inFlight
+		}
+		mu.Unlock()
+		time.Sleep(20 * time.Millisecond)
+		mu.Lock()
+		inFlight--
+		mu.Unlock()
+		writeV3Token(w, "token", v3TokenBody)
+	})
+	a := newAuth(t, v3Connection(s), 3, WithHostConcurrency(limit))
+	regions := a.(RegionBinder)
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		// Views share the limit but not the token
+		view := regions.ForRegion(fmt.Sprintf("R%d", i))
+		go func() {
+			defer wg.Done()
+			if err := authenticate(view, v3Connection(s)); err != nil {
+				t.Errorf("auth failed: %v", err)
+			}
+		}()
+	}
+	wg.Wait()
+	if n := len(s.recorded()); n != 10 {
+		t.Errorf("want 10 requests got %d", n)
+	}
+	if most > limit {
+		t.Errorf("want at most %d requests in flight got %d", limit, most)
+	}
+}
+
+func TestHostConcurrencyWaitRespectsContext(t *testing.T) {
+	started := make(chan struct{})
+	release := make(chan struct{})
+	s := newFakeServer(t, func(w http.ResponseWriter, r *http.Request, body string) {
+		close(started)
+		<-release
+		writeV3Token(w, "token", v3TokenBody)
+	})
+	a := newAuth(t, v3Connection(s), 3, WithHostConcurrency(1))
+	first := make(chan error, 1)
+	go func() {
+		first <- authenticate(a, v3Connection(s))
+	}()
+	<-started
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if _, err := a.Request(ctx, v3Connection(s)); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("want the wait for a slot to time out got %v", err)
+	}
+	close(release)
+	if err := <-first; err != nil {
+		t.Fatalf("first auth failed: %v", err)
+	}
+	if n := len(s.recorded()); n != 1 {
+		t.Errorf("want 1 request got %d", n)
+	}
+}
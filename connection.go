@@ -0,0 +1,100 @@
+package auth
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/ncw/swift/v2"
+	"github.com/pkg/errors"
+)
+
+// defaultConnectTimeout is used by NewConnection if no ConnectTimeout
+// is set - the same default as swift.Connection
+const defaultConnectTimeout = 10 * time.Second
+
+// ConnectionParams describes a swift.Connection for NewConnection
+type ConnectionParams struct {
+	AuthUrl     string
+	AuthVersion AuthVersion // 0 to guess from AuthUrl
+
+	UserName string
+	UserId   string
+	ApiKey   string // password, API key or token
+	Domain   string // user's domain name (v3 auth only)
+	DomainId string // user's domain id (v3 auth only)
+
+	ApplicationCredentialId     string // v3 auth only
+	ApplicationCredentialName   string // v3 auth only
+	ApplicationCredentialSecret string // v3 auth only
+
+	Tenant         string // v2, v3 auth only
+	TenantId       string // v2, v3 auth only
+	TenantDomain   string // v3 auth only
+	TenantDomainId string // v3 auth only
+	TrustId        string // v3 auth only
+	Region         string // v2, v3 auth only
+
+	EndpointType swift.EndpointType // overrides Internal if set
+	Internal     bool
+
+	UserAgent      string
+	ConnectTimeout time.Duration // default 10s, also the auth timeout
+	Timeout        time.Duration // data channel timeout
+	Transport      http.RoundTripper
+
+	Options []Option // options for the Authenticator
+}
+
+// NewConnection makes a swift.Connection from params with an
+// Authenticator from New installed
+//
+// The credential fields of the connection are set consistently with
+// what the Authenticator expects.
+func NewConnection(params ConnectionParams) (*swift.Connection, error) {
+	if params.AuthUrl == "" {
+		return nil, errors.New("AuthUrl should be provided")
+	}
+	if params.UserName == "" && params.UserId == "" && params.ApiKey == "" &&
+		params.ApplicationCredentialSecret == "" {
+		return nil, errors.New("credentials should be provided")
+	}
+	if params.ApplicationCredentialId != "" {
+		// The name is ignored if the Id is set
+		params.ApplicationCredentialName = ""
+	}
+	connectTimeout := params.ConnectTimeout
+	if connectTimeout == 0 {
+		connectTimeout = defaultConnectTimeout
+	}
+
+	authenticator, err := New(params.AuthUrl, params.ApiKey, params.AuthVersion, connectTimeout, params.Options...)
+	if err != nil {
+		return nil, err
+	}
+
+	return &swift.Connection{
+		AuthUrl:                     params.AuthUrl,
+		AuthVersion:                 params.AuthVersion,
+		UserName:                    params.UserName,
+		UserId:                      params.UserId,
+		ApiKey:                      params.ApiKey,
+		Domain:                      params.Domain,
+		DomainId:                    params.DomainId,
+		ApplicationCredentialId:     params.ApplicationCredentialId,
+		ApplicationCredentialName:   params.ApplicationCredentialName,
+		ApplicationCredentialSecret: params.ApplicationCredentialSecret,
+		Tenant:                      params.Tenant,
+		TenantId:                    params.TenantId,
+		TenantDomain:                params.TenantDomain,
+		TenantDomainId:              params.TenantDomainId,
+		TrustId:                     params.TrustId,
+		Region:                      params.Region,
+		EndpointType:                params.EndpointType,
+		Internal:                    params.Internal,
+		UserAgent:                   params.UserAgent,
+		ConnectTimeout:              connectTimeout,
+		Timeout:                     params.Timeout,
+		Transport:                   params.Transport,
+		Auth:                        authenticator,
+	}, nil
+}
@@ -0,0 +1,55 @@
+package auth
+
+import (
+	"context"
+	"net/http"
+	"testing"
+)
+
+func TestNewConnectionAuthenticates(t *testing.T) {
+	s := newFakeServer(t, func(w http.ResponseWriter, r *http.Request, body string) {
+		writeV3Token(w, "token", v3TokenBody)
+	})
+	c, err := NewConnection(ConnectionParams{
+		AuthUrl:  s.URL + "/v3",
+		UserName: "user",
+		ApiKey:   "secret",
+		Domain:   "Default",
+		Tenant:   "project",
+		Internal: true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.Auth == nil {
+		t.Fatal("no Authenticator installed")
+	}
+	if err := c.Authenticate(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if c.AuthToken != "token" {
+		t.Errorf("AuthToken = %q, want token", c.AuthToken)
+	}
+	if want := "http://internal.example.com/v1/AUTH_p"; c.StorageUrl != want {
+		t.Errorf("StorageUrl = %q, want %q", c.StorageUrl, want)
+	}
+	requests := s.recorded()
+	if len(requests) != 1 {
+		t.Fatalf("want 1 request got %d", len(requests))
+	}
+	password := decodeV3Request(t, requests[0]).Auth.Identity.Password
+	if password == nil || password.User.Name != "user" || password.User.Password != "secret" {
+		t.Errorf("connection credentials not sent: %s", requests[0].Body)
+	}
+}
+
+func TestNewConnectionRejectsMissingFields(t *testing.T) {
+	for _, params := range []ConnectionParams{
+		{UserName: "user", ApiKey: "secret"},
+		{AuthUrl: "http://example.com/v3"},
+	} {
+		if _, err := NewConnection(params); err == nil {
+			t.Errorf("NewConnection(%+v) succeeded", params)
+		}
+	}
+}
@@ -0,0 +1,149 @@
+package auth
+
+import (
+	"context"
+	"io/ioutil"
+	"strings"
+
+	"github.com/ncw/swift/v2"
+	"github.com/pkg/errors"
+)
+
+// Credentials are supplied by a CredentialProvider
+type Credentials struct {
+	// Password or API key (or token for v3 token auth)
+	Secret string
+	// v2 auth: CredentialFormPassword or CredentialFormApiKey to say
+	// which Secret is, or "" to try both
+	Form string
+}
+
+// CredentialProvider supplies credentials afresh for each
+// authentication, for example to pick up rotated keys
+type CredentialProvider interface {
+	Credentials(ctx context.Context) (Credentials, error)
+}
+
+// WithCredentialProvider gets the password or API key from provider
+// each time authentication is done instead of using
+// Connection.ApiKey
+func WithCredentialProvider(provider CredentialProvider) Option {
+	return func(o *options) {
+		o.credentialProvider = provider
+	}
+}
+
+// credentials returns the password or API key to authenticate c
+// with from the provider if set
+func (o *options) credentials(ctx context.Context, c *swift.Connection) (Credentials, error) {
+	if o.credentialProvider != nil {
+		creds, err := o.credentialProvider.Credentials(ctx)
+		if err != nil {
+			return Credentials{}, errors.Wrap(err, "credential provider")
+		}
+		return creds, nil
+	}
+	apiKey, err := o.apiKey(c)
+	if err != nil {
+		return Credentials{}, err
+	}
+	return Credentials{Secret: apiKey}, nil
+}
+
+// ErrEmptyCredential is returned when there is no password or API
+// key to send
+var ErrEmptyCredential = errors.New("empty credential")
+
+// WithEmptyCredentials allows authenticating with an empty password or
+// API key, for the rare auth server which accepts anonymous requests
+//
+// An empty credential is an error by default as it is usually a
+// mistake which the server only reports as 401 Unauthorized.
+func WithEmptyCredentials(allowed bool) Option {
+	return func(o *options) {
+		o.allowEmptyCredential = allowed
+	}
+}
+
+// checkSecret returns ErrEmptyCredential naming what if secret is
+// empty and that isn't allowed
+func (o *options) checkSecret(secret, what string) error {
+	if secret != "" || o.allowEmptyCredential {
+		return nil
+	}
+	return errors.Wrapf(ErrEmptyCredential, "%s should be provided in ApiKey", what)
+}
+
+// WithPasswordFile reads the password (or API key) from path each
+// time authentication is done instead of using Connection.ApiKey
+//
+// This suits secrets mounted as files which may be rotated.
+func WithPasswordFile(path string) Option {
+	return func(o *options) {
+		o.passwordFile = path
+	}
+}
+
+// WithApplicationCredentialSecretFile reads the application
+// credential secret from path each time authentication is done
+// instead of using Connection.ApplicationCredentialSecret
+func WithApplicationCredentialSecretFile(path string) Option {
+	return func(o *options) {
+		o.applicationCredentialSecretFile = path
+	}
+}
+
+// apiKey returns the password or API key to authenticate c with
+func (o *options) apiKey(c *swift.Connection) (string, error) {
+	if o.passwordFile == "" {
+		return c.ApiKey, nil
+	}
+	return readSecretFile(o.passwordFile)
+}
+
+// applicationCredentialSecret returns the application credential
+// secret to authenticate c with
+func (o *options) applicationCredentialSecret(c *swift.Connection) (string, error) {
+	if o.applicationCredentialSecretFile == "" {
+		return c.ApplicationCredentialSecret, nil
+	}
+	return readSecretFile(o.applicationCredentialSecretFile)
+}
+
+// readSecretFile reads a secret from path ignoring surrounding
+// whitespace such as a trailing newline
+func readSecretFile(path string) (string, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return "", errors.Wrap(err, "read secret file")
+	}
+	return strings.TrimSpace(string(data)), nil
+}
+
+// PasscodeFunc returns a TOTP passcode for v3 auth
+type PasscodeFunc func(ctx context.Context) (string, error)
+
+// WithTOTP makes v3 auth use only the totp method with the passcode
+// from passcode and the user from the connection
+//
+// This suits service accounts which authenticate with TOTP alone.
+func WithTOTP(passcode PasscodeFunc) Option {
+	return func(o *options) {
+		o.totpPasscode = passcode
+	}
+}
+
+// WithApplicationCredentialUserDomain sets the domain of the user in
+// a v3 application credential request by Id or name, when it differs
+// from the connection's domain
+//
+// It needs ApplicationCredentialName and the user Name to be set.
+func WithApplicationCredentialUserDomain(domainId, domainName string) Option {
+	return func(o *options) {
+		if domainId == "" && domainName == "" {
+			o.appCredUserDomain = nil
+			return
+		}
+		o.appCredUserDomain = &v3Domain{Id: domainId, Name: domainName}
+	}
+}
@@ -0,0 +1,166 @@
+package auth
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/ncw/swift/v2"
+	"github.com/pkg/errors"
+)
+
+func TestEmptyCredentials(t *testing.T) {
+	s := newFakeServer(t, func(w http.ResponseWriter, r *http.Request, body string) {
+		writeJson(w, http.StatusUnauthorized, `{"error":{"code":401,"message":"no credentials"}}`)
+	})
+	for _, test := range []struct {
+		name    string
+		version AuthVersion
+		c       func() *swift.Connection
+	}{
+		{"v1", 1, func() *swift.Connection {
+			return &swift.Connection{AuthUrl: s.URL + "/auth/v1.0", UserName: "user"}
+		}},
+		{"v2", 2, func() *swift.Connection {
+			c := v2Connection(s)
+			c.ApiKey = ""
+			return c
+		}},
+		{"v3 password", 3, func() *swift.Connection {
+			c := v3Connection(s)
+			c.ApiKey = ""
+			return c
+		}},
+		{"v3 token", 3, func() *swift.Connection {
+			return &swift.Connection{AuthUrl: s.URL + "/v3", TenantId: "p"}
+		}},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			before := len(s.recorded())
+			c := test.c()
+			err := authenticate(newAuth(t, c, test.version), c)
+			if !errors.Is(err, ErrEmptyCredential) {
+				t.Errorf("want ErrEmptyCredential got %v", err)
+			}
+			if n := len(s.recorded()) - before; n != 0 {
+				t.Errorf("empty credential sent in %d requests", n)
+			}
+
+			c = test.c()
+			err = authenticate(newAuth(t, c, test.version, WithEmptyCredentials(true)), c)
+			if errors.Is(err, ErrEmptyCredential) {
+				t.Errorf("empty credential rejected when allowed: %v", err)
+			}
+			if n := len(s.recorded()) - before; n == 0 {
+				t.Error("empty credential not sent when allowed")
+			}
+		})
+	}
+}
+
+func TestSecretFiles(t *testing.T) {
+	s := newFakeServer(t, func(w http.ResponseWriter, r *http.Request, body string) {
+		writeV3Token(w, "token", v3TokenBody)
+	})
+	dir := t.TempDir()
+	write := func(name, secret string) string {
+		path := filepath.Join(dir, name)
+		if err := ioutil.WriteFile(path, []byte(secret+"\n"), 0600); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+
+	t.Run("application credential", func(t *testing.T) {
+		path := write("appcred", "first")
+		c := &swift.Connection{AuthUrl: s.URL + "/v3", ApplicationCredentialId: "cid"}
+		a := newAuth(t, c, 3, WithApplicationCredentialSecretFile(path))
+		for _, want := range []string{"first", "rotated"} {
+			write("appcred", want)
+			if err := authenticate(a, c); err != nil {
+				t.Fatalf("auth failed: %v", err)
+			}
+			requests := s.recorded()
+			appCred := decodeV3Request(t, requests[len(requests)-1]).Auth.Identity.ApplicationCredential
+			if appCred == nil || appCred.Secret != want {
+				t.Errorf("want secret %q from the file got %s", want, requests[len(requests)-1].Body)
+			}
+		}
+	})
+
+	t.Run("password", func(t *testing.T) {
+		path := write("password", "from-file")
+		c := v3Connection(s)
+		c.ApiKey = ""
+		if err := authenticate(newAuth(t, c, 3, WithPasswordFile(path)), c); err != nil {
+			t.Fatalf("auth failed: %v", err)
+		}
+		requests := s.recorded()
+		password := decodeV3Request(t, requests[len(requests)-1]).Auth.Identity.Password
+		if password == nil || password.User.Password != "from-file" {
+			t.Errorf("want the password from the file got %s", requests[len(requests)-1].Body)
+		}
+	})
+
+	t.Run("missing file", func(t *testing.T) {
+		before := len(s.recorded())
+		c := v3Connection(s)
+		err := authenticate(newAuth(t, c, 3, WithPasswordFile(filepath.Join(dir, "missing"))), c)
+		if err == nil || !strings.Contains(err.Error(), "read secret file") {
+			t.Errorf("want a read secret file error got %v", err)
+		}
+		if n := len(s.recorded()) - before; n != 0 {
+			t.Errorf("want no request got %d", n)
+		}
+	})
+}
+
+// rotatingProvider supplies the next of its API keys on each call
+type rotatingProvider struct {
+	keys []string
+	next int
+}
+
+func (p *rotatingProvider) Credentials(ctx context.Context) (Credentials, error) {
+	key := p.keys[p.next]
+	p.next++
+	return Credentials{Secret: key, Form: CredentialFormApiKey}, nil
+}
+
+func TestV2CredentialProviderRotation(t *testing.T) {
+	s := v2FormServer(t)
+	c := v2Connection(s)
+	c.ApiKey = "unused"
+	a := newAuth(t, c, AuthV2, WithCredentialProvider(&rotatingProvider{keys: []string{"key1", "key2"}}))
+	for i := 0; i < 2; i++ {
+		if err := authenticate(a, c); err != nil {
+			t.Fatalf("auth %d: %v", i, err)
+		}
+	}
+	requests := s.recorded()
+	if len(requests) != 2 {
+		t.Fatalf("sent %d requests, want 2 without trying the password form", len(requests))
+	}
+	for i, want := range []string{"key1", "key2"} {
+		var req struct {
+			Auth struct {
+				ApiKeyCredentials *struct {
+					ApiKey string
+				} `json:"RAX-KSKEY:apiKeyCredentials"`
+			}
+		}
+		if err := json.Unmarshal([]byte(requests[i].Body), &req); err != nil {
+			t.Fatal(err)
+		}
+		if req.Auth.ApiKeyCredentials == nil || req.Auth.ApiKeyCredentials.ApiKey != want {
+			t.Errorf("request %d sent %s, want API key %q", i, requests[i].Body, want)
+		}
+		if strings.Contains(requests[i].Body, "unused") {
+			t.Errorf("request %d sent the connection's ApiKey", i)
+		}
+	}
+}
@@ -0,0 +1,167 @@
+package auth
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+// masked replaces secrets in debug dumps
+const masked = "***"
+
+// maskedHeaders are the headers whose values are masked in dumps
+var maskedHeaders = []string{
+	"Authorization",
+	"X-Auth-Key",
+	"X-Auth-Token",
+	"X-Subject-Token",
+	"X-Storage-Token",
+	"X-Service-Token",
+	v3ReceiptHeader,
+}
+
+// maskedKeys are the JSON keys whose values are masked in dumps
+var maskedKeys = map[string]bool{
+	"password": true,
+	"secret":   true,
+	"apikey":   true,
+	"passcode": true,
+}
+
+// Exchange is a dump of an auth request and its response with the
+// secrets masked
+type Exchange struct {
+	Method         string
+	URL            string
+	RequestHeader  http.Header
+	RequestBody    string
+	StatusCode     int
+	Status         string
+	ResponseHeader http.Header
+	ResponseBody   string
+}
+
+// Debugger is an optional interface to read the last auth request
+// and response when debugging is enabled with WithDebug
+type Debugger interface {
+	LastExchange() *Exchange
+}
+
+// debugState holds the last exchange captured
+type debugState struct {
+	mu   sync.Mutex
+	last *Exchange
+}
+
+// WithDebug captures each auth request and response so the last one
+// can be read with LastExchange
+//
+// Passwords, secrets, tokens and receipts are masked in the dump, as
+// are bodies which aren't JSON.
+func WithDebug(debug bool) Option {
+	return func(o *options) {
+		o.debug = debug
+	}
+}
+
+// LastExchange returns the last auth request and response captured,
+// or nil if there isn't one or debugging isn't enabled
+func (o *options) LastExchange() *Exchange {
+	o.debugState.mu.Lock()
+	defer o.debugState.mu.Unlock()
+	return o.debugState.last
+}
+
+// dumpRequest starts an Exchange from r
+func (o *options) dumpRequest(r *http.Request) *Exchange {
+	x := &Exchange{
+		Method:        r.Method,
+		URL:           r.URL.String(),
+		RequestHeader: maskHeader(r.Header, o.v1TokenHeader()),
+	}
+	if r.GetBody != nil {
+		if body, err := r.GetBody(); err == nil {
+			data, _ := ioutil.ReadAll(body)
+			_ = body.Close()
+			x.RequestBody = maskBody(data)
+		}
+	}
+	return x
+}
+
+// dumpResponse completes x from resp
+//
+// The body of resp is replaced so it can still be read.
+func (o *options) dumpResponse(x *Exchange, resp *http.Response) {
+	x.StatusCode = resp.StatusCode
+	x.Status = resp.Status
+	x.ResponseHeader = maskHeader(resp.Header, o.v1TokenHeader())
+	data, _ := ioutil.ReadAll(resp.Body)
+	_ = resp.Body.Close()
+	resp.Body = ioutil.NopCloser(bytes.NewReader(data))
+	x.ResponseBody = maskBody(data)
+}
+
+// saveExchange records x as the last exchange
+func (o *options) saveExchange(x *Exchange) {
+	o.debugState.mu.Lock()
+	defer o.debugState.mu.Unlock()
+	o.debugState.last = x
+}
+
+// maskHeader returns a copy of h with the secret values masked
+// including those of the extra headers
+func maskHeader(h http.Header, extra ...string) http.Header {
+	h = h.Clone()
+	for _, name := range append(maskedHeaders, extra...) {
+		if h.Get(name) != "" {
+			h.Set(name, masked)
+		}
+	}
+	return h
+}
+
+// maskBody returns data with the secret values masked if it is JSON
+//
+// Other bodies can't be searched for secrets so are masked entirely.
+func maskBody(data []byte) string {
+	if len(data) == 0 {
+		return ""
+	}
+	var v interface{}
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	if err := decoder.Decode(&v); err != nil {
+		return fmt.Sprintf("%s (%d bytes not JSON)", masked, len(data))
+	}
+	maskValue(v, "")
+	out, err := json.Marshal(v)
+	if err != nil {
+		return fmt.Sprintf("%s (%d bytes)", masked, len(data))
+	}
+	return string(out)
+}
+
+// maskValue masks the secrets in the decoded JSON v which is the
+// value of key
+func maskValue(v interface{}, key string) {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		for k, value := range v {
+			lower := strings.ToLower(k)
+			if _, isString := value.(string); isString && (maskedKeys[lower] || (lower == "id" && strings.ToLower(key) == "token")) {
+				v[k] = masked
+				continue
+			}
+			maskValue(value, k)
+		}
+	case []interface{}:
+		for _, value := range v {
+			maskValue(value, key)
+		}
+	}
+}
@@ -0,0 +1,66 @@
+package auth
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestDebugMasksSecrets(t *testing.T) {
+	s := newFakeServer(t, func(w http.ResponseWriter, r *http.Request, body string) {
+		w.Header().Set(v3ReceiptHeader, "RECEIPT")
+		writeV3Token(w, "TOKEN", v3TokenBody)
+	})
+	c := v3Connection(s)
+	c.ApiKey = "PASSWORD"
+	a := newAuth(t, c, AuthV3, WithDebug(true))
+	if err := authenticate(a, c); err != nil {
+		t.Fatal(err)
+	}
+	x := a.(Debugger).LastExchange()
+	if x == nil {
+		t.Fatal("no exchange captured")
+	}
+	for _, v := range []string{x.RequestBody, x.ResponseBody, x.ResponseHeader.Get("X-Subject-Token"), x.ResponseHeader.Get(v3ReceiptHeader)} {
+		for _, secret := range []string{"PASSWORD", "TOKEN", "RECEIPT"} {
+			if strings.Contains(v, secret) {
+				t.Errorf("%s not masked in %q", secret, v)
+			}
+		}
+	}
+	if !strings.Contains(x.RequestBody, `"user"`) {
+		t.Errorf("request body masked entirely: %q", x.RequestBody)
+	}
+}
+
+func TestDebugMasksNonJsonBody(t *testing.T) {
+	s := newFakeServer(t, func(w http.ResponseWriter, r *http.Request, body string) {
+		w.Header().Set("Content-Type", "text/plain")
+		_, _ = w.Write([]byte("token=TOKEN"))
+	})
+	c := v3Connection(s)
+	a := newAuth(t, c, AuthV3, WithDebug(true), WithRetries(0))
+	if err := authenticate(a, c); err == nil {
+		t.Fatal("expected non JSON response to fail")
+	}
+	x := a.(Debugger).LastExchange()
+	if x == nil || strings.Contains(x.ResponseBody, "TOKEN") || !strings.HasPrefix(x.ResponseBody, masked) {
+		t.Errorf("non JSON body not masked: %+v", x)
+	}
+}
+
+func TestDebugMasksV1TokenHeader(t *testing.T) {
+	s := newFakeServer(t, func(w http.ResponseWriter, r *http.Request, body string) {
+		w.Header().Set("X-Custom-Token", "TOKEN")
+		w.Header().Set("X-Storage-Url", "http://storage.example.com")
+	})
+	conn := v3Connection(s)
+	conn.AuthUrl = s.URL + "/v1.0"
+	a := newAuth(t, conn, AuthV1, WithDebug(true), WithV1Headers("X-Custom-Token", ""))
+	if err := authenticate(a, conn); err != nil {
+		t.Fatal(err)
+	}
+	if got := a.(Debugger).LastExchange().ResponseHeader.Get("X-Custom-Token"); got != masked {
+		t.Errorf("v1 token header = %q, want masked", got)
+	}
+}
@@ -0,0 +1,127 @@
+package auth
+
+import (
+	"fmt"
+
+	"github.com/ncw/swift/v2"
+)
+
+// EndpointCandidate is a catalog endpoint considered by
+// DiagnoseEndpoint
+type EndpointCandidate struct {
+	Endpoint Endpoint
+	Selected bool
+	Reasons  []string // why it was rejected
+}
+
+// EndpointReport explains the selection of an endpoint
+type EndpointReport struct {
+	ServiceType  string   // the type selected from, or requested if none was
+	ServiceTypes []string // the types tried in order
+	Region       string
+	EndpointType swift.EndpointType
+	Candidates   []EndpointCandidate
+	Selected     *Endpoint // nil if none matched or overridden
+	Override     string    // url set with WithEndpointOverride used instead
+}
+
+// EndpointDiagnoser is an optional interface to explain why an
+// endpoint was or wasn't selected
+//
+// A serviceType of "" diagnoses the storage url, trying the types set
+// with WithServiceTypes in turn.
+type EndpointDiagnoser interface {
+	DiagnoseEndpoint(serviceType, region string, endpointType swift.EndpointType) EndpointReport
+}
+
+// InterfaceLister is an optional interface to list the interfaces the
+// catalog has storage endpoints for
+type InterfaceLister interface {
+	AvailableInterfaces(region string) []swift.EndpointType
+}
+
+// availableInterfaces returns the interfaces of endpoints in region,
+// or in any region if region is "", in catalog order
+func availableInterfaces(endpoints []Endpoint, region string) []swift.EndpointType {
+	var interfaces []swift.EndpointType
+	for _, endpoint := range endpoints {
+		if !endpoint.Enabled || (region != "" && endpoint.Region != region) {
+			continue
+		}
+		found := false
+		for _, Interface := range interfaces {
+			if interfaceMatches(Interface, endpoint.Interface) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			interfaces = append(interfaces, endpoint.Interface)
+		}
+	}
+	return interfaces
+}
+
+// diagnoseEndpoint reports on each of endpoints for the selection of
+// serviceType, region and endpointType
+//
+// The selection is made as for the storage url, applying the endpoint
+// overrides, EndpointMatcher and DuplicatePolicy. If serviceType is ""
+// the storage types are tried in turn.
+func (o *options) diagnoseEndpoint(endpoints []Endpoint, serviceType, region string, endpointType swift.EndpointType) EndpointReport {
+	types := []string{serviceType}
+	if serviceType == "" {
+		types = o.storageTypes()
+	}
+	report := EndpointReport{
+		ServiceType:  types[0],
+		ServiceTypes: types,
+		Region:       region,
+		EndpointType: endpointType,
+	}
+	for _, Type := range types {
+		if url, ok := o.endpointOverride(Type, region); ok {
+			report.ServiceType = Type
+			report.Override = url
+			break
+		}
+		if selected, found := o.selectStorageEndpoint(endpointsOfType(endpoints, Type), region, endpointType); found {
+			report.ServiceType = Type
+			report.Selected = &selected
+			break
+		}
+	}
+	for _, endpoint := range endpoints {
+		candidate := EndpointCandidate{Endpoint: endpoint}
+		if !contains(types, endpoint.ServiceType) {
+			candidate.Reasons = append(candidate.Reasons, fmt.Sprintf("type mismatch: %q", endpoint.ServiceType))
+		}
+		if region != "" && endpoint.Region != region {
+			candidate.Reasons = append(candidate.Reasons, fmt.Sprintf("region mismatch: %q", endpoint.Region))
+		}
+		if !interfaceMatches(endpoint.Interface, endpointType) {
+			candidate.Reasons = append(candidate.Reasons, fmt.Sprintf("interface mismatch: %q", endpoint.Interface))
+		}
+		if !endpoint.Enabled {
+			candidate.Reasons = append(candidate.Reasons, "disabled")
+		}
+		if o.endpointMatcher != nil && !o.endpointMatcher(endpoint) {
+			candidate.Reasons = append(candidate.Reasons, "rejected by the endpoint matcher")
+		}
+		switch {
+		case report.Selected != nil && endpoint == *report.Selected:
+			candidate.Selected = true
+		case len(candidate.Reasons) > 0:
+		case report.Override != "":
+			candidate.Reasons = append(candidate.Reasons, fmt.Sprintf("overridden by %q", report.Override))
+		case endpoint.ServiceType != report.ServiceType:
+			candidate.Reasons = append(candidate.Reasons, fmt.Sprintf("type %q was tried first", report.ServiceType))
+		case report.Selected != nil && o.duplicatePolicy == DuplicateLast && endpoint.Region == report.Selected.Region:
+			candidate.Reasons = append(candidate.Reasons, "a later duplicate was preferred")
+		default:
+			candidate.Reasons = append(candidate.Reasons, "another matching endpoint was preferred")
+		}
+		report.Candidates = append(report.Candidates, candidate)
+	}
+	return report
+}
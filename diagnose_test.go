@@ -0,0 +1,112 @@
+package auth
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/ncw/swift/v2"
+)
+
+// reasons returns the reasons of the candidate with url
+func reasons(t *testing.T, report EndpointReport, url string) []string {
+	t.Helper()
+	for _, candidate := range report.Candidates {
+		if candidate.Endpoint.Url == url {
+			return candidate.Reasons
+		}
+	}
+	t.Fatalf("no candidate %q in %+v", url, report.Candidates)
+	return nil
+}
+
+func TestDiagnoseFollowsStorageSelection(t *testing.T) {
+	port8080 := "http://swift.example.com:8080/v1/AUTH_p"
+	port9090 := "http://swift.example.com:9090/v1/AUTH_p"
+	twoPorts := v3BodyWithStorage(v3Endpoint("public", "R", port8080), v3Endpoint("public", "R", port9090))
+	for _, test := range []struct {
+		name         string
+		body         string
+		opts         []Option
+		wantType     string
+		wantSelected string
+		wantOverride string
+		other        string // url of a candidate not selected
+		otherReason  string
+	}{
+		{"default", twoPorts, nil, "object-store", port8080, "", port9090, "another matching endpoint was preferred"},
+		{"matcher", twoPorts, []Option{WithEndpointMatcher(MatchPort("9090"))}, "object-store", port9090, "", port8080, "rejected by the endpoint matcher"},
+		{"duplicate last", twoPorts, []Option{WithDuplicatePolicy(DuplicateLast)}, "object-store", port9090, "", port8080, "a later duplicate was preferred"},
+		{"override", twoPorts, []Option{WithEndpointOverride("object-store", "R", "http://local.test/v1/AUTH_p")}, "object-store", "", "http://local.test/v1/AUTH_p", port8080, `overridden by "http://local.test/v1/AUTH_p"`},
+		{"service types", strings.Replace(twoPorts, `"type": "object-store"`, `"type": "object-storage"`, 1),
+			[]Option{WithServiceTypes("object-store", "object-storage")}, "object-storage", port8080, "", "http://compute.example.com", `type mismatch: "compute"`},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			c := bodyServer(t, 3, test.body)
+			c.Region = "R"
+			a := newAuth(t, c, AuthV3, test.opts...)
+			if err := authenticate(a, c); err != nil {
+				t.Fatal(err)
+			}
+			report := a.(EndpointDiagnoser).DiagnoseEndpoint("", "R", swift.EndpointTypePublic)
+			if report.ServiceType != test.wantType || report.Override != test.wantOverride {
+				t.Errorf("report for type %q override %q, want %q and %q", report.ServiceType, report.Override, test.wantType, test.wantOverride)
+			}
+			selected := ""
+			if report.Selected != nil {
+				selected = report.Selected.Url
+			}
+			if selected != test.wantSelected {
+				t.Errorf("selected %q, want %q", selected, test.wantSelected)
+			}
+			// The report agrees with the storage url
+			want := test.wantSelected
+			if test.wantOverride != "" {
+				want = test.wantOverride
+			}
+			if got := a.StorageUrl(false); got != want {
+				t.Errorf("storage url %q, report says %q", got, want)
+			}
+			got := reasons(t, report, test.other)
+			if !contains(got, test.otherReason) {
+				t.Errorf("reasons for %s = %q, want %q", test.other, got, test.otherReason)
+			}
+		})
+	}
+}
+
+func TestAvailableInterfaces(t *testing.T) {
+	public, internal := swift.EndpointTypePublic, swift.EndpointTypeInternal
+	for _, test := range []struct {
+		name    string
+		version AuthVersion
+		body    string
+	}{
+		{"v2", 2, v2BodyWithStorage(
+			`{"region": "R1", "publicURL": "http://r1.example.com/v1/AUTH_t1"}`,
+			v2Endpoint("R2", "http://r2.example.com/v1/AUTH_t1", "http://r2.internal/v1/AUTH_t1"),
+		)},
+		{"v3", 3, v3BodyWithStorage(
+			v3Endpoint("public", "R1", "http://r1.example.com/v1/AUTH_p"),
+			v3Endpoint("public", "R2", "http://r2.example.com/v1/AUTH_p"),
+			v3Endpoint("internal", "R2", "http://r2.internal/v1/AUTH_p"),
+		)},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			lister := authenticateWith(t, test.version, test.body).(InterfaceLister)
+			for _, region := range []struct {
+				region string
+				want   []swift.EndpointType
+			}{
+				{"R1", []swift.EndpointType{public}},
+				{"R2", []swift.EndpointType{public, internal}},
+				{"", []swift.EndpointType{public, internal}},
+				{"X", nil},
+			} {
+				if got := lister.AvailableInterfaces(region.region); !reflect.DeepEqual(got, region.want) {
+					t.Errorf("region %q: interfaces %q, want %q", region.region, got, region.want)
+				}
+			}
+		})
+	}
+}
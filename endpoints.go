@@ -0,0 +1,445 @@
+package auth
+
+import (
+	"net/url"
+	"strings"
+
+	"github.com/ncw/swift/v2"
+	"github.com/pkg/errors"
+)
+
+// defaultServiceType is the catalog type of the object store
+const defaultServiceType = "object-store"
+
+// ErrEndpointNotFound is returned when no storage endpoint matches
+var ErrEndpointNotFound = errors.New("storage endpoint not found")
+
+// Endpoint describes an endpoint from the service catalog
+//
+// v2 endpoints which carry several URLs are split into one Endpoint
+// per interface. Disabled endpoints are listed but never selected.
+type Endpoint struct {
+	ServiceType string
+	Id          string
+	Region      string
+	RegionId    string
+	Interface   swift.EndpointType
+	Url         string
+	Enabled     bool // false if the catalog marks it disabled
+}
+
+// EndpointLister is an optional interface to read all the storage
+// endpoints in the catalog
+type EndpointLister interface {
+	StorageEndpoints() []Endpoint
+}
+
+// AllEndpointsLister is an optional interface to read the endpoints
+// of every service in the catalog grouped by service type, for
+// configuring other OpenStack clients from the same token
+type AllEndpointsLister interface {
+	AllEndpoints() map[string][]Endpoint
+}
+
+// FallbackEndpointAuthenticator is an optional interface to read the
+// storage url falling back to another interface if the preferred one
+// isn't in the catalog
+type FallbackEndpointAuthenticator interface {
+	StorageUrlForEndpointWithFallback(pref swift.EndpointType) (url string, used swift.EndpointType, err error)
+}
+
+// endpointFallbacks is the order interfaces are tried in after the
+// preferred one
+var endpointFallbacks = []swift.EndpointType{
+	swift.EndpointTypePublic,
+	swift.EndpointTypeInternal,
+	swift.EndpointTypeAdmin,
+}
+
+// endpointsOfType returns the endpoints with the service type Type
+func endpointsOfType(endpoints []Endpoint, Type string) []Endpoint {
+	var result []Endpoint
+	for _, endpoint := range endpoints {
+		if endpoint.ServiceType == Type {
+			result = append(result, endpoint)
+		}
+	}
+	return result
+}
+
+// groupByType returns endpoints grouped by service type keeping their
+// order
+func groupByType(endpoints []Endpoint) map[string][]Endpoint {
+	result := make(map[string][]Endpoint)
+	for _, endpoint := range endpoints {
+		result[endpoint.ServiceType] = append(result[endpoint.ServiceType], endpoint)
+	}
+	return result
+}
+
+// isEnabled returns false only if the enabled flag of a catalog
+// endpoint is present and false
+func isEnabled(enabled *bool) bool {
+	return enabled == nil || *enabled
+}
+
+// interfaceMatches returns true if the catalog interface is
+// endpointType ignoring case as some clouds use "Public" or "PUBLIC"
+func interfaceMatches(Interface, endpointType swift.EndpointType) bool {
+	return strings.EqualFold(string(Interface), string(endpointType))
+}
+
+// selectEndpoint picks the endpoint of endpointType in region
+//
+// If region is "" the endpoint is chosen deterministically as the
+// first by region then url, as the order of the catalog isn't stable
+// across Keystone versions.
+func selectEndpoint(endpoints []Endpoint, region string, endpointType swift.EndpointType) (Endpoint, bool) {
+	var selected Endpoint
+	found := false
+	for _, endpoint := range endpoints {
+		if !endpoint.Enabled || !interfaceMatches(endpoint.Interface, endpointType) {
+			continue
+		}
+		if region != "" {
+			if endpoint.Region == region {
+				return endpoint, true
+			}
+			continue
+		}
+		if !found || endpoint.Region < selected.Region ||
+			(endpoint.Region == selected.Region && endpoint.Url < selected.Url) {
+			selected = endpoint
+			found = true
+		}
+	}
+	return selected, found
+}
+
+// storageUrlWithFallback looks up the storage url for pref and if
+// that is missing for the other interfaces in turn
+//
+// It returns the url and the interface it was found for.
+func storageUrlWithFallback(lookup func(swift.EndpointType) string, pref swift.EndpointType) (string, swift.EndpointType, error) {
+	if url := lookup(pref); url != "" {
+		return url, pref, nil
+	}
+	for _, endpointType := range endpointFallbacks {
+		if endpointType == pref {
+			continue
+		}
+		if url := lookup(endpointType); url != "" {
+			return url, endpointType, nil
+		}
+	}
+	return "", "", ErrEndpointNotFound
+}
+
+// WithServiceTypes sets the catalog types tried in order to find the
+// object store
+//
+// Some clouds register it under different types in different regions.
+// The default is "object-store".
+func WithServiceTypes(types ...string) Option {
+	return func(o *options) {
+		o.serviceTypes = types
+	}
+}
+
+// storageTypes returns the catalog types to find the object store by
+func (o *options) storageTypes() []string {
+	if len(o.serviceTypes) == 0 {
+		return []string{defaultServiceType}
+	}
+	return o.serviceTypes
+}
+
+// firstEndpointUrl returns the url from lookup for the first of the
+// storage types that has one
+func (o *options) firstEndpointUrl(lookup func(Type string, endpointType swift.EndpointType) string, endpointType swift.EndpointType) string {
+	for _, Type := range o.storageTypes() {
+		if url := lookup(Type, endpointType); url != "" {
+			return o.rewriteStorageUrl(url)
+		}
+	}
+	return ""
+}
+
+// firstEndpoints returns the endpoints from list for the first of the
+// storage types that has any
+func (o *options) firstEndpoints(list func(Type string) []Endpoint) []Endpoint {
+	for _, Type := range o.storageTypes() {
+		if endpoints := list(Type); len(endpoints) > 0 {
+			return endpoints
+		}
+	}
+	return nil
+}
+
+// WithMaxCatalogEndpoints caps the number of catalog endpoints kept
+// from an auth response to bound the work done on enormous catalogs
+//
+// Endpoints of the storage service types are always kept and count
+// towards max. Other services are kept in catalog order until max is
+// reached. Truncation is logged. 0 keeps all the endpoints.
+func WithMaxCatalogEndpoints(max int) Option {
+	return func(o *options) {
+		o.maxCatalogEndpoints = max
+	}
+}
+
+// catalogLimits returns how many endpoints to keep of each catalog
+// service given their types and endpoint counts, or nil if they should
+// all be kept
+func (o *options) catalogLimits(types []string, counts []int) []int {
+	if o.maxCatalogEndpoints <= 0 {
+		return nil
+	}
+	total := 0
+	for _, count := range counts {
+		total += count
+	}
+	if total <= o.maxCatalogEndpoints {
+		return nil
+	}
+	limits := make([]int, len(counts))
+	left := o.maxCatalogEndpoints
+	// The object store is never dropped
+	for i, Type := range types {
+		if contains(o.storageTypes(), Type) {
+			limits[i] = counts[i]
+			left -= counts[i]
+		}
+	}
+	kept := o.maxCatalogEndpoints - left
+	for i, Type := range types {
+		if contains(o.storageTypes(), Type) || left <= 0 {
+			continue
+		}
+		limits[i] = counts[i]
+		if limits[i] > left {
+			limits[i] = left
+		}
+		left -= limits[i]
+		kept += limits[i]
+	}
+	o.logf("auth catalog truncated to %d of %d endpoints", kept, total)
+	return limits
+}
+
+// EndpointMatcher reports whether an endpoint may be selected
+type EndpointMatcher func(Endpoint) bool
+
+// MatchPort matches endpoints whose url has port
+func MatchPort(port string) EndpointMatcher {
+	return func(endpoint Endpoint) bool {
+		u, err := url.Parse(endpoint.Url)
+		return err == nil && u.Port() == port
+	}
+}
+
+// MatchPathPrefix matches endpoints whose url path starts with prefix
+func MatchPathPrefix(prefix string) EndpointMatcher {
+	return func(endpoint Endpoint) bool {
+		u, err := url.Parse(endpoint.Url)
+		return err == nil && strings.HasPrefix(u.Path, prefix)
+	}
+}
+
+// WithEndpointMatcher restricts the storage endpoints which may be
+// selected to those matched by matcher
+//
+// This picks between endpoints which region matching can't tell
+// apart, for example the same host on a different port per region in
+// catalogs without region labels.
+func WithEndpointMatcher(matcher EndpointMatcher) Option {
+	return func(o *options) {
+		o.endpointMatcher = matcher
+	}
+}
+
+// matchEndpoints returns the endpoints matched by the EndpointMatcher
+// if set
+func (o *options) matchEndpoints(endpoints []Endpoint) []Endpoint {
+	if o.endpointMatcher == nil {
+		return endpoints
+	}
+	var matched []Endpoint
+	for _, endpoint := range endpoints {
+		if o.endpointMatcher(endpoint) {
+			matched = append(matched, endpoint)
+		}
+	}
+	return matched
+}
+
+// WithInterfaceMapping treats the catalog interface names in mapping
+// as the given interface, for clouds using non standard names such as
+// "service" for internal
+//
+// Names are matched case insensitively.
+func WithInterfaceMapping(mapping map[string]swift.EndpointType) Option {
+	return func(o *options) {
+		o.interfaceMapping = make(map[string]swift.EndpointType, len(mapping))
+		for name, endpointType := range mapping {
+			o.interfaceMapping[strings.ToLower(name)] = endpointType
+		}
+	}
+}
+
+// catalogInterface normalizes the interface name of a catalog endpoint
+func (o *options) catalogInterface(name string) swift.EndpointType {
+	name = strings.ToLower(name)
+	if endpointType, ok := o.interfaceMapping[name]; ok {
+		return endpointType
+	}
+	return swift.EndpointType(name)
+}
+
+// WithStrictRegion makes auth fail with ErrEndpointNotFound when a
+// region is configured but the catalog has no storage endpoint in it
+//
+// By default the auth succeeds leaving the storage url empty.
+func WithStrictRegion(strict bool) Option {
+	return func(o *options) {
+		o.strictRegion = strict
+	}
+}
+
+// checkRegion returns an error in strict region mode if region is set
+// and none of the storage endpoints are in it
+func (o *options) checkRegion(endpoints []Endpoint, region string) error {
+	if !o.strictRegion || region == "" {
+		return nil
+	}
+	var regions []string
+	for _, endpoint := range endpoints {
+		if endpoint.Region == region {
+			return nil
+		}
+		if !contains(regions, endpoint.Region) {
+			regions = append(regions, endpoint.Region)
+		}
+	}
+	return errors.Wrapf(ErrEndpointNotFound, "region %q not in catalog regions %q", region, regions)
+}
+
+// DuplicatePolicy chooses what to do when several storage endpoints
+// match the same region and interface
+type DuplicatePolicy int
+
+// Duplicate policies
+const (
+	DuplicateFirst DuplicatePolicy = iota // use the first selected (the default)
+	DuplicateLast                         // use the last in catalog order
+	DuplicateError                        // fail the auth with ErrDuplicateEndpoint
+)
+
+// ErrDuplicateEndpoint is returned by auth with DuplicateError when
+// several storage endpoints match the same region and interface
+var ErrDuplicateEndpoint = errors.New("duplicate storage endpoints")
+
+// WithDuplicatePolicy sets what to do when several storage endpoints
+// match the same region and interface, which usually means the
+// catalog is misconfigured
+func WithDuplicatePolicy(policy DuplicatePolicy) Option {
+	return func(o *options) {
+		o.duplicatePolicy = policy
+	}
+}
+
+// duplicatesOf returns the endpoints in the region of selected which
+// match endpointType in catalog order
+func duplicatesOf(endpoints []Endpoint, selected Endpoint, endpointType swift.EndpointType) []Endpoint {
+	var duplicates []Endpoint
+	for _, endpoint := range endpoints {
+		if endpoint.Enabled && endpoint.Region == selected.Region && interfaceMatches(endpoint.Interface, endpointType) {
+			duplicates = append(duplicates, endpoint)
+		}
+	}
+	return duplicates
+}
+
+// selectStorageEndpoint picks the storage endpoint of endpointType in
+// region from endpoints applying the EndpointMatcher and
+// DuplicatePolicy
+func (o *options) selectStorageEndpoint(endpoints []Endpoint, region string, endpointType swift.EndpointType) (Endpoint, bool) {
+	endpoints = o.matchEndpoints(endpoints)
+	selected, found := selectEndpoint(endpoints, region, endpointType)
+	if found && o.duplicatePolicy == DuplicateLast {
+		duplicates := duplicatesOf(endpoints, selected, endpointType)
+		selected = duplicates[len(duplicates)-1]
+	}
+	return selected, found
+}
+
+// checkDuplicates returns an error with DuplicateError if several of
+// the storage endpoints match the region and an interface
+func (o *options) checkDuplicates(endpoints []Endpoint, region string) error {
+	if o.duplicatePolicy != DuplicateError {
+		return nil
+	}
+	endpoints = o.matchEndpoints(endpoints)
+	for _, endpointType := range endpointFallbacks {
+		selected, found := selectEndpoint(endpoints, region, endpointType)
+		if !found {
+			continue
+		}
+		if duplicates := duplicatesOf(endpoints, selected, endpointType); len(duplicates) > 1 {
+			return errors.Wrapf(ErrDuplicateEndpoint, "%d %s endpoints in region %q", len(duplicates), endpointType, selected.Region)
+		}
+	}
+	return nil
+}
+
+// WithStorageUrlRewrite rewrites the storage url with rewrite, for
+// example to route storage traffic through the gateway Keystone is
+// reached by
+//
+// Only the storage url is rewritten, the endpoints listed from the
+// catalog are left as they are.
+func WithStorageUrlRewrite(rewrite func(storageUrl string) string) Option {
+	return func(o *options) {
+		o.storageUrlRewrite = rewrite
+	}
+}
+
+// rewriteStorageUrl rewrites storageUrl if a rewrite is set
+func (o *options) rewriteStorageUrl(storageUrl string) string {
+	if o.storageUrlRewrite == nil || storageUrl == "" {
+		return storageUrl
+	}
+	return o.storageUrlRewrite(storageUrl)
+}
+
+// endpointKey identifies an endpoint override
+type endpointKey struct {
+	serviceType string
+	region      string
+}
+
+// WithEndpointOverride makes the endpoints of serviceType in region
+// resolve to url whatever the catalog says, for example to point the
+// object store at a local fake in tests
+//
+// The override applies to all interfaces. If region is "" it applies
+// to all regions without an override of their own. It can be given
+// several times.
+func WithEndpointOverride(serviceType, region, url string) Option {
+	return func(o *options) {
+		if o.endpointOverrides == nil {
+			o.endpointOverrides = make(map[endpointKey]string)
+		}
+		o.endpointOverrides[endpointKey{serviceType, region}] = url
+	}
+}
+
+// endpointOverride returns the url overriding the endpoints of Type in
+// region if there is one
+func (o *options) endpointOverride(Type, region string) (string, bool) {
+	if url, ok := o.endpointOverrides[endpointKey{Type, region}]; ok {
+		return url, true
+	}
+	url, ok := o.endpointOverrides[endpointKey{Type, ""}]
+	return url, ok
+}
@@ -0,0 +1,679 @@
+package auth
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/ncw/swift/v2"
+	"github.com/pkg/errors"
+)
+
+// twoRegionV3Body has a public object-store endpoint in regions R1
+// and R2
+var twoRegionV3Body = v3BodyWithStorage(
+	v3Endpoint("public", "R1", "http://r1.example.com/v1/AUTH_p"),
+	v3Endpoint("public", "R2", "http://r2.example.com/v1/AUTH_p"),
+)
+
+// twoRegionV2Body has an object-store endpoint in regions R1 and R2
+var twoRegionV2Body = v2BodyWithStorage(
+	v2Endpoint("R1", "http://r1.example.com/v1/AUTH_t1", "http://r1.internal/v1/AUTH_t1"),
+	v2Endpoint("R2", "http://r2.example.com/v1/AUTH_t1", "http://r2.internal/v1/AUTH_t1"),
+)
+
+// bodyServer returns a connection for version against a server
+// answering every request with body
+func bodyServer(t *testing.T, version AuthVersion, body string) *swift.Connection {
+	t.Helper()
+	s := newFakeServer(t, func(w http.ResponseWriter, r *http.Request, _ string) {
+		if version == 3 {
+			writeV3Token(w, "token", body)
+		} else {
+			writeJson(w, http.StatusOK, body)
+		}
+	})
+	if version == 2 {
+		return v2Connection(s)
+	}
+	return v3Connection(s)
+}
+
+func TestSetRegionOverridesConnectionRegion(t *testing.T) {
+	for _, test := range []struct {
+		name    string
+		version AuthVersion
+		body    string
+	}{
+		{"v2", 2, twoRegionV2Body},
+		{"v3", 3, twoRegionV3Body},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			c := bodyServer(t, test.version, test.body)
+			c.Region = "R1"
+			a := newAuth(t, c, test.version)
+			a.(RegionSetter).SetRegion("R2")
+			if err := authenticate(a, c); err != nil {
+				t.Fatal(err)
+			}
+			if got := a.StorageUrl(false); !strings.HasPrefix(got, "http://r2.example.com/") {
+				t.Errorf("storage url = %q, want the R2 endpoint", got)
+			}
+			if c.Region != "R1" {
+				t.Errorf("connection region changed to %q", c.Region)
+			}
+
+			a.(RegionSetter).SetRegion("")
+			if err := authenticate(a, c); err != nil {
+				t.Fatal(err)
+			}
+			if got := a.StorageUrl(false); !strings.HasPrefix(got, "http://r1.example.com/") {
+				t.Errorf("storage url = %q after clearing, want the R1 endpoint", got)
+			}
+		})
+	}
+}
+
+func TestV3AdminEndpoint(t *testing.T) {
+	body := v3BodyWithStorage(
+		v3Endpoint("public", "R", "http://public.example.com/v1/AUTH_p"),
+		v3Endpoint("admin", "R", "http://admin.example.com/v1/AUTH_p"),
+	)
+	a := authenticateWith(t, 3, body).(*v3Auth)
+	if got, want := a.StorageUrlForEndpoint(swift.EndpointTypeAdmin), "http://admin.example.com/v1/AUTH_p"; got != want {
+		t.Errorf("admin url = %q, want %q", got, want)
+	}
+	if got, want := a.StorageUrlForEndpoint(swift.EndpointTypePublic), "http://public.example.com/v1/AUTH_p"; got != want {
+		t.Errorf("public url = %q, want %q", got, want)
+	}
+}
+
+func TestStorageUrlWithFallback(t *testing.T) {
+	publicOnly := v3BodyWithStorage(v3Endpoint("public", "R", "http://public.example.com/v1/AUTH_p"))
+	for _, test := range []struct {
+		name     string
+		body     string
+		pref     swift.EndpointType
+		wantUrl  string
+		wantUsed swift.EndpointType
+		wantErr  bool
+	}{
+		{"exact internal", v3TokenBody, swift.EndpointTypeInternal, "http://internal.example.com/v1/AUTH_p", swift.EndpointTypeInternal, false},
+		{"exact public", v3TokenBody, swift.EndpointTypePublic, "http://public.example.com/v1/AUTH_p", swift.EndpointTypePublic, false},
+		{"internal falls back to public", publicOnly, swift.EndpointTypeInternal, "http://public.example.com/v1/AUTH_p", swift.EndpointTypePublic, false},
+		{"admin falls back to public", publicOnly, swift.EndpointTypeAdmin, "http://public.example.com/v1/AUTH_p", swift.EndpointTypePublic, false},
+		{"no storage endpoints", v3BodyWithStorage(), swift.EndpointTypePublic, "", "", true},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			a := authenticateWith(t, 3, test.body).(FallbackEndpointAuthenticator)
+			url, used, err := a.StorageUrlForEndpointWithFallback(test.pref)
+			if test.wantErr {
+				if err != ErrEndpointNotFound {
+					t.Errorf("err = %v, want ErrEndpointNotFound", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if url != test.wantUrl || used != test.wantUsed {
+				t.Errorf("got %q via %q, want %q via %q", url, used, test.wantUrl, test.wantUsed)
+			}
+		})
+	}
+}
+
+func TestStorageEndpoints(t *testing.T) {
+	for _, test := range []struct {
+		name    string
+		version AuthVersion
+		body    string
+		want    []Endpoint
+	}{
+		{"v2", 2, v2TokenBody, []Endpoint{
+			{ServiceType: "object-store", Id: "1", Region: "R", Interface: swift.EndpointTypePublic, Url: "http://public.example.com/v1/AUTH_t1", Enabled: true},
+			{ServiceType: "object-store", Id: "1", Region: "R", Interface: swift.EndpointTypeInternal, Url: "http://internal.example.com/v1/AUTH_t1", Enabled: true},
+			{ServiceType: "object-store", Id: "1", Region: "R", Interface: swift.EndpointTypeAdmin, Url: "http://admin.example.com/v1/AUTH_t1", Enabled: true},
+		}},
+		{"v3", 3, v3TokenBody, []Endpoint{
+			{ServiceType: "object-store", Id: "2", Region: "R", RegionId: "R", Interface: swift.EndpointTypePublic, Url: "http://public.example.com/v1/AUTH_p", Enabled: true},
+			{ServiceType: "object-store", Id: "3", Region: "R", RegionId: "R", Interface: swift.EndpointTypeInternal, Url: "http://internal.example.com/v1/AUTH_p", Enabled: true},
+		}},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			a := authenticateWith(t, test.version, test.body)
+			got := a.(EndpointLister).StorageEndpoints()
+			if !reflect.DeepEqual(got, test.want) {
+				t.Errorf("got %+v\nwant %+v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestServiceTypesTriedInOrder(t *testing.T) {
+	v3Body := strings.Replace(v3TokenBody, `"type": "object-store"`, `"type": "object-storage"`, 1)
+	v2Body := strings.Replace(v2TokenBody, `"type": "object-store"`, `"type": "object-storage"`, 1)
+	for _, test := range []struct {
+		name    string
+		version AuthVersion
+		body    string
+		want    string
+	}{
+		{"v2", 2, v2Body, "http://public.example.com/v1/AUTH_t1"},
+		{"v3", 3, v3Body, "http://public.example.com/v1/AUTH_p"},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			a := authenticateWith(t, test.version, test.body)
+			if got := a.StorageUrl(false); got != "" {
+				t.Errorf("default service type found %q", got)
+			}
+			a = authenticateWith(t, test.version, test.body, WithServiceTypes("object-store", "object-storage"))
+			if got := a.StorageUrl(false); got != test.want {
+				t.Errorf("storage url = %q, want %q", got, test.want)
+			}
+		})
+	}
+}
+
+func TestV3UppercaseInterfaces(t *testing.T) {
+	body := v3BodyWithStorage(
+		v3Endpoint("PUBLIC", "R", "http://public.example.com/v1/AUTH_p"),
+		v3Endpoint("Internal", "R", "http://internal.example.com/v1/AUTH_p"),
+	)
+	a := authenticateWith(t, 3, body)
+	if got, want := a.StorageUrl(false), "http://public.example.com/v1/AUTH_p"; got != want {
+		t.Errorf("public url = %q, want %q", got, want)
+	}
+	if got, want := a.StorageUrl(true), "http://internal.example.com/v1/AUTH_p"; got != want {
+		t.Errorf("internal url = %q, want %q", got, want)
+	}
+}
+
+func TestDeterministicSelectionWithoutRegion(t *testing.T) {
+	v3R1 := v3Endpoint("public", "R1", "http://r1.example.com/v1/AUTH_p")
+	v3R2 := v3Endpoint("public", "R2", "http://r2.example.com/v1/AUTH_p")
+	v2R1 := v2Endpoint("R1", "http://r1.example.com/v1/AUTH_t1", "")
+	v2R2 := v2Endpoint("R2", "http://r2.example.com/v1/AUTH_t1", "")
+	for _, test := range []struct {
+		name    string
+		version AuthVersion
+		bodies  []string
+		want    string
+	}{
+		{"v2", 2, []string{v2BodyWithStorage(v2R1, v2R2), v2BodyWithStorage(v2R2, v2R1)}, "http://r1.example.com/v1/AUTH_t1"},
+		{"v3", 3, []string{v3BodyWithStorage(v3R1, v3R2), v3BodyWithStorage(v3R2, v3R1)}, "http://r1.example.com/v1/AUTH_p"},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			for i, body := range test.bodies {
+				a := authenticateWith(t, test.version, body)
+				if got := a.StorageUrl(false); got != test.want {
+					t.Errorf("order %d: storage url = %q, want %q", i, got, test.want)
+				}
+			}
+		})
+	}
+}
+
+func TestV2InterfaceMarkerCatalog(t *testing.T) {
+	body := v2BodyWithStorage(
+		`{"region": "R", "interface": "public", "url": "http://public.example.com/v1/AUTH_t1"}`,
+		`{"region": "R", "interface": "internal", "url": "http://internal.example.com/v1/AUTH_t1"}`,
+		`{"region": "R", "interface": "admin", "url": "http://admin.example.com/v1/AUTH_t1"}`,
+	)
+	a := authenticateWith(t, 2, body)
+	for _, test := range []struct {
+		endpointType swift.EndpointType
+		want         string
+	}{
+		{swift.EndpointTypePublic, "http://public.example.com/v1/AUTH_t1"},
+		{swift.EndpointTypeInternal, "http://internal.example.com/v1/AUTH_t1"},
+		{swift.EndpointTypeAdmin, "http://admin.example.com/v1/AUTH_t1"},
+	} {
+		if got := a.(*v2Auth).StorageUrlForEndpoint(test.endpointType); got != test.want {
+			t.Errorf("%s url = %q, want %q", test.endpointType, got, test.want)
+		}
+	}
+	if n := len(a.(EndpointLister).StorageEndpoints()); n != 3 {
+		t.Errorf("listed %d storage endpoints, want 3", n)
+	}
+}
+
+// withExtraServices returns body with n services of 2 endpoints each
+// put before the rest of its catalog
+func withExtraServices(version AuthVersion, body string, n int) string {
+	var services []string
+	for i := 0; i < n; i++ {
+		url := fmt.Sprintf("http://svc%d.example.com", i)
+		if version == 3 {
+			services = append(services, fmt.Sprintf(`{"type": "svc%d", "endpoints": [%s, %s]}`,
+				i, v3Endpoint("public", "R", url), v3Endpoint("internal", "R", url+"/internal")))
+		} else {
+			services = append(services, fmt.Sprintf(`{"type": "svc%d", "endpoints": [%s, %s]}`,
+				i, v2Endpoint("R", url, url+"/internal"), v2Endpoint("R2", url, url+"/internal")))
+		}
+	}
+	catalog := `"catalog": [`
+	if version == 2 {
+		catalog = `"serviceCatalog": [`
+	}
+	return strings.Replace(body, catalog, catalog+strings.Join(services, ",\n")+",", 1)
+}
+
+func TestMaxCatalogEndpoints(t *testing.T) {
+	for _, test := range []struct {
+		name     string
+		version  AuthVersion
+		body     string
+		max      int // the object store then 3 endpoints of 2 services
+		storage  int // object-store endpoints listed, v2 lists each url
+		services int // services without a cap
+	}{
+		{"v2", 2, v2TokenBody, 4, 3, 1001},
+		{"v3", 3, v3TokenBody, 5, 2, 1002},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			logger := &recordingLogger{}
+			body := withExtraServices(test.version, test.body, 1000)
+			a := authenticateWith(t, test.version, body, WithMaxCatalogEndpoints(test.max), WithLogger(logger))
+			if got := a.StorageUrl(false); !strings.HasPrefix(got, "http://public.example.com/") {
+				t.Errorf("storage url = %q, want the public endpoint", got)
+			}
+			all := a.(AllEndpointsLister).AllEndpoints()
+			if n := len(all["object-store"]); n != test.storage {
+				t.Errorf("kept %d object-store endpoints, want %d", n, test.storage)
+			}
+			for _, Type := range []string{"svc0", "svc1"} {
+				if len(all[Type]) == 0 {
+					t.Errorf("%s dropped, want it kept", Type)
+				}
+			}
+			if len(all) != 3 {
+				t.Errorf("kept services %d, want 3", len(all))
+			}
+			if !logger.contains("truncated") {
+				t.Errorf("truncation not logged: %q", logger.messages)
+			}
+
+			a = authenticateWith(t, test.version, body)
+			if n := len(a.(AllEndpointsLister).AllEndpoints()); n != test.services {
+				t.Errorf("kept %d services without a cap, want %d", n, test.services)
+			}
+		})
+	}
+}
+
+func TestSelectedRegion(t *testing.T) {
+	for _, test := range []struct {
+		name    string
+		version AuthVersion
+		body    string
+	}{
+		{"v2", 2, twoRegionV2Body},
+		{"v3", 3, twoRegionV3Body},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			a := authenticateWith(t, test.version, test.body)
+			selector := a.(RegionSelector)
+			if got := selector.SelectedRegion(); got != "" {
+				t.Errorf("selected region = %q before the storage url is read, want none", got)
+			}
+			// Without a region the first match is used
+			url := a.StorageUrl(false)
+			if got := selector.SelectedRegion(); got != "R1" || !strings.HasPrefix(url, "http://r1.example.com/") {
+				t.Errorf("selected region = %q for %q, want R1", got, url)
+			}
+
+			a.(RegionSetter).SetRegion("R2")
+			url = a.StorageUrl(false)
+			if got := selector.SelectedRegion(); got != "R2" || !strings.HasPrefix(url, "http://r2.example.com/") {
+				t.Errorf("selected region = %q for %q, want R2", got, url)
+			}
+		})
+	}
+}
+
+func TestEndpointMatcherPicksSameHost(t *testing.T) {
+	// Regions told apart only by the port, without region labels
+	const (
+		port8080 = "http://swift.example.com:8080/v1/AUTH_p"
+		port8081 = "http://swift.example.com:8081/v1/AUTH_p"
+		prefixed = "http://swift.example.com:8081/west/v1/AUTH_p"
+	)
+	for _, test := range []struct {
+		name    string
+		version AuthVersion
+		body    string
+	}{
+		{"v2", 2, v2BodyWithStorage(v2Endpoint("", port8080, port8080), v2Endpoint("", port8081, port8081), v2Endpoint("", prefixed, prefixed))},
+		{"v3", 3, v3BodyWithStorage(v3Endpoint("public", "", port8080), v3Endpoint("public", "", port8081), v3Endpoint("public", "", prefixed))},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			for _, match := range []struct {
+				name    string
+				matcher EndpointMatcher
+				want    string
+			}{
+				{"none", nil, port8080},
+				{"port", MatchPort("8081"), port8081},
+				{"path prefix", MatchPathPrefix("/west/"), prefixed},
+			} {
+				opts := []Option{}
+				if match.matcher != nil {
+					opts = append(opts, WithEndpointMatcher(match.matcher))
+				}
+				a := authenticateWith(t, test.version, test.body, opts...)
+				if got := a.StorageUrl(false); got != match.want {
+					t.Errorf("%s: storage url = %q, want %q", match.name, got, match.want)
+				}
+			}
+		})
+	}
+}
+
+func TestStorageURLSelector(t *testing.T) {
+	s := newFakeServer(t, func(w http.ResponseWriter, r *http.Request, _ string) {
+		switch r.URL.Path {
+		case "/auth/v1.0":
+			w.Header().Set("X-Auth-Token", "token")
+			w.Header().Set("X-Storage-Url", "http://storage.example.com/v1/AUTH_a")
+			w.WriteHeader(http.StatusNoContent)
+		case "/v2.0/tokens":
+			writeJson(w, http.StatusOK, v2TokenBody)
+		default:
+			writeV3Token(w, "token", v3TokenBody)
+		}
+	})
+	for _, test := range []struct {
+		name         string
+		version      AuthVersion
+		c            *swift.Connection
+		wantInternal string
+		wantPublic   string
+	}{
+		{"v1", 1, &swift.Connection{AuthUrl: s.URL + "/auth/v1.0", UserName: "user", ApiKey: "key"},
+			"http://snet-storage.example.com/v1/AUTH_a", "http://storage.example.com/v1/AUTH_a"},
+		{"v2", 2, v2Connection(s), "http://internal.example.com/v1/AUTH_t1", "http://public.example.com/v1/AUTH_t1"},
+		{"v3", 3, v3Connection(s), "http://internal.example.com/v1/AUTH_p", "http://public.example.com/v1/AUTH_p"},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			sent := len(s.recorded())
+			// The connection's choice doesn't limit the urls available
+			test.c.Internal = true
+			a := newAuth(t, test.c, test.version)
+			if err := authenticate(a, test.c); err != nil {
+				t.Fatal(err)
+			}
+			if n := len(s.recorded()) - sent; n != 1 {
+				t.Errorf("sent %d requests, want 1", n)
+			}
+			selector := a.(StorageURLSelector)
+			if got := selector.StorageURLInternal(); got != test.wantInternal {
+				t.Errorf("internal url = %q, want %q", got, test.wantInternal)
+			}
+			if got := selector.StorageURLPublic(); got != test.wantPublic {
+				t.Errorf("public url = %q, want %q", got, test.wantPublic)
+			}
+		})
+	}
+}
+
+func TestInterfaceMapping(t *testing.T) {
+	for _, test := range []struct {
+		name    string
+		version AuthVersion
+		body    string
+	}{
+		{"v2", 2, v2BodyWithStorage(
+			`{"region": "R", "interface": "public", "url": "http://public.example.com/v1/AUTH_p"}`,
+			`{"region": "R", "interface": "service", "url": "http://service.example.com/v1/AUTH_p"}`,
+		)},
+		{"v3", 3, v3BodyWithStorage(
+			v3Endpoint("public", "R", "http://public.example.com/v1/AUTH_p"),
+			v3Endpoint("service", "R", "http://service.example.com/v1/AUTH_p"),
+		)},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			a := authenticateWith(t, test.version, test.body)
+			if got := a.StorageUrl(true); got != "" {
+				t.Errorf("internal url = %q without a mapping, want none", got)
+			}
+
+			a = authenticateWith(t, test.version, test.body, WithInterfaceMapping(map[string]swift.EndpointType{
+				"Service": swift.EndpointTypeInternal,
+			}))
+			if got, want := a.StorageUrl(true), "http://service.example.com/v1/AUTH_p"; got != want {
+				t.Errorf("internal url = %q, want %q", got, want)
+			}
+			if got, want := a.StorageUrl(false), "http://public.example.com/v1/AUTH_p"; got != want {
+				t.Errorf("public url = %q, want %q", got, want)
+			}
+			var interfaces []swift.EndpointType
+			for _, endpoint := range a.(EndpointLister).StorageEndpoints() {
+				interfaces = append(interfaces, endpoint.Interface)
+			}
+			if want := []swift.EndpointType{swift.EndpointTypePublic, swift.EndpointTypeInternal}; !reflect.DeepEqual(interfaces, want) {
+				t.Errorf("listed interfaces %q, want %q", interfaces, want)
+			}
+		})
+	}
+}
+
+func TestDuplicatePolicy(t *testing.T) {
+	// Catalog order differs from url order
+	const (
+		first = "http://b.example.com/v1/AUTH_p"
+		last  = "http://a.example.com/v1/AUTH_p"
+	)
+	for _, test := range []struct {
+		name    string
+		version AuthVersion
+		body    string
+	}{
+		{"v2", 2, v2BodyWithStorage(v2Endpoint("R", first, first), v2Endpoint("R", last, last))},
+		{"v3", 3, v3BodyWithStorage(v3Endpoint("public", "R", first), v3Endpoint("public", "R", last))},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			for _, policy := range []struct {
+				name    string
+				opts    []Option
+				want    string
+				wantErr error
+			}{
+				{"default", nil, first, nil},
+				{"first", []Option{WithDuplicatePolicy(DuplicateFirst)}, first, nil},
+				{"last", []Option{WithDuplicatePolicy(DuplicateLast)}, last, nil},
+				{"error", []Option{WithDuplicatePolicy(DuplicateError)}, "", ErrDuplicateEndpoint},
+			} {
+				c := bodyServer(t, test.version, test.body)
+				c.Region = "R"
+				a := newAuth(t, c, test.version, policy.opts...)
+				err := authenticate(a, c)
+				if !errors.Is(err, policy.wantErr) {
+					t.Errorf("%s: err = %v, want %v", policy.name, err, policy.wantErr)
+				}
+				if got := a.StorageUrl(false); got != policy.want {
+					t.Errorf("%s: storage url = %q, want %q", policy.name, got, policy.want)
+				}
+			}
+		})
+	}
+}
+
+func TestStorageUrlRewriteThroughGateway(t *testing.T) {
+	s := newFakeServer(t, func(w http.ResponseWriter, r *http.Request, _ string) {
+		if r.URL.Path != "/identity/v3/auth/tokens" {
+			http.NotFound(w, r)
+			return
+		}
+		writeV3Token(w, "token", v3TokenBody)
+	})
+	gateway := s.URL
+	// Route storage through the gateway Keystone is reached by
+	rewrite := func(storageUrl string) string {
+		u, err := url.Parse(storageUrl)
+		if err != nil {
+			return storageUrl
+		}
+		return gateway + "/object-store" + u.Path
+	}
+	c := v3Connection(s)
+	c.AuthUrl = gateway + "/identity/v3"
+	a := newAuth(t, c, 3, WithStorageUrlRewrite(rewrite))
+	c.Auth = a
+	if err := c.Authenticate(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	want := gateway + "/object-store/v1/AUTH_p"
+	if c.StorageUrl != want {
+		t.Errorf("connection storage url = %q, want %q", c.StorageUrl, want)
+	}
+	if got := a.StorageUrl(true); got != want {
+		t.Errorf("internal storage url = %q, want %q", got, want)
+	}
+	// The catalog is listed as published
+	var urls []string
+	for _, endpoint := range a.(EndpointLister).StorageEndpoints() {
+		urls = append(urls, endpoint.Url)
+	}
+	if want := []string{"http://public.example.com/v1/AUTH_p", "http://internal.example.com/v1/AUTH_p"}; !reflect.DeepEqual(urls, want) {
+		t.Errorf("listed urls %q, want %q", urls, want)
+	}
+}
+
+func TestAllEndpoints(t *testing.T) {
+	v2Body := strings.Replace(v2TokenBody, `"serviceCatalog": [`, `"serviceCatalog": [
+      {"type": "compute", "name": "nova", "endpoints": [{"region": "R", "publicURL": "http://compute.example.com"}]},`, 1)
+	for _, test := range []struct {
+		name        string
+		version     AuthVersion
+		body        string
+		compute     Endpoint
+		wantStorage []string
+	}{
+		{"v2", 2, v2Body, Endpoint{ServiceType: "compute", Region: "R", Interface: swift.EndpointTypePublic, Url: "http://compute.example.com", Enabled: true},
+			[]string{"http://public.example.com/v1/AUTH_t1", "http://internal.example.com/v1/AUTH_t1", "http://admin.example.com/v1/AUTH_t1"}},
+		{"v3", 3, v3TokenBody, Endpoint{ServiceType: "compute", Id: "1", Region: "R", RegionId: "R", Interface: swift.EndpointTypePublic, Url: "http://compute.example.com", Enabled: true},
+			[]string{"http://public.example.com/v1/AUTH_p", "http://internal.example.com/v1/AUTH_p"}},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			all := authenticateWith(t, test.version, test.body).(AllEndpointsLister).AllEndpoints()
+			if len(all) != 2 {
+				t.Errorf("services %d, want object-store and compute", len(all))
+			}
+			if want := []Endpoint{test.compute}; !reflect.DeepEqual(all["compute"], want) {
+				t.Errorf("compute endpoints %+v, want %+v", all["compute"], want)
+			}
+			var urls []string
+			for _, endpoint := range all["object-store"] {
+				if endpoint.ServiceType != "object-store" {
+					t.Errorf("endpoint %+v grouped under object-store", endpoint)
+				}
+				urls = append(urls, endpoint.Url)
+			}
+			if !reflect.DeepEqual(urls, test.wantStorage) {
+				t.Errorf("object-store urls %q, want %q", urls, test.wantStorage)
+			}
+		})
+	}
+}
+
+func TestEndpointOverride(t *testing.T) {
+	const (
+		local   = "http://127.0.0.1:8080/v1/AUTH_local"
+		localR2 = "http://127.0.0.1:8082/v1/AUTH_local"
+	)
+	for _, test := range []struct {
+		name    string
+		version AuthVersion
+		body    string
+		r1      string // the R1 catalog url
+	}{
+		{"v2", 2, twoRegionV2Body, "http://r1.example.com/v1/AUTH_t1"},
+		{"v3", 3, twoRegionV3Body, "http://r1.example.com/v1/AUTH_p"},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			for _, override := range []struct {
+				name   string
+				opts   []Option
+				region string
+				want   string
+			}{
+				{"none", nil, "R1", test.r1},
+				{"all regions", []Option{WithEndpointOverride("object-store", "", local)}, "R1", local},
+				{"other region", []Option{WithEndpointOverride("object-store", "R2", localR2)}, "R1", test.r1},
+				{"this region", []Option{WithEndpointOverride("object-store", "R2", localR2)}, "R2", localR2},
+				{"region first", []Option{
+					WithEndpointOverride("object-store", "", local),
+					WithEndpointOverride("object-store", "R2", localR2),
+				}, "R2", localR2},
+				{"other service", []Option{WithEndpointOverride("compute", "", local)}, "R1", test.r1},
+			} {
+				c := bodyServer(t, test.version, test.body)
+				c.Region = override.region
+				a := newAuth(t, c, test.version, override.opts...)
+				c.Auth = a
+				if err := c.Authenticate(context.Background()); err != nil {
+					t.Fatal(err)
+				}
+				if c.StorageUrl != override.want {
+					t.Errorf("%s: storage url = %q, want %q", override.name, c.StorageUrl, override.want)
+				}
+				if override.want != test.r1 {
+					if got := a.StorageUrl(true); got != override.want {
+						t.Errorf("%s: internal storage url = %q, want the override", override.name, got)
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestDisabledEndpointsSkipped(t *testing.T) {
+	const (
+		disabled = "http://a.example.com/v1/AUTH_p"
+		enabled  = "http://b.example.com/v1/AUTH_p"
+	)
+	v2Disabled := `{"region": "R", "publicURL": "` + disabled + `", "enabled": false}`
+	v3Disabled := `{"id": "d", "interface": "public", "region": "R", "region_id": "R", "url": "` + disabled + `", "enabled": false}`
+	v3Enabled := `{"id": "e", "interface": "public", "region": "R", "region_id": "R", "url": "` + enabled + `", "enabled": true}`
+	for _, test := range []struct {
+		name    string
+		version AuthVersion
+		body    string
+		want    string
+		enabled []bool // of the listed storage endpoints
+	}{
+		{"v2", 2, v2BodyWithStorage(v2Disabled, `{"region": "R", "publicURL": "`+enabled+`"}`), enabled, []bool{false, true}},
+		{"v2 all disabled", 2, v2BodyWithStorage(v2Disabled), "", []bool{false}},
+		{"v3", 3, v3BodyWithStorage(v3Disabled, v3Enabled), enabled, []bool{false, true}},
+		{"v3 flag absent", 3, v3BodyWithStorage(v3Disabled, v3Endpoint("public", "R", enabled)), enabled, []bool{false, true}},
+		{"v3 all disabled", 3, v3BodyWithStorage(v3Disabled), "", []bool{false}},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			// With and without a region the disabled endpoint, which
+			// is first either way, is skipped
+			for _, region := range []string{"", "R"} {
+				c := bodyServer(t, test.version, test.body)
+				c.Region = region
+				a := newAuth(t, c, test.version)
+				if err := authenticate(a, c); err != nil {
+					t.Fatal(err)
+				}
+				if got := a.StorageUrl(false); got != test.want {
+					t.Errorf("region %q: storage url = %q, want %q", region, got, test.want)
+				}
+				var got []bool
+				for _, endpoint := range a.(EndpointLister).StorageEndpoints() {
+					got = append(got, endpoint.Enabled)
+				}
+				if !reflect.DeepEqual(got, test.enabled) {
+					t.Errorf("region %q: listed enabled %v, want %v", region, got, test.enabled)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,235 @@
+package auth
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ncw/swift/v2"
+)
+
+// v3TokenBody is a Keystone v3 token response as documented, with a
+// storage and a compute service
+const v3TokenBody = `{
+  "token": {
+    "methods": ["password"],
+    "user": {
+      "domain": {"id": "default", "name": "Default"},
+      "id": "ee4dfb6e5540447cb3741905149d9b6e",
+      "name": "user",
+      "password_expires_at": "2099-11-06T15:32:17.000000"
+    },
+    "audit_ids": ["3T2dc1CGQxyJsHdDu1xkcw"],
+    "expires_at": "2099-11-07T02:58:43.578887Z",
+    "issued_at": "2015-11-07T01:58:43.578929Z",
+    "project": {
+      "domain": {"id": "default", "name": "Default"},
+      "id": "a6944d763bf64ee6a275f1263fae0352",
+      "name": "project"
+    },
+    "is_domain": false,
+    "roles": [{"id": "51cc68287d524c759f47c811e6463340", "name": "member"}],
+    "catalog": [
+      {
+        "endpoints": [
+          {"id": "1", "interface": "public", "region": "R", "region_id": "R", "url": "http://compute.example.com"}
+        ],
+        "id": "c1",
+        "type": "compute",
+        "name": "nova"
+      },
+      {
+        "endpoints": [
+          {"id": "2", "interface": "public", "region": "R", "region_id": "R", "url": "http://public.example.com/v1/AUTH_p"},
+          {"id": "3", "interface": "internal", "region": "R", "region_id": "R", "url": "http://internal.example.com/v1/AUTH_p"}
+        ],
+        "id": "s1",
+        "type": "object-store",
+        "name": "swift"
+      }
+    ]
+  }
+}`
+
+// v2TokenBody is a Keystone v2 token response as documented with the
+// Rackspace extensions
+const v2TokenBody = `{
+  "access": {
+    "token": {
+      "issued_at": "2015-11-07T01:58:43.578929Z",
+      "expires": "2099-11-07T02:58:43Z",
+      "id": "v2token",
+      "tenant": {"description": null, "enabled": true, "id": "t1", "name": "tenant"},
+      "audit_ids": ["abc"],
+      "RAX-AUTH:authenticatedBy": ["APIKEY"]
+    },
+    "serviceCatalog": [
+      {
+        "endpoints": [
+          {"adminURL": "http://admin.example.com/v1/AUTH_t1", "region": "R", "internalURL": "http://internal.example.com/v1/AUTH_t1", "id": "1", "publicURL": "http://public.example.com/v1/AUTH_t1"}
+        ],
+        "endpoints_links": [],
+        "type": "object-store",
+        "name": "swift"
+      }
+    ],
+    "user": {
+      "username": "user",
+      "roles_links": [],
+      "id": "u1",
+      "roles": [{"name": "member"}],
+      "name": "user",
+      "RAX-AUTH:defaultRegion": "DFW"
+    },
+    "metadata": {"is_admin": 0, "roles": ["r1"]}
+  }
+}`
+
+// v3StorageEndpoints is the object-store endpoints of v3TokenBody
+const v3StorageEndpoints = `{"id": "2", "interface": "public", "region": "R", "region_id": "R", "url": "http://public.example.com/v1/AUTH_p"},
+          {"id": "3", "interface": "internal", "region": "R", "region_id": "R", "url": "http://internal.example.com/v1/AUTH_p"}`
+
+// v3Endpoint returns a v3 catalog endpoint
+func v3Endpoint(iface, region, url string) string {
+	return fmt.Sprintf(`{"id": %q, "interface": %q, "region": %q, "region_id": %q, "url": %q}`, url, iface, region, region, url)
+}
+
+// v3BodyWithStorage returns v3TokenBody with endpoints as its
+// object-store endpoints
+func v3BodyWithStorage(endpoints ...string) string {
+	return strings.Replace(v3TokenBody, v3StorageEndpoints, strings.Join(endpoints, ",\n"), 1)
+}
+
+// v2StorageEndpoints is the object-store endpoints of v2TokenBody
+const v2StorageEndpoints = `{"adminURL": "http://admin.example.com/v1/AUTH_t1", "region": "R", "internalURL": "http://internal.example.com/v1/AUTH_t1", "id": "1", "publicURL": "http://public.example.com/v1/AUTH_t1"}`
+
+// v2Endpoint returns a v2 catalog endpoint
+func v2Endpoint(region, publicUrl, internalUrl string) string {
+	return fmt.Sprintf(`{"region": %q, "publicURL": %q, "internalURL": %q}`, region, publicUrl, internalUrl)
+}
+
+// v2BodyWithStorage returns v2TokenBody with endpoints as its
+// object-store endpoints
+func v2BodyWithStorage(endpoints ...string) string {
+	return strings.Replace(v2TokenBody, v2StorageEndpoints, strings.Join(endpoints, ",\n"), 1)
+}
+
+// recorded is a request received by a fake server
+type recorded struct {
+	Method string
+	Path   string
+	Header http.Header
+	Body   string
+}
+
+// fakeServer is an auth server for tests recording the requests made
+type fakeServer struct {
+	*httptest.Server
+	mu       sync.Mutex
+	requests []recorded
+}
+
+// newFakeServer starts a fakeServer answering with handler, which is
+// passed the body already read
+func newFakeServer(t *testing.T, handler func(w http.ResponseWriter, r *http.Request, body string)) *fakeServer {
+	t.Helper()
+	s := &fakeServer{}
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		data, _ := ioutil.ReadAll(r.Body)
+		s.mu.Lock()
+		s.requests = append(s.requests, recorded{Method: r.Method, Path: r.URL.Path, Header: r.Header.Clone(), Body: string(data)})
+		s.mu.Unlock()
+		handler(w, r, string(data))
+	}))
+	t.Cleanup(s.Close)
+	return s
+}
+
+// recorded returns the requests received so far
+func (s *fakeServer) recorded() []recorded {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]recorded(nil), s.requests...)
+}
+
+// writeV3Token answers with a v3 token response
+func writeV3Token(w http.ResponseWriter, token, body string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Subject-Token", token)
+	w.WriteHeader(http.StatusCreated)
+	_, _ = w.Write([]byte(body))
+}
+
+// writeJson answers with status and a JSON body
+func writeJson(w http.ResponseWriter, status int, body string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_, _ = w.Write([]byte(body))
+}
+
+// v3Connection returns a connection for v3 password auth against s
+func v3Connection(s *fakeServer) *swift.Connection {
+	return &swift.Connection{
+		AuthUrl:  s.URL + "/v3",
+		UserName: "user",
+		ApiKey:   "secret",
+		Domain:   "Default",
+		Tenant:   "project",
+	}
+}
+
+// v2Connection returns a connection for v2 password auth against s
+func v2Connection(s *fakeServer) *swift.Connection {
+	return &swift.Connection{
+		AuthUrl:  s.URL + "/v2.0",
+		UserName: "user",
+		ApiKey:   "secret",
+		Tenant:   "tenant",
+	}
+}
+
+// newAuth makes an Authenticator for c failing the test on error
+func newAuth(t *testing.T, c *swift.Connection, version AuthVersion, opts ...Option) swift.Authenticator {
+	t.Helper()
+	a, err := New(c.AuthUrl, c.ApiKey, version, 5*time.Second, opts...)
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	return a
+}
+
+// authenticate runs a's Request for c
+func authenticate(a swift.Authenticator, c *swift.Connection) error {
+	_, err := a.Request(context.Background(), c)
+	return err
+}
+
+// recordingLogger is a Logger keeping the messages
+type recordingLogger struct {
+	mu       sync.Mutex
+	messages []string
+}
+
+func (l *recordingLogger) Printf(format string, v ...interface{}) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.messages = append(l.messages, fmt.Sprintf(format, v...))
+}
+
+// contains returns true if a message containing s was logged
+func (l *recordingLogger) contains(s string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for _, message := range l.messages {
+		if strings.Contains(message, s) {
+			return true
+		}
+	}
+	return false
+}
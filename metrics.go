@@ -0,0 +1,19 @@
+package auth
+
+import "time"
+
+// Metrics receives measurements of authentication
+type Metrics interface {
+	// AuthDone is called when authentication finishes with the
+	// total time taken, the number of attempts made and the error
+	// if it failed
+	AuthDone(elapsed time.Duration, attempts int, err error)
+}
+
+// WithMetrics sets a Metrics to receive measurements of
+// authentication
+func WithMetrics(metrics Metrics) Option {
+	return func(o *options) {
+		o.metrics = metrics
+	}
+}
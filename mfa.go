@@ -0,0 +1,165 @@
+package auth
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha1"
+	"encoding/base32"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/ncw/swift/v2"
+	"github.com/pkg/errors"
+)
+
+// v3ReceiptHeader carries the receipt of a partial multi-factor auth
+const v3ReceiptHeader = "Openstack-Auth-Receipt"
+
+// totpPeriod is the RFC 6238 time step used by Keystone
+const totpPeriod = 30 * time.Second
+
+// ReceiptError is returned when v3 auth succeeded with some methods but
+// the user needs more to complete multi-factor auth
+//
+// Keystone replies 401 with a receipt which can be sent with the
+// missing methods to continue.
+type ReceiptError struct {
+	Err             *AuthError
+	Receipt         string     // the receipt to continue with
+	Methods         []string   // methods already satisfied
+	RequiredMethods [][]string // any one of these sets completes the auth
+	ExpiresAt       string     // when the receipt expires
+}
+
+func (e *ReceiptError) Error() string {
+	return fmt.Sprintf("%v: auth receipt needs one of %v", e.Err, e.RequiredMethods)
+}
+
+func (e *ReceiptError) Unwrap() error {
+	return e.Err
+}
+
+// missing returns the methods needed besides the satisfied ones to
+// complete the auth with the first required set made of satisfied
+// methods and available, or false if there isn't one
+func (e *ReceiptError) missing(available ...string) ([]string, bool) {
+	have := make(map[string]bool)
+	for _, method := range e.Methods {
+		have[method] = true
+	}
+	for _, required := range e.RequiredMethods {
+		var missing []string
+		ok := true
+		for _, method := range required {
+			if have[method] {
+				continue
+			}
+			if !contains(available, method) {
+				ok = false
+				break
+			}
+			missing = append(missing, method)
+		}
+		if ok {
+			return missing, true
+		}
+	}
+	return nil, false
+}
+
+// contains returns true if values has value
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+// receiptError returns a *ReceiptError for err if resp is a 401 with
+// an auth receipt, otherwise err
+func receiptError(resp *http.Response, err error) error {
+	var authErr *AuthError
+	if resp == nil || !errors.As(err, &authErr) || authErr.StatusCode != http.StatusUnauthorized {
+		return err
+	}
+	receipt := resp.Header.Get(v3ReceiptHeader)
+	if receipt == "" {
+		return err
+	}
+	var body struct {
+		Receipt struct {
+			Methods   []string `json:"methods"`
+			ExpiresAt string   `json:"expires_at"`
+		} `json:"receipt"`
+		RequiredAuthMethods [][]string `json:"required_auth_methods"`
+	}
+	if json.Unmarshal([]byte(authErr.Body), &body) != nil {
+		return err
+	}
+	return &ReceiptError{
+		Err:             authErr,
+		Receipt:         receipt,
+		Methods:         body.Receipt.Methods,
+		RequiredMethods: body.RequiredAuthMethods,
+		ExpiresAt:       body.Receipt.ExpiresAt,
+	}
+}
+
+// WithTOTPSecret makes v3 password auth continue automatically with a
+// TOTP passcode made from secret when Keystone asks for one with an
+// auth receipt
+//
+// secret is the base32 RFC 6238 seed of the user. This allows
+// unattended multi-factor auth for service accounts.
+func WithTOTPSecret(secret string) Option {
+	return func(o *options) {
+		o.totpSecret = secret
+	}
+}
+
+// totpCode returns the RFC 6238 passcode for the base32 secret at t
+func totpCode(secret string, t time.Time) (string, error) {
+	secret = strings.ToUpper(strings.ReplaceAll(secret, " ", ""))
+	key, err := base32.StdEncoding.WithPadding(base32.NoPadding).DecodeString(strings.TrimRight(secret, "="))
+	if err != nil {
+		return "", errors.Wrap(err, "bad TOTP secret")
+	}
+	var counter [8]byte
+	binary.BigEndian.PutUint64(counter[:], uint64(t.Unix()/int64(totpPeriod/time.Second)))
+	mac := hmac.New(sha1.New, key)
+	mac.Write(counter[:])
+	sum := mac.Sum(nil)
+	offset := sum[len(sum)-1] & 0x0f
+	code := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+	// Keystone passcodes are 6 digits
+	return fmt.Sprintf("%06d", code%1000000), nil
+}
+
+// continueReceipt resubmits the v3 password request with a TOTP
+// passcode and the receipt from receiptErr
+func (auth *v3Auth) continueReceipt(ctx context.Context, c *swift.Connection, v3 *v3AuthRequest, receiptErr *ReceiptError) error {
+	missing, ok := receiptErr.missing(v3AuthMethodTotp)
+	if !ok || len(missing) == 0 {
+		return receiptErr
+	}
+	passcode, err := totpCode(auth.totpSecret, auth.now())
+	if err != nil {
+		return err
+	}
+	user := v3.Auth.Identity.Password.User
+	user.Password = ""
+	user.Passcode = passcode
+
+	next := *v3
+	next.Auth.Identity.Methods = []string{v3AuthMethodPassword, v3AuthMethodTotp}
+	next.Auth.Identity.Totp = &v3AuthTotp{User: user}
+	next.receipt = receiptErr.Receipt
+	auth.logf("v3 auth: continuing with %v after auth receipt", next.Auth.Identity.Methods)
+	return auth.authenticate(ctx, c, &next)
+}
@@ -0,0 +1,164 @@
+package auth
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ncw/swift/v2"
+	"github.com/pkg/errors"
+)
+
+// fixedClock is a Clock stopped at a time
+type fixedClock time.Time
+
+func (c fixedClock) Now() time.Time                         { return time.Time(c) }
+func (c fixedClock) After(d time.Duration) <-chan time.Time { return time.After(d) }
+
+// receiptServer starts a Keystone asking password auth for a TOTP
+// passcode with an auth receipt
+func receiptServer(t *testing.T) *fakeServer {
+	return newFakeServer(t, func(w http.ResponseWriter, r *http.Request, body string) {
+		if r.Header.Get(v3ReceiptHeader) == "" {
+			w.Header().Set(v3ReceiptHeader, "RECEIPT")
+			writeJson(w, http.StatusUnauthorized, `{"receipt":{"methods":["password"],"expires_at":"2099-01-01T00:00:00Z"},"required_auth_methods":[["password","totp"]]}`)
+			return
+		}
+		writeV3Token(w, "token", v3TokenBody)
+	})
+}
+
+func TestReceiptContinuesWithTOTP(t *testing.T) {
+	s := receiptServer(t)
+	c := v3Connection(s)
+	// RFC 6238 test vector: the passcode at 59s is 94287082
+	a := newAuth(t, c, 3,
+		WithTOTPSecret("GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQ"),
+		WithClock(fixedClock(time.Unix(59, 0))))
+	if err := authenticate(a, c); err != nil {
+		t.Fatalf("auth failed: %v", err)
+	}
+	requests := s.recorded()
+	if len(requests) != 2 {
+		t.Fatalf("want 2 requests got %d", len(requests))
+	}
+	if got := requests[1].Header.Get(v3ReceiptHeader); got != "RECEIPT" {
+		t.Errorf("want receipt sent got %q", got)
+	}
+	var body struct {
+		Auth struct {
+			Identity struct {
+				Methods []string
+				Totp    struct {
+					User struct {
+						Name     string
+						Passcode string
+						Password string
+					}
+				}
+			}
+		}
+	}
+	if err := json.Unmarshal([]byte(requests[1].Body), &body); err != nil {
+		t.Fatal(err)
+	}
+	identity := body.Auth.Identity
+	if len(identity.Methods) != 2 || identity.Methods[0] != "password" || identity.Methods[1] != "totp" {
+		t.Errorf("want methods [password totp] got %v", identity.Methods)
+	}
+	if identity.Totp.User.Name != "user" || identity.Totp.User.Passcode != "287082" || identity.Totp.User.Password != "" {
+		t.Errorf("bad totp user %+v", identity.Totp.User)
+	}
+	if a.(interface{ Token() string }).Token() != "token" {
+		t.Error("token not read")
+	}
+}
+
+func TestReceiptReturnedWithoutTOTPSecret(t *testing.T) {
+	s := receiptServer(t)
+	c := v3Connection(s)
+	a := newAuth(t, c, 3)
+	err := authenticate(a, c)
+	var receiptErr *ReceiptError
+	if !errors.As(err, &receiptErr) {
+		t.Fatalf("want a ReceiptError got %v", err)
+	}
+	if receiptErr.Receipt != "RECEIPT" || len(receiptErr.RequiredMethods) != 1 || receiptErr.ExpiresAt == "" {
+		t.Errorf("bad receipt %+v", receiptErr)
+	}
+	if missing, ok := receiptErr.missing(v3AuthMethodTotp); !ok || len(missing) != 1 || missing[0] != "totp" {
+		t.Errorf("want totp missing got %v %v", missing, ok)
+	}
+	if n := len(s.recorded()); n != 1 {
+		t.Errorf("want 1 request got %d", n)
+	}
+}
+
+func TestTOTPOnly(t *testing.T) {
+	passcode := func(code string) PasscodeFunc {
+		return func(ctx context.Context) (string, error) { return code, nil }
+	}
+	for _, test := range []struct {
+		name     string
+		passcode string
+		setup    func(c *swift.Connection)
+		wantErr  bool
+	}{
+		{"user name", "123456", func(c *swift.Connection) {}, false},
+		{"user id", "123456", func(c *swift.Connection) { c.UserName, c.UserId = "", "uid" }, false},
+		{"no passcode", "", func(c *swift.Connection) {}, true},
+		{"no user", "123456", func(c *swift.Connection) { c.UserName = "" }, true},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			s := newFakeServer(t, func(w http.ResponseWriter, r *http.Request, body string) {
+				writeV3Token(w, "token", v3TokenBody)
+			})
+			c := v3Connection(s)
+			test.setup(c)
+			err := authenticate(newAuth(t, c, AuthV3, WithTOTP(passcode(test.passcode))), c)
+			requests := s.recorded()
+			if test.wantErr {
+				if err == nil || len(requests) != 0 {
+					t.Errorf("err = %v after %d requests, want an error before sending", err, len(requests))
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(requests) != 1 {
+				t.Fatalf("want 1 request got %d", len(requests))
+			}
+			var body struct {
+				Auth struct {
+					Identity struct {
+						Methods  []string
+						Password json.RawMessage
+						Totp     struct {
+							User struct {
+								Id, Name, Passcode, Password string
+							}
+						}
+					}
+				}
+			}
+			if err := json.Unmarshal([]byte(requests[0].Body), &body); err != nil {
+				t.Fatal(err)
+			}
+			identity := body.Auth.Identity
+			if len(identity.Methods) != 1 || identity.Methods[0] != "totp" {
+				t.Errorf("want methods [totp] got %v", identity.Methods)
+			}
+			user := identity.Totp.User
+			if user.Passcode != "123456" || user.Password != "" || (user.Name != c.UserName || user.Id != c.UserId) {
+				t.Errorf("bad totp user %+v", user)
+			}
+			if identity.Password != nil || strings.Contains(requests[0].Body, c.ApiKey) {
+				t.Errorf("password sent with totp only auth: %s", requests[0].Body)
+			}
+		})
+	}
+}
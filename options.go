@@ -0,0 +1,254 @@
+package auth
+
+import (
+	"fmt"
+	"net/http"
+	"runtime"
+	"runtime/debug"
+	"sync"
+	"time"
+
+	"github.com/ncw/swift/v2"
+)
+
+// Option configures an Authenticator created by New
+type Option func(*options)
+
+// Logger is used to report adjustments made during authentication
+//
+// It is satisfied by *log.Logger
+type Logger interface {
+	Printf(format string, v ...interface{})
+}
+
+// options holds the configuration shared by all auth versions
+type options struct {
+	strictJson bool   // reject unknown fields when decoding auth responses
+	logger     Logger // if set receives log messages
+
+	redactValues []string // values hidden from error messages
+
+	credentialProvider              CredentialProvider // if set supplies the password
+	passwordFile                    string             // if set read the password from here
+	totpPasscode                    PasscodeFunc       // if set use totp auth only
+	totpSecret                      string             // if set continue auth receipts with totp
+	appCredUserDomain               *v3Domain          // if set the domain of the app credential user
+	applicationCredentialSecretFile string             // if set read the app credential secret from here
+	allowEmptyCredential            bool               // send an empty password or API key
+
+	connectTimeout time.Duration // dial and TLS handshake timeout for the auth transport
+	authTimeout    time.Duration // if set overrides the timeout passed to New
+	forceHTTP2     bool          // attempt HTTP/2 on the auth transport
+	noKeepAlives   bool          // don't reuse auth transport connections
+
+	maxIdleConns        int           // idle connections kept by the auth transport
+	maxIdleConnsPerHost int           // idle connections per host kept by the auth transport
+	idleConnTimeout     time.Duration // how long the auth transport keeps idle connections
+
+	fallbackTransports []http.RoundTripper // tried in order after network errors
+
+	retries int           // number of times to retry a failed request
+	budget  time.Duration // if set limits the total time taken including retries
+	backoff Backoff       // if set chooses the delay between retries
+	jitter  *lockedRand   // if set the source of the default backoff jitter
+
+	defaultTTL   time.Duration // if set the TTL of tokens without an expiry
+	minTTL       time.Duration // if set the least time a new token must have left
+	minTTLReauth bool          // authenticate again if a new token expires too soon
+	freshWindow  time.Duration // if set a new token doesn't need reauth for this long
+	metrics      Metrics       // if set receives measurements
+
+	timingsObserver TimingsObserver // if set auth requests are traced
+	timingsState    timingsState
+
+	rateLimiter *rateLimiter    // if set limits the rate of auth requests
+	breaker     *circuitBreaker // if set stops auth after repeated failures
+
+	hostConcurrency int // if set the most auth requests in flight per host
+	hostLimiter     hostLimiter
+
+	v1TokenHeaderName       string   // v1 header holding the token
+	v1StorageUrlHeaderName  string   // v1 header holding the storage url
+	v1CatalogUrl            string   // if set v1 auth fetches a catalog from here
+	v2CredentialForm        string   // if set the only credential form v2 auth sends
+	allowVersionMismatch    bool     // allow an auth version contradicting the url
+	noUserAgent             bool     // don't set the User-Agent on auth requests
+	noDefaultProjectDomain  bool     // don't fall back to the "Default" project domain
+	defaultProjectDomainSet bool     // WithDefaultProjectDomain was used
+	requireProjectDomain    bool     // scoping to a project by name needs its domain
+	projectIdDomain         bool     // send the project domain when scoping by project id too
+	tokenDomainScope        bool     // scope v3 token auth without a project to the domain
+	autoProject             bool     // scope an unscoped v3 token to the user's only project
+	serviceTypes            []string // catalog types of the object store in order
+
+	maxCatalogEndpoints int                           // if set the most catalog endpoints kept
+	endpointMatcher     EndpointMatcher               // if set restricts the storage endpoints selected
+	interfaceMapping    map[string]swift.EndpointType // catalog interface names to interfaces
+	strictRegion        bool                          // fail if the configured region isn't in the catalog
+	duplicatePolicy     DuplicatePolicy               // what to do with duplicate storage endpoints
+	storageUrlRewrite   func(string) string           // if set rewrites the storage url
+	endpointOverrides   map[endpointKey]string        // urls used instead of the catalog
+	streamingCatalog    bool                          // stream v3 responses keeping only storage services
+
+	probe          bool // discover the versioned auth url
+	probeState     probeState
+	discoveryCache *DiscoveryCache // if set shares probes between authenticators
+
+	clock       Clock       // if set the source of time
+	validator   Validator   // if set checks new tokens
+	signRequest SignRequest // if set signs auth requests
+
+	debug      bool // capture the last exchange
+	debugState debugState
+
+	transportMu    sync.Mutex
+	authTransports map[*http.Transport]*http.Transport // built by the package from the connections' transports
+}
+
+// newOptions returns the default options with opts applied
+func newOptions(opts ...Option) *options {
+	o := &options{
+		hostConcurrency: defaultHostConcurrency,
+	}
+	for _, opt := range opts {
+		opt(o)
+	}
+	return o
+}
+
+// WithStrictJson enables strict decoding of auth responses
+//
+// Unknown fields in the response cause the authentication to fail.
+// The fields documented by Keystone are all known, vendor extensions
+// other than Rackspace's aren't. This is useful in testing and
+// integration to catch malformed or unexpected responses early.
+// Decoding is lenient by default.
+func WithStrictJson(strict bool) Option {
+	return func(o *options) {
+		o.strictJson = strict
+	}
+}
+
+// WithLogger sets a Logger to report adjustments made while
+// authenticating. Nothing is logged by default.
+func WithLogger(logger Logger) Option {
+	return func(o *options) {
+		o.logger = logger
+	}
+}
+
+// logf logs to the configured Logger if any
+func (o *options) logf(format string, v ...interface{}) {
+	if o.logger != nil {
+		o.logger.Printf(format, v...)
+	}
+}
+
+// WithDefaultProjectDomain controls whether v3 auth scoping to a
+// project by name uses the "Default" domain when no project or user
+// domain is configured
+//
+// It is enabled by default. Disable it for clouds without a "Default"
+// domain so Keystone applies its own default.
+func WithDefaultProjectDomain(enabled bool) Option {
+	return func(o *options) {
+		o.noDefaultProjectDomain = !enabled
+		o.defaultProjectDomainSet = true
+	}
+}
+
+// WithRequireProjectDomain makes v3 auth scoping to a project by name
+// fail unless a project or user domain is configured
+//
+// Project names are only unique within a domain so without one the
+// token may be scoped to the wrong project. Using the "Default"
+// domain can still be allowed explicitly with
+// WithDefaultProjectDomain(true).
+func WithRequireProjectDomain(required bool) Option {
+	return func(o *options) {
+		o.requireProjectDomain = required
+	}
+}
+
+// WithProjectIdDomain makes v3 auth scoping to a project by id send
+// the project domain too, chosen as when scoping by name
+//
+// Keystone doesn't need it but some clouds require it. It is off by
+// default.
+func WithProjectIdDomain(enabled bool) Option {
+	return func(o *options) {
+		o.projectIdDomain = enabled
+	}
+}
+
+// WithTokenDomainScope makes v3 auth with an existing token and no
+// project scope the new token to the connection's domain
+//
+// The domain id is used if set, otherwise the domain name. This suits
+// federated setups exchanging a token for a domain scoped one. It is
+// off by default so the token is exchanged unscoped.
+func WithTokenDomainScope(enabled bool) Option {
+	return func(o *options) {
+		o.tokenDomainScope = enabled
+	}
+}
+
+// WithUserAgent controls whether auth requests set the User-Agent
+// from the connection
+//
+// It is enabled by default. Disable it to keep a User-Agent set by
+// the transport.
+func WithUserAgent(enabled bool) Option {
+	return func(o *options) {
+		o.noUserAgent = !enabled
+	}
+}
+
+// modulePath is the import path of this module
+const modulePath = "github.com/kismia/swift-auth"
+
+// DefaultUserAgent is the User-Agent of auth requests when the
+// connection doesn't set one
+//
+// It names the version of this module if known, the Go version and
+// the platform, for example "swift-auth/v1.2.0 (go1.15; linux/amd64)".
+var DefaultUserAgent = defaultUserAgent()
+
+// defaultUserAgent makes the DefaultUserAgent
+func defaultUserAgent() string {
+	version := "(devel)"
+	if info, ok := debug.ReadBuildInfo(); ok {
+		if info.Main.Path == modulePath {
+			version = info.Main.Version
+		}
+		for _, dep := range info.Deps {
+			if dep.Path == modulePath {
+				version = dep.Version
+			}
+		}
+	}
+	return fmt.Sprintf("swift-auth/%s (%s; %s/%s)", version, runtime.Version(), runtime.GOOS, runtime.GOARCH)
+}
+
+// setUserAgent sets the User-Agent of req from c, or DefaultUserAgent
+// if c has none, unless disabled
+func (o *options) setUserAgent(req *http.Request, c *swift.Connection) {
+	if o.noUserAgent {
+		return
+	}
+	userAgent := c.UserAgent
+	if userAgent == "" {
+		userAgent = DefaultUserAgent
+	}
+	req.Header.Set("User-Agent", userAgent)
+}
+
+// WithVersionMismatch allows New to be given an auth version which
+// contradicts the version in the auth url, for example when proxying
+//
+// The mismatch is logged instead of being an error.
+func WithVersionMismatch(allowed bool) Option {
+	return func(o *options) {
+		o.allowVersionMismatch = allowed
+	}
+}
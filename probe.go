@@ -0,0 +1,304 @@
+package auth
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ncw/swift/v2"
+	"github.com/pkg/errors"
+)
+
+// WithVersionProbe discovers the versioned auth url from the versions
+// document served at the auth url before authenticating
+//
+// This allows the auth url to be a version-less Keystone root which
+// answers with 300 Multiple Choices. If New can't find the version in
+// the auth url v3 is used.
+func WithVersionProbe(enabled bool) Option {
+	return func(o *options) {
+		o.probe = enabled
+	}
+}
+
+// EffectiveAuthReader is an optional interface to read the auth url
+// and version of the last successful auth, which may differ from the
+// configured ones when probing
+type EffectiveAuthReader interface {
+	EffectiveAuthURL() string
+	EffectiveVersion() AuthVersion
+}
+
+// probeState holds the auth url found by probing and the one which
+// last succeeded
+type probeState struct {
+	mu               sync.Mutex
+	base             string      // auth url probed
+	url              string      // versioned auth url found
+	effectiveUrl     string      // auth url of the last successful auth
+	effectiveVersion AuthVersion // auth version of the last successful auth
+}
+
+// keystoneVersion is an entry in a Keystone versions document
+type keystoneVersion struct {
+	Id         string
+	Status     string
+	Updated    string
+	MediaTypes json.RawMessage `json:"media-types"`
+	Links      []struct {
+		Href string
+		Rel  string
+		Type string
+	}
+}
+
+// keystoneVersions is a Keystone versions document
+//
+// The root lists the versions in versions.values (or directly in
+// versions) and a versioned url describes itself in version.
+type keystoneVersions struct {
+	Versions json.RawMessage  `json:"versions"`
+	Version  *keystoneVersion `json:"version"`
+}
+
+// values returns all the versions in the document
+func (doc *keystoneVersions) values() []keystoneVersion {
+	var values []keystoneVersion
+	if len(doc.Versions) > 0 {
+		var wrapped struct {
+			Values []keystoneVersion
+		}
+		if err := json.Unmarshal(doc.Versions, &wrapped); err == nil {
+			values = wrapped.Values
+		} else {
+			_ = json.Unmarshal(doc.Versions, &values)
+		}
+	}
+	if doc.Version != nil {
+		values = append(values, *doc.Version)
+	}
+	return values
+}
+
+// authUrl returns the auth url to use for c - the one found by
+// probing if any
+func (o *options) authUrl(c *swift.Connection) string {
+	o.probeState.mu.Lock()
+	defer o.probeState.mu.Unlock()
+	if o.probeState.base == c.AuthUrl && o.probeState.url != "" {
+		return o.probeState.url
+	}
+	return c.AuthUrl
+}
+
+// EffectiveAuthURL returns the auth url of the last successful auth,
+// the versioned url if found by probing
+//
+// It is "" before the first success.
+func (o *options) EffectiveAuthURL() string {
+	o.probeState.mu.Lock()
+	defer o.probeState.mu.Unlock()
+	return o.probeState.effectiveUrl
+}
+
+// EffectiveVersion returns the auth version of the last successful
+// auth
+//
+// It is 0 before the first success.
+func (o *options) EffectiveVersion() AuthVersion {
+	o.probeState.mu.Lock()
+	defer o.probeState.mu.Unlock()
+	return o.probeState.effectiveVersion
+}
+
+// setEffective records the auth url of c and version after a
+// successful auth
+func (o *options) setEffective(c *swift.Connection, version AuthVersion) {
+	url := o.authUrl(c)
+	o.probeState.mu.Lock()
+	o.probeState.effectiveUrl = url
+	o.probeState.effectiveVersion = version
+	o.probeState.mu.Unlock()
+}
+
+// probeVersion finds the url of version from the auth url of c if
+// probing is enabled and it hasn't been found already
+func (o *options) probeVersion(ctx context.Context, c *swift.Connection, version AuthVersion, timeout time.Duration) error {
+	if !o.probe {
+		return nil
+	}
+	o.probeState.mu.Lock()
+	done := o.probeState.base == c.AuthUrl && o.probeState.url != ""
+	o.probeState.mu.Unlock()
+	if done {
+		return nil
+	}
+	url, err := o.discoverVersion(ctx, c, version, timeout)
+	if err != nil {
+		return errors.Wrap(err, "probe auth version")
+	}
+	o.probeState.mu.Lock()
+	o.probeState.base = c.AuthUrl
+	o.probeState.url = url
+	o.probeState.mu.Unlock()
+	return nil
+}
+
+// discoverVersion reads the versions document at the auth url of c,
+// from the DiscoveryCache if set, and returns the url of version
+func (o *options) discoverVersion(ctx context.Context, c *swift.Connection, version AuthVersion, timeout time.Duration) (string, error) {
+	fetch := func() ([]keystoneVersion, error) {
+		return o.fetchVersions(ctx, c, timeout)
+	}
+	var values []keystoneVersion
+	var err error
+	if o.discoveryCache != nil {
+		values, err = o.discoveryCache.get(ctx, c.AuthUrl, o.now(), fetch)
+	} else {
+		values, err = fetch()
+	}
+	if err != nil {
+		return "", err
+	}
+	return findVersionUrl(values, version)
+}
+
+// fetchVersions reads the versions document at the auth url of c
+//
+// Both 200 and 300 Multiple Choices are accepted from the root.
+func (o *options) fetchVersions(ctx context.Context, c *swift.Connection, timeout time.Duration) ([]keystoneVersion, error) {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, "GET", c.AuthUrl, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", "application/json")
+	o.setUserAgent(req, c)
+
+	if err = o.sign(req, nil); err != nil {
+		return nil, err
+	}
+
+	transport, err := o.transport(c)
+	if err != nil {
+		return nil, err
+	}
+	resp, _, err := o.send(req, transport)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusMultipleChoices {
+		if err = parseHeaders(resp); err != nil {
+			return nil, err
+		}
+	}
+	var doc keystoneVersions
+	if _, err = o.readJson(resp, &doc); err != nil {
+		return nil, errors.Wrap(err, "read versions")
+	}
+	return doc.values(), nil
+}
+
+// findVersionUrl returns the self link of version from values
+func findVersionUrl(values []keystoneVersion, version AuthVersion) (string, error) {
+	prefix := fmt.Sprintf("v%d", version)
+	for _, value := range values {
+		if !strings.HasPrefix(value.Id, prefix) {
+			continue
+		}
+		for _, link := range value.Links {
+			if link.Rel == "self" && link.Href != "" {
+				return link.Href, nil
+			}
+		}
+	}
+	return "", errors.Errorf("auth version %d not offered", version)
+}
+
+// DiscoveryCache shares the versions documents read by probing
+// between authenticators so each auth url is probed once per TTL
+//
+// It is safe for concurrent use.
+type DiscoveryCache struct {
+	ttl     time.Duration
+	mu      sync.Mutex
+	entries map[string]*discoveryEntry
+}
+
+// discoveryEntry is a versions document in a DiscoveryCache
+type discoveryEntry struct {
+	done    chan struct{} // closed once fetched
+	values  []keystoneVersion
+	err     error
+	fetched time.Time
+}
+
+// NewDiscoveryCache makes a DiscoveryCache keeping versions documents
+// for ttl
+func NewDiscoveryCache(ttl time.Duration) *DiscoveryCache {
+	return &DiscoveryCache{
+		ttl:     ttl,
+		entries: make(map[string]*discoveryEntry),
+	}
+}
+
+// WithDiscoveryCache makes version probing share cache with the other
+// authenticators using it
+func WithDiscoveryCache(cache *DiscoveryCache) Option {
+	return func(o *options) {
+		o.discoveryCache = cache
+	}
+}
+
+// get returns the versions document of authUrl calling fetch if it
+// isn't cached or has expired at now
+//
+// Concurrent calls for the same authUrl wait for a single fetch.
+// Errors aren't cached.
+func (dc *DiscoveryCache) get(ctx context.Context, authUrl string, now time.Time, fetch func() ([]keystoneVersion, error)) ([]keystoneVersion, error) {
+	dc.mu.Lock()
+	entry := dc.entries[authUrl]
+	if entry != nil && entry.expired(now, dc.ttl) {
+		entry = nil
+	}
+	if entry == nil {
+		entry = &discoveryEntry{done: make(chan struct{})}
+		dc.entries[authUrl] = entry
+		dc.mu.Unlock()
+		entry.values, entry.err = fetch()
+		entry.fetched = now
+		if entry.err != nil {
+			dc.mu.Lock()
+			if dc.entries[authUrl] == entry {
+				delete(dc.entries, authUrl)
+			}
+			dc.mu.Unlock()
+		}
+		close(entry.done)
+		return entry.values, entry.err
+	}
+	dc.mu.Unlock()
+	select {
+	case <-entry.done:
+		return entry.values, entry.err
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// expired returns true if the entry was fetched more than ttl before
+// now
+func (e *discoveryEntry) expired(now time.Time, ttl time.Duration) bool {
+	select {
+	case <-e.done:
+		return now.Sub(e.fetched) > ttl
+	default:
+		// Still being fetched
+		return false
+	}
+}
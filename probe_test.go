@@ -0,0 +1,120 @@
+package auth
+
+import (
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+)
+
+// newVersionsServer starts a Keystone whose root lists the versions
+// and which issues v3 tokens
+func newVersionsServer(t *testing.T) *fakeServer {
+	return newFakeServer(t, func(w http.ResponseWriter, r *http.Request, body string) {
+		switch r.URL.Path {
+		case "/":
+			writeJson(w, http.StatusMultipleChoices, `{"versions":{"values":[
+				{"id":"v2.0","status":"deprecated","links":[{"href":"http://`+r.Host+`/v2.0/","rel":"self"}]},
+				{"id":"v3.14","status":"stable","links":[{"href":"http://`+r.Host+`/v3/","rel":"self"}]}]}}`)
+		case "/v3/auth/tokens":
+			writeV3Token(w, "token", v3TokenBody)
+		default:
+			http.NotFound(w, r)
+		}
+	})
+}
+
+// paths returns the method and path of the requests s received
+func paths(s *fakeServer) []string {
+	var out []string
+	for _, r := range s.recorded() {
+		out = append(out, r.Method+" "+r.Path)
+	}
+	return out
+}
+
+// checkPaths fails unless s received the requests want
+func checkPaths(t *testing.T, s *fakeServer, want ...string) {
+	t.Helper()
+	got := paths(s)
+	if len(got) != len(want) {
+		t.Fatalf("want requests %q got %q", want, got)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Fatalf("want requests %q got %q", want, got)
+		}
+	}
+}
+
+func TestProbeFindsVersionedUrl(t *testing.T) {
+	s := newVersionsServer(t)
+	c := v3Connection(s)
+	c.AuthUrl = s.URL
+	a := newAuth(t, c, 0, WithVersionProbe(true))
+	for i := 0; i < 2; i++ {
+		if err := authenticate(a, c); err != nil {
+			t.Fatalf("auth %d: %v", i, err)
+		}
+	}
+	checkPaths(t, s, "GET /", "POST /v3/auth/tokens", "POST /v3/auth/tokens")
+
+	reader := a.(EffectiveAuthReader)
+	if got, want := reader.EffectiveAuthURL(), s.URL+"/v3/"; got != want {
+		t.Errorf("want effective url %q got %q", want, got)
+	}
+	if got := reader.EffectiveVersion(); got != AuthV3 {
+		t.Errorf("want effective version 3 got %d", got)
+	}
+}
+
+// failingTransport fails every request with a network error
+type failingTransport struct{}
+
+func (failingTransport) RoundTrip(*http.Request) (*http.Response, error) {
+	return nil, errors.New("connection refused")
+}
+
+func TestProbeUsesFallbackTransports(t *testing.T) {
+	s := newVersionsServer(t)
+	c := v3Connection(s)
+	c.AuthUrl = s.URL
+	c.Transport = failingTransport{}
+	a := newAuth(t, c, 0, WithVersionProbe(true), WithFallbackTransports(http.DefaultTransport))
+	if err := authenticate(a, c); err != nil {
+		t.Fatalf("auth failed: %v", err)
+	}
+	checkPaths(t, s, "GET /", "POST /v3/auth/tokens")
+}
+
+func TestProbeIsDebugged(t *testing.T) {
+	s := newFakeServer(t, func(w http.ResponseWriter, r *http.Request, body string) {
+		http.NotFound(w, r)
+	})
+	c := v3Connection(s)
+	c.AuthUrl = s.URL
+	a := newAuth(t, c, 0, WithVersionProbe(true), WithDebug(true))
+	err := authenticate(a, c)
+	var authErr *AuthError
+	if !errors.As(err, &authErr) || authErr.StatusCode != http.StatusNotFound {
+		t.Fatalf("want a 404 AuthError got %v", err)
+	}
+	x := a.(Debugger).LastExchange()
+	if x == nil || x.Method != "GET" || x.URL != s.URL || x.StatusCode != http.StatusNotFound {
+		t.Errorf("probe exchange not captured: %+v", x)
+	}
+}
+
+func TestDiscoveryCacheSharesProbe(t *testing.T) {
+	s := newVersionsServer(t)
+	cache := NewDiscoveryCache(time.Minute)
+	for i := 0; i < 3; i++ {
+		c := v3Connection(s)
+		c.AuthUrl = s.URL
+		a := newAuth(t, c, 0, WithVersionProbe(true), WithDiscoveryCache(cache))
+		if err := authenticate(a, c); err != nil {
+			t.Fatalf("auth %d: %v", i, err)
+		}
+	}
+	checkPaths(t, s, "GET /", "POST /v3/auth/tokens", "POST /v3/auth/tokens", "POST /v3/auth/tokens")
+}
@@ -0,0 +1,109 @@
+package auth
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/ncw/swift/v2"
+	"github.com/pkg/errors"
+)
+
+// WithAutoProject makes v3 auth with no project, domain or trust
+// configured scope to the user's project if they have exactly one
+//
+// The token is obtained unscoped, the projects it can be scoped to are
+// listed and it is then rescoped to the project, which is set on the
+// connection so reauth scopes to it directly. The Validator and the
+// region checks only apply to the rescoped token. If the user has
+// several projects the auth fails listing them. This suits
+// interactive tools for users with a single project. It is off by
+// default.
+func WithAutoProject(enabled bool) Option {
+	return func(o *options) {
+		o.autoProject = enabled
+	}
+}
+
+// v3ProjectEntry is a project listed by Keystone
+//
+// All the documented fields are modelled so strict decoding accepts
+// it.
+type v3ProjectEntry struct {
+	Id          string
+	Name        string
+	Domain_Id   string
+	Description string
+	Enabled     bool
+	Is_Domain   bool
+	Parent_Id   string
+	Tags        []string
+	Options     json.RawMessage
+	Links       json.RawMessage
+}
+
+// v3ProjectsUrl returns the url of the projects available to a token
+func (o *options) v3ProjectsUrl(c *swift.Connection) string {
+	url := o.authUrl(c)
+	if !strings.HasSuffix(url, "/") {
+		url += "/"
+	}
+	return url + "auth/projects"
+}
+
+// listProjects lists the projects the current token can be scoped to
+func (auth *v3Auth) listProjects(ctx context.Context, c *swift.Connection) ([]v3ProjectEntry, error) {
+	token := auth.Token()
+	ctx, cancel := context.WithTimeout(ctx, requestTimeout(ctx, auth.timeout))
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, "GET", auth.v3ProjectsUrl(c), nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", "application/json")
+	req.Header.Set("X-Auth-Token", token)
+	auth.setUserAgent(req, c)
+
+	if err = auth.sign(req, nil); err != nil {
+		return nil, err
+	}
+
+	transport, err := auth.transport(c)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := auth.doRequest(req, transport)
+	if err != nil {
+		return nil, auth.redact(errors.Wrap(err, "do projects request"), token)
+	}
+	var result struct {
+		Projects []v3ProjectEntry
+		Links    json.RawMessage
+	}
+	if _, err = auth.readJson(resp, &result); err != nil {
+		return nil, auth.redact(errors.Wrap(err, "read projects"), token)
+	}
+	return result.Projects, nil
+}
+
+// scopeToOnlyProject rescopes the unscoped token to the only project
+// of the user
+func (auth *v3Auth) scopeToOnlyProject(ctx context.Context, c *swift.Connection) error {
+	projects, err := auth.listProjects(ctx, c)
+	if err != nil {
+		return errors.Wrap(err, "auto project")
+	}
+	switch len(projects) {
+	case 0:
+		return errors.New("auto project: user has no projects")
+	case 1:
+		return auth.Rescope(ctx, c, ProjectRef{Id: projects[0].Id, Name: projects[0].Name})
+	}
+	choices := make([]string, len(projects))
+	for i, project := range projects {
+		choices[i] = fmt.Sprintf("%q (id %q)", project.Name, project.Id)
+	}
+	return errors.Errorf("auto project: user has %d projects - set TenantId or Tenant to one of %s", len(projects), strings.Join(choices, ", "))
+}
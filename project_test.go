@@ -0,0 +1,96 @@
+package auth
+
+import (
+	"errors"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+// v3UnscopedBody is a v3 token response without scope or catalog
+const v3UnscopedBody = `{"token":{"methods":["password"],"user":{"domain":{"id":"default","name":"Default"},"id":"u","name":"user"},` +
+	`"audit_ids":["a"],"expires_at":"2099-11-07T02:58:43.578887Z","issued_at":"2015-11-07T01:58:43.578929Z"}}`
+
+// newProjectsServer starts a Keystone issuing unscoped tokens unless a
+// scope is asked for and listing projects
+func newProjectsServer(t *testing.T, projects string) *fakeServer {
+	return newFakeServer(t, func(w http.ResponseWriter, r *http.Request, body string) {
+		switch r.URL.Path {
+		case "/v3/auth/tokens":
+			if strings.Contains(body, `"scope"`) {
+				writeV3Token(w, "scoped", v3TokenBody)
+			} else {
+				writeV3Token(w, "unscoped", v3UnscopedBody)
+			}
+		case "/v3/auth/projects":
+			writeJson(w, http.StatusOK, `{"projects":[`+projects+`],"links":{"self":"x"}}`)
+		default:
+			http.NotFound(w, r)
+		}
+	})
+}
+
+func TestAutoProjectScopesToOnlyProject(t *testing.T) {
+	s := newProjectsServer(t, `{"id":"a6944d763bf64ee6a275f1263fae0352","name":"project","domain_id":"default","enabled":true}`)
+	c := v3Connection(s)
+	c.Tenant = ""
+	c.Region = "R"
+	validated := 0
+	a := newAuth(t, c, 3,
+		WithAutoProject(true),
+		WithStrictRegion(true),
+		WithValidator(func(info TokenInfo) error {
+			validated++
+			if info.Scope.Kind != ScopeProject {
+				return errors.New("token not scoped to a project")
+			}
+			return nil
+		}))
+	if err := authenticate(a, c); err != nil {
+		t.Fatalf("auth failed: %v", err)
+	}
+	checkPaths(t, s, "POST /v3/auth/tokens", "GET /v3/auth/projects", "POST /v3/auth/tokens")
+	if got := s.recorded()[1].Header.Get("X-Auth-Token"); got != "unscoped" {
+		t.Errorf("want projects listed with the unscoped token got %q", got)
+	}
+	if validated != 1 {
+		t.Errorf("want the rescoped token validated once got %d", validated)
+	}
+	if c.TenantId != "a6944d763bf64ee6a275f1263fae0352" || c.Tenant != "project" {
+		t.Errorf("project not set on the connection: %q %q", c.TenantId, c.Tenant)
+	}
+	v3 := a.(*v3Auth)
+	if v3.Token() != "scoped" || !v3.IsScoped() {
+		t.Errorf("want the scoped token got %q", v3.Token())
+	}
+	if got, want := c.StorageUrl, "http://public.example.com/v1/AUTH_p"; got != want {
+		t.Errorf("want storage url %q got %q", want, got)
+	}
+}
+
+func TestAutoProjectChecksRescopedToken(t *testing.T) {
+	s := newProjectsServer(t, `{"id":"p1","name":"project"}`)
+	c := v3Connection(s)
+	c.Tenant = ""
+	c.Region = "elsewhere"
+	a := newAuth(t, c, 3, WithAutoProject(true), WithStrictRegion(true))
+	if err := authenticate(a, c); !errors.Is(err, ErrEndpointNotFound) {
+		t.Fatalf("want ErrEndpointNotFound got %v", err)
+	}
+	checkPaths(t, s, "POST /v3/auth/tokens", "GET /v3/auth/projects", "POST /v3/auth/tokens")
+}
+
+func TestAutoProjectListsSeveralProjects(t *testing.T) {
+	s := newProjectsServer(t, `{"id":"p1","name":"one"},{"id":"p2","name":"two"}`)
+	c := v3Connection(s)
+	c.Tenant = ""
+	a := newAuth(t, c, 3, WithAutoProject(true))
+	err := authenticate(a, c)
+	if err == nil || !strings.Contains(err.Error(), `"one" (id "p1")`) || !strings.Contains(err.Error(), `"two" (id "p2")`) {
+		t.Fatalf("want an error listing the projects got %v", err)
+	}
+	checkPaths(t, s, "POST /v3/auth/tokens", "GET /v3/auth/projects")
+	if c.TenantId != "" || c.Tenant != "" {
+		t.Errorf("project set on the connection: %q %q", c.TenantId, c.Tenant)
+	}
+}
@@ -0,0 +1,97 @@
+package auth
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// ErrRateLimited is returned when an auth request would exceed the
+// rate limit set with WithRateLimit and waiting is disabled
+var ErrRateLimited = errors.New("auth rate limit exceeded")
+
+// WithRateLimit limits auth requests to rate per second allowing
+// bursts of up to burst requests
+//
+// If wait is set a request over the limit waits for its turn (or for
+// the context to be done), otherwise it fails with ErrRateLimited.
+// There is no limit by default.
+func WithRateLimit(rate float64, burst int, wait bool) Option {
+	return func(o *options) {
+		if rate <= 0 {
+			o.rateLimiter = nil
+			return
+		}
+		if burst < 1 {
+			burst = 1
+		}
+		o.rateLimiter = &rateLimiter{
+			rate:   rate,
+			burst:  float64(burst),
+			tokens: float64(burst),
+			wait:   wait,
+		}
+	}
+}
+
+// rateLimiter is a token bucket
+type rateLimiter struct {
+	mu     sync.Mutex
+	rate   float64 // tokens added per second
+	burst  float64 // size of the bucket
+	tokens float64 // tokens available, negative if reserved ahead
+	last   time.Time
+	wait   bool // wait for a token rather than erroring
+}
+
+// reserve takes a token returning how long to wait before using it
+//
+// If the limiter doesn't wait no token is taken when one isn't
+// available and ok is false.
+func (l *rateLimiter) reserve(now time.Time) (delay time.Duration, ok bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if !l.last.IsZero() {
+		l.tokens += now.Sub(l.last).Seconds() * l.rate
+		if l.tokens > l.burst {
+			l.tokens = l.burst
+		}
+	}
+	l.last = now
+	if l.tokens >= 1 {
+		l.tokens--
+		return 0, true
+	}
+	if !l.wait {
+		return 0, false
+	}
+	delay = time.Duration((1 - l.tokens) / l.rate * float64(time.Second))
+	l.tokens--
+	return delay, true
+}
+
+// cancel returns a token reserved but not used
+func (l *rateLimiter) cancel() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.tokens++
+}
+
+// waitRateLimit blocks until an auth request is allowed by the rate
+// limit if any
+func (o *options) waitRateLimit(ctx context.Context) error {
+	if o.rateLimiter == nil {
+		return nil
+	}
+	delay, ok := o.rateLimiter.reserve(o.now())
+	if !ok {
+		return ErrRateLimited
+	}
+	if delay > 0 && !o.sleep(ctx, delay) {
+		o.rateLimiter.cancel()
+		return ctx.Err()
+	}
+	return nil
+}
@@ -0,0 +1,98 @@
+package auth
+
+import (
+	"context"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+func TestRateLimiterReserve(t *testing.T) {
+	start := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	failing := &rateLimiter{rate: 1, burst: 2, tokens: 2}
+	for i, want := range []bool{true, true, false} {
+		if _, ok := failing.reserve(start); ok != want {
+			t.Errorf("request %d allowed %v, want %v", i, ok, want)
+		}
+	}
+	if _, ok := failing.reserve(start.Add(time.Second)); !ok {
+		t.Errorf("request not allowed after the bucket refilled")
+	}
+
+	waiting := &rateLimiter{rate: 2, burst: 1, tokens: 1, wait: true}
+	for i, want := range []time.Duration{0, 500 * time.Millisecond, time.Second} {
+		delay, ok := waiting.reserve(start)
+		if !ok || delay != want {
+			t.Errorf("request %d waits %v (ok %v), want %v", i, delay, ok, want)
+		}
+	}
+}
+
+func TestRateLimitThrottlesBurst(t *testing.T) {
+	s := newFakeServer(t, func(w http.ResponseWriter, r *http.Request, body string) {
+		writeV3Token(w, "token", v3TokenBody)
+	})
+	c := v3Connection(s)
+	a := newAuth(t, c, AuthV3, WithRateLimit(1, 2, false))
+	for i := 0; i < 2; i++ {
+		if err := authenticate(a, c); err != nil {
+			t.Fatalf("auth %d: %v", i, err)
+		}
+	}
+	if err := authenticate(a, c); !errors.Is(err, ErrRateLimited) {
+		t.Errorf("err = %v, want ErrRateLimited", err)
+	}
+	if n := len(s.recorded()); n != 2 {
+		t.Errorf("sent %d requests, want 2", n)
+	}
+}
+
+func TestRateLimitWaits(t *testing.T) {
+	s := newFakeServer(t, func(w http.ResponseWriter, r *http.Request, body string) {
+		writeV3Token(w, "token", v3TokenBody)
+	})
+	c := v3Connection(s)
+	a := newAuth(t, c, AuthV3, WithRateLimit(20, 1, true))
+	start := time.Now()
+	for i := 0; i < 3; i++ {
+		if err := authenticate(a, c); err != nil {
+			t.Fatalf("auth %d: %v", i, err)
+		}
+	}
+	if elapsed := time.Since(start); elapsed < 90*time.Millisecond {
+		t.Errorf("3 auths at 20/s took %v, want at least 100ms", elapsed)
+	}
+	if n := len(s.recorded()); n != 3 {
+		t.Errorf("sent %d requests, want 3", n)
+	}
+}
+
+func TestRateLimitWaitRespectsContext(t *testing.T) {
+	s := newFakeServer(t, func(w http.ResponseWriter, r *http.Request, body string) {
+		writeV3Token(w, "token", v3TokenBody)
+	})
+	c := v3Connection(s)
+	a := newAuth(t, c, AuthV3, WithRateLimit(0.1, 1, true))
+	if err := authenticate(a, c); err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	if _, err := a.Request(ctx, c); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("err = %v, want context.DeadlineExceeded", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("wait took %v, want it cut off by the context", elapsed)
+	}
+	if n := len(s.recorded()); n != 1 {
+		t.Errorf("sent %d requests, want 1", n)
+	}
+	// The reservation of the cancelled request is given back
+	if tokens := a.(*v3Auth).rateLimiter.tokens; tokens < -0.01 {
+		t.Errorf("bucket has %v tokens, want the cancelled reservation returned", tokens)
+	}
+}
@@ -0,0 +1,111 @@
+package auth
+
+import (
+	"errors"
+	"reflect"
+	"strings"
+)
+
+// WithRedactedValues adds values which must never appear in error
+// messages in addition to the credentials in use
+func WithRedactedValues(values ...string) Option {
+	return func(o *options) {
+		o.redactValues = append(o.redactValues, values...)
+	}
+}
+
+// redactedError hides secret values in the message of the error it
+// wraps
+//
+// The errors it wraps are only exposed redacted too: Unwrap returns
+// the next error in the chain wrapped in a redactedError, and As gives
+// copies of *AuthError and *ReceiptError with the response text
+// scrubbed. Sentinel errors can still be matched with errors.Is.
+type redactedError struct {
+	err     error
+	secrets []string
+}
+
+func (e *redactedError) Error() string {
+	return e.scrub(e.err.Error())
+}
+
+func (e *redactedError) Unwrap() error {
+	next := errors.Unwrap(e.err)
+	if next == nil {
+		return nil
+	}
+	return &redactedError{err: next, secrets: e.secrets}
+}
+
+// Is reports whether the wrapped error is target
+func (e *redactedError) Is(target error) bool {
+	if reflect.TypeOf(target).Comparable() && e.err == target {
+		return true
+	}
+	if x, ok := e.err.(interface{ Is(error) bool }); ok {
+		return x.Is(target)
+	}
+	return false
+}
+
+// As sets target to a scrubbed copy of the wrapped error if it is
+// assignable to it
+func (e *redactedError) As(target interface{}) bool {
+	value := reflect.ValueOf(target)
+	if value.Kind() != reflect.Ptr || value.IsNil() {
+		return false
+	}
+	scrubbed := e.scrubError(e.err)
+	if reflect.TypeOf(scrubbed).AssignableTo(value.Type().Elem()) {
+		value.Elem().Set(reflect.ValueOf(scrubbed))
+		return true
+	}
+	return false
+}
+
+// scrub returns s with the secrets masked
+func (e *redactedError) scrub(s string) string {
+	for _, secret := range e.secrets {
+		if secret != "" {
+			s = strings.ReplaceAll(s, secret, masked)
+		}
+	}
+	return s
+}
+
+// scrubError returns a copy of err with the secrets masked in the
+// text of the response if it holds one, otherwise err
+func (e *redactedError) scrubError(err error) error {
+	switch err := err.(type) {
+	case *AuthError:
+		scrubbed := *err
+		scrubbed.Status = e.scrub(err.Status)
+		scrubbed.Body = e.scrub(err.Body)
+		scrubbed.Title = e.scrub(err.Title)
+		scrubbed.Message = e.scrub(err.Message)
+		return &scrubbed
+	case *ReceiptError:
+		scrubbed := *err
+		if err.Err != nil {
+			scrubbed.Err = e.scrubError(err.Err).(*AuthError)
+		}
+		return &scrubbed
+	}
+	return err
+}
+
+// redact returns err with secrets and any configured values hidden
+// from its message and from the errors it wraps
+//
+// All errors from authentication pass through here so credentials
+// never leak into logs via error strings.
+func (o *options) redact(err error, secrets ...string) error {
+	if err == nil {
+		return nil
+	}
+	all := make([]string, 0, len(secrets)+len(o.redactValues))
+	all = append(all, secrets...)
+	all = append(all, o.redactValues...)
+	return &redactedError{err: err, secrets: all}
+}
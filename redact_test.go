@@ -0,0 +1,88 @@
+package auth
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/ncw/swift/v2"
+	"github.com/pkg/errors"
+)
+
+// checkRedacted fails if secret appears anywhere in the chain of err
+func checkRedacted(t *testing.T, err error, secret string) {
+	t.Helper()
+	if err == nil {
+		t.Fatal("expecting an error")
+	}
+	for e := err; e != nil; e = errors.Unwrap(e) {
+		if strings.Contains(e.Error(), secret) {
+			t.Errorf("secret in %T: %q", e, e.Error())
+		}
+	}
+	var authErr *AuthError
+	if !errors.As(err, &authErr) {
+		t.Fatalf("no *AuthError in %v", err)
+	}
+	for name, text := range map[string]string{
+		"Error":   authErr.Error(),
+		"Status":  authErr.Status,
+		"Body":    authErr.Body,
+		"Title":   authErr.Title,
+		"Message": authErr.Message,
+	} {
+		if strings.Contains(text, secret) {
+			t.Errorf("secret in AuthError.%s: %q", name, text)
+		}
+	}
+}
+
+func TestRedactErrorChain(t *testing.T) {
+	const secret = "SECRETPW"
+	const fault = `{"error":{"code":401,"title":"Unauthorized ` + secret + `","message":"bad password ` + secret + `"}}`
+	s := newFakeServer(t, func(w http.ResponseWriter, r *http.Request, body string) {
+		writeJson(w, http.StatusUnauthorized, fault)
+	})
+	for _, test := range []struct {
+		name       string
+		version    int
+		connection func(*fakeServer) *swift.Connection
+	}{
+		{"v2", 2, v2Connection},
+		{"v3", 3, v3Connection},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			c := test.connection(s)
+			c.ApiKey = secret
+			a := newAuth(t, c, test.version)
+			err := authenticate(a, c)
+			checkRedacted(t, err, secret)
+
+			var authErr *AuthError
+			if errors.As(err, &authErr) && authErr.StatusCode != http.StatusUnauthorized {
+				t.Errorf("want status 401 got %d", authErr.StatusCode)
+			}
+		})
+	}
+}
+
+func TestRedactConfiguredValues(t *testing.T) {
+	const value = "INTERNAL-HOST"
+	s := newFakeServer(t, func(w http.ResponseWriter, r *http.Request, body string) {
+		writeJson(w, http.StatusUnauthorized, `{"error":{"code":401,"message":"from `+value+`"}}`)
+	})
+	c := v3Connection(s)
+	a := newAuth(t, c, 3, WithRedactedValues(value))
+	checkRedacted(t, authenticate(a, c), value)
+}
+
+func TestRedactKeepsSentinels(t *testing.T) {
+	s := newFakeServer(t, func(w http.ResponseWriter, r *http.Request, body string) {
+		writeJson(w, http.StatusCreated, v3TokenBody)
+	})
+	c := v3Connection(s)
+	a := newAuth(t, c, 3)
+	if err := authenticate(a, c); !errors.Is(err, ErrNoToken) {
+		t.Errorf("want ErrNoToken got %v", err)
+	}
+}
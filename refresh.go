@@ -0,0 +1,28 @@
+package auth
+
+import (
+	"context"
+
+	"github.com/ncw/swift/v2"
+	"github.com/pkg/errors"
+)
+
+// Refresher is an optional interface to authenticate again and find
+// out whether the token changed, as some Keystone configurations hand
+// out the same token again
+type Refresher interface {
+	Refresh(ctx context.Context, c *swift.Connection) (changed bool, err error)
+}
+
+// refresh authenticates c again with auth, which must be its
+// authenticator, and reports whether the token changed
+func refresh(ctx context.Context, c *swift.Connection, auth swift.Authenticator) (bool, error) {
+	if c.Auth != auth {
+		return false, errors.New("connection doesn't use this authenticator")
+	}
+	old := auth.Token()
+	if err := c.Authenticate(ctx); err != nil {
+		return false, err
+	}
+	return auth.Token() != old, nil
+}
@@ -0,0 +1,70 @@
+package auth
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/ncw/swift/v2"
+)
+
+func TestRefreshReportsChange(t *testing.T) {
+	// The server reuses the first token once then issues another
+	tokens := []string{"token1", "token1", "token2"}
+	for _, test := range []struct {
+		name    string
+		version AuthVersion
+		path    string
+	}{
+		{"v1", 1, "/auth/v1.0"},
+		{"v2", 2, "/v2.0"},
+		{"v3", 3, "/v3"},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			var sent int32
+			s := newFakeServer(t, func(w http.ResponseWriter, r *http.Request, _ string) {
+				i := int(atomic.AddInt32(&sent, 1)) - 1
+				if i >= len(tokens) {
+					i = len(tokens) - 1
+				}
+				switch test.version {
+				case 1:
+					w.Header().Set("X-Auth-Token", tokens[i])
+					w.Header().Set("X-Storage-Url", "http://storage.example.com/v1/AUTH_a")
+					w.WriteHeader(http.StatusNoContent)
+				case 2:
+					writeJson(w, http.StatusOK, strings.Replace(v2TokenBody, `"v2token"`, `"`+tokens[i]+`"`, 1))
+				default:
+					writeV3Token(w, tokens[i], v3TokenBody)
+				}
+			})
+			c := &swift.Connection{AuthUrl: s.URL + test.path, UserName: "user", ApiKey: "key", Domain: "Default", Tenant: "project"}
+			a := newAuth(t, c, test.version)
+			c.Auth = a
+			ctx := context.Background()
+			if err := c.Authenticate(ctx); err != nil {
+				t.Fatal(err)
+			}
+			refresher := a.(Refresher)
+			for i, want := range []bool{false, true} {
+				changed, err := refresher.Refresh(ctx, c)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if changed != want {
+					t.Errorf("refresh %d: changed = %v, want %v", i+1, changed, want)
+				}
+			}
+			if got := c.AuthToken; got != "token2" {
+				t.Errorf("connection token = %q, want token2", got)
+			}
+
+			other := &swift.Connection{AuthUrl: c.AuthUrl, UserName: "user", ApiKey: "key"}
+			if _, err := refresher.Refresh(ctx, other); err == nil {
+				t.Error("expected an error refreshing a connection using another authenticator")
+			}
+		})
+	}
+}
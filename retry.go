@@ -0,0 +1,202 @@
+package auth
+
+import (
+	"context"
+	"math/rand"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	// retryBaseDelay is the delay before the first retry
+	retryBaseDelay = 100 * time.Millisecond
+	// retryMaxDelay is the longest delay between retries
+	retryMaxDelay = 10 * time.Second
+)
+
+// ErrBudgetExceeded is returned when authentication including any
+// retries takes longer than the budget set with WithBudget
+var ErrBudgetExceeded = errors.New("auth budget exceeded")
+
+// WithRetries retries an auth request which fails with a network
+// error, a 5xx or a 429 up to retries more times
+//
+// The delay between attempts is set by WithBackoff. The default is
+// not to retry.
+func WithRetries(retries int) Option {
+	return func(o *options) {
+		o.retries = retries
+	}
+}
+
+// WithBudget limits the total time spent authenticating including
+// all the retries
+//
+// When the budget is used up the request in flight is cancelled and
+// the error is ErrBudgetExceeded.
+func WithBudget(budget time.Duration) Option {
+	return func(o *options) {
+		o.budget = budget
+	}
+}
+
+// withRetries calls attempt until it succeeds, fails with an error
+// which isn't worth retrying or the retries or budget run out
+//
+// The context bounds the whole loop: it is checked before each
+// attempt and no retry is made if the deadline would pass during the
+// backoff. Each attempt waits for the rate limit if one is set and
+// the result is recorded by the circuit breaker if one is set.
+//
+// The total time taken is reported to the Metrics if set.
+func (o *options) withRetries(ctx context.Context, attempt func(ctx context.Context) error) (err error) {
+	if o.breaker != nil {
+		trial, allowErr := o.breaker.allow(o.now())
+		if allowErr != nil {
+			return allowErr
+		}
+		defer func() {
+			o.breaker.record(err, o.now(), trial)
+		}()
+	}
+	start := o.now()
+	parent := ctx
+	if o.budget > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, o.budget)
+		defer cancel()
+	}
+	attempts := 0
+	outOfTime := false
+	defer func() {
+		if o.metrics != nil {
+			o.metrics.AuthDone(o.now().Sub(start), attempts, err)
+		}
+	}()
+	for {
+		if ctxErr := ctx.Err(); ctxErr != nil {
+			if err == nil {
+				err = ctxErr
+			}
+			break
+		}
+		attempts++
+		if err = o.waitRateLimit(ctx); err != nil {
+			break
+		}
+		err = attempt(ctx)
+		if err == nil || attempts > o.retries || ctx.Err() != nil || !isRetryable(err) {
+			break
+		}
+		delay := o.getBackoff().Next(attempts)
+		if deadline, ok := ctx.Deadline(); ok && time.Until(deadline) < delay {
+			// No time left for another attempt
+			outOfTime = true
+			break
+		}
+		o.logf("auth attempt %d failed, retrying: %v", attempts, err)
+		if !o.sleep(ctx, delay) {
+			break
+		}
+	}
+	if (ctx.Err() != nil || outOfTime) && parent.Err() == nil && o.budgetBinds(parent, start) {
+		return errors.Wrapf(ErrBudgetExceeded, "after %v and %d attempts: %v", o.now().Sub(start), attempts, err)
+	}
+	return err
+}
+
+// budgetBinds returns true if the budget ends before the deadline of
+// parent
+func (o *options) budgetBinds(parent context.Context, start time.Time) bool {
+	if o.budget <= 0 {
+		return false
+	}
+	deadline, ok := parent.Deadline()
+	return !ok || start.Add(o.budget).Before(deadline)
+}
+
+// isRetryable returns true if err may succeed if tried again
+//
+// Only network errors, timeouts of a single attempt and 5xx or 429
+// replies are retried. Everything else, such as auth rejections,
+// malformed responses and tokens rejected by the Validator, would
+// fail the same way again.
+func isRetryable(err error) bool {
+	var authErr *AuthError
+	if errors.As(err, &authErr) {
+		return authErr.StatusCode >= 500 || authErr.StatusCode == http.StatusTooManyRequests
+	}
+	var netErr net.Error
+	return errors.As(err, &netErr) || errors.Is(err, context.DeadlineExceeded)
+}
+
+// Backoff chooses the delay between auth attempts
+type Backoff interface {
+	// Next returns the delay after attempt which starts at 1
+	Next(attempt int) time.Duration
+}
+
+// WithBackoff sets the Backoff used between retries
+//
+// The default is exponential with jitter.
+func WithBackoff(backoff Backoff) Option {
+	return func(o *options) {
+		o.backoff = backoff
+	}
+}
+
+// WithJitterSeed seeds the random jitter of the default backoff so the
+// delays are reproducible, for example in tests
+//
+// By default the jitter is randomly seeded.
+func WithJitterSeed(seed int64) Option {
+	return func(o *options) {
+		o.jitter = &lockedRand{rng: rand.New(rand.NewSource(seed))}
+	}
+}
+
+// lockedRand is a rand.Rand safe for concurrent use
+type lockedRand struct {
+	mu  sync.Mutex
+	rng *rand.Rand
+}
+
+// int63n returns a random number in [0, n)
+func (r *lockedRand) int63n(n int64) int64 {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.rng.Int63n(n)
+}
+
+// exponentialBackoff doubles the delay after each attempt with jitter
+type exponentialBackoff struct {
+	jitter *lockedRand // if nil the global source is used
+}
+
+// Next returns the delay after attempt - exponential with jitter
+func (b exponentialBackoff) Next(attempt int) time.Duration {
+	delay := retryMaxDelay
+	if attempt < 32 {
+		delay = retryBaseDelay << uint(attempt-1)
+		if delay > retryMaxDelay || delay <= 0 {
+			delay = retryMaxDelay
+		}
+	}
+	n := int64(delay/2) + 1
+	if b.jitter != nil {
+		return delay/2 + time.Duration(b.jitter.int63n(n))
+	}
+	return delay/2 + time.Duration(rand.Int63n(n))
+}
+
+// getBackoff returns the Backoff to use
+func (o *options) getBackoff() Backoff {
+	if o.backoff == nil {
+		return exponentialBackoff{jitter: o.jitter}
+	}
+	return o.backoff
+}
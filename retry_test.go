@@ -0,0 +1,221 @@
+package auth
+
+import (
+	"context"
+	"errors"
+	"math/rand"
+	"net/http"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// constantBackoff waits the same time between all attempts
+type constantBackoff time.Duration
+
+func (b constantBackoff) Next(attempt int) time.Duration {
+	return time.Duration(b)
+}
+
+func TestRetriesServerErrors(t *testing.T) {
+	posts := 0
+	countPosts := func() int {
+		posts++
+		return posts
+	}
+	s := newFakeServer(t, func(w http.ResponseWriter, r *http.Request, body string) {
+		if countPosts() < 3 {
+			writeJson(w, http.StatusServiceUnavailable, `{}`)
+			return
+		}
+		writeV3Token(w, "tok", v3TokenBody)
+	})
+	c := v3Connection(s)
+	a := newAuth(t, c, AuthV3, WithRetries(3), WithBackoff(constantBackoff(time.Millisecond)))
+	if err := authenticate(a, c); err != nil {
+		t.Fatal(err)
+	}
+	if n := len(s.recorded()); n != 3 {
+		t.Errorf("sent %d requests, want 3", n)
+	}
+}
+
+func TestRetriesSkipDeterministicFailures(t *testing.T) {
+	for _, test := range []struct {
+		name    string
+		handler func(w http.ResponseWriter, r *http.Request, body string)
+		want    error
+	}{
+		{"unauthorized", func(w http.ResponseWriter, r *http.Request, body string) {
+			writeJson(w, http.StatusUnauthorized, `{}`)
+		}, nil},
+		{"no token", func(w http.ResponseWriter, r *http.Request, body string) {
+			writeJson(w, http.StatusCreated, `{"token":{}}`)
+		}, ErrNoToken},
+		{"not JSON", func(w http.ResponseWriter, r *http.Request, body string) {
+			w.Header().Set("Content-Type", "text/html")
+			_, _ = w.Write([]byte("<html>login</html>"))
+		}, nil},
+		{"bad JSON", func(w http.ResponseWriter, r *http.Request, body string) {
+			writeV3Token(w, "tok", `{"token":`)
+		}, nil},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			s := newFakeServer(t, test.handler)
+			c := v3Connection(s)
+			a := newAuth(t, c, AuthV3, WithRetries(3), WithBackoff(constantBackoff(time.Millisecond)))
+			err := authenticate(a, c)
+			if err == nil {
+				t.Fatal("expected an error")
+			}
+			if test.want != nil && !errors.Is(err, test.want) {
+				t.Errorf("err = %v, want %v", err, test.want)
+			}
+			if n := len(s.recorded()); n != 1 {
+				t.Errorf("sent %d requests, want 1", n)
+			}
+		})
+	}
+}
+
+func TestRetriesStopAtContextDeadline(t *testing.T) {
+	s := newFakeServer(t, func(w http.ResponseWriter, r *http.Request, body string) {
+		writeJson(w, http.StatusServiceUnavailable, `{}`)
+	})
+	c := v3Connection(s)
+	a := newAuth(t, c, AuthV3, WithRetries(1000), WithBackoff(constantBackoff(20*time.Millisecond)))
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	_, err := a.Request(ctx, c)
+	elapsed := time.Since(start)
+	if err == nil {
+		t.Fatal("expected an error")
+	}
+	if elapsed > 200*time.Millisecond+100*time.Millisecond {
+		t.Errorf("took %v, want to stop at the 200ms deadline", elapsed)
+	}
+	if n := len(s.recorded()); n < 2 || n > 11 {
+		t.Errorf("sent %d requests, want retries bounded by the deadline", n)
+	}
+}
+
+// recordingMetrics keeps the last AuthDone call
+type recordingMetrics struct {
+	calls    int
+	elapsed  time.Duration
+	attempts int
+	err      error
+}
+
+func (m *recordingMetrics) AuthDone(elapsed time.Duration, attempts int, err error) {
+	m.calls++
+	m.elapsed, m.attempts, m.err = elapsed, attempts, err
+}
+
+func TestBudgetStopsRetries(t *testing.T) {
+	for _, test := range []struct {
+		name         string
+		handler      func(w http.ResponseWriter, r *http.Request, body string)
+		wantAttempts int // minimum number of attempts
+	}{
+		{"retries exceed budget", func(w http.ResponseWriter, r *http.Request, body string) {
+			writeJson(w, http.StatusServiceUnavailable, `{}`)
+		}, 2},
+		{"attempt exceeds budget", slowHandler, 1},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			s := newFakeServer(t, test.handler)
+			c := v3Connection(s)
+			metrics := &recordingMetrics{}
+			a := newAuth(t, c, AuthV3, WithRetries(1000), WithBackoff(constantBackoff(20*time.Millisecond)),
+				WithBudget(150*time.Millisecond), WithMetrics(metrics))
+			start := time.Now()
+			err := authenticate(a, c)
+			elapsed := time.Since(start)
+			if !errors.Is(err, ErrBudgetExceeded) {
+				t.Fatalf("err = %v, want ErrBudgetExceeded", err)
+			}
+			if elapsed > 150*time.Millisecond+200*time.Millisecond {
+				t.Errorf("took %v, want to stop at the 150ms budget", elapsed)
+			}
+			if metrics.calls != 1 {
+				t.Fatalf("metrics called %d times, want 1", metrics.calls)
+			}
+			if metrics.attempts < test.wantAttempts || metrics.attempts != len(s.recorded()) {
+				t.Errorf("metrics reported %d attempts for %d requests", metrics.attempts, len(s.recorded()))
+			}
+			if metrics.elapsed <= 0 || metrics.elapsed > elapsed {
+				t.Errorf("metrics reported %v elapsed, want up to %v", metrics.elapsed, elapsed)
+			}
+			if !errors.Is(metrics.err, ErrBudgetExceeded) {
+				t.Errorf("metrics err = %v, want ErrBudgetExceeded", metrics.err)
+			}
+		})
+	}
+}
+
+// recordingBackoff records the attempts it is asked about
+type recordingBackoff struct {
+	attempts []int
+}
+
+func (b *recordingBackoff) Next(attempt int) time.Duration {
+	b.attempts = append(b.attempts, attempt)
+	return time.Millisecond
+}
+
+func TestBackoffAskedForEachRetry(t *testing.T) {
+	s := newFakeServer(t, func(w http.ResponseWriter, r *http.Request, body string) {
+		writeJson(w, http.StatusServiceUnavailable, `{}`)
+	})
+	c := v3Connection(s)
+	backoff := &recordingBackoff{}
+	a := newAuth(t, c, AuthV3, WithRetries(3), WithBackoff(backoff))
+	if err := authenticate(a, c); err == nil {
+		t.Fatal("expected an error")
+	}
+	if want := []int{1, 2, 3}; !reflect.DeepEqual(backoff.attempts, want) {
+		t.Errorf("backoff asked about attempts %v, want %v", backoff.attempts, want)
+	}
+	if n := len(s.recorded()); n != 4 {
+		t.Errorf("sent %d requests, want 4", n)
+	}
+}
+
+func TestJitterSeed(t *testing.T) {
+	// waits authenticates against a server failing 3 times with seed
+	// returning the delays waited on the clock
+	waits := func(seed int64) []time.Duration {
+		attempts := 0
+		s := newFakeServer(t, func(w http.ResponseWriter, r *http.Request, body string) {
+			if attempts++; attempts <= 3 {
+				writeJson(w, http.StatusServiceUnavailable, `{}`)
+				return
+			}
+			writeV3Token(w, "token", v3TokenBody)
+		})
+		c := v3Connection(s)
+		clock := &manualClock{now: ttlNow}
+		a := newAuth(t, c, AuthV3, WithRetries(3), WithJitterSeed(seed), WithClock(clock))
+		if err := authenticate(a, c); err != nil {
+			t.Fatal(err)
+		}
+		return clock.waits
+	}
+	// The delay doubles from 100ms with jitter in its upper half
+	rng := rand.New(rand.NewSource(42))
+	var want []time.Duration
+	for _, delay := range []time.Duration{100 * time.Millisecond, 200 * time.Millisecond, 400 * time.Millisecond} {
+		want = append(want, delay/2+time.Duration(rng.Int63n(int64(delay/2)+1)))
+	}
+	if got := waits(42); !reflect.DeepEqual(got, want) {
+		t.Errorf("waits with seed 42 = %v, want %v", got, want)
+	}
+	if got := waits(42); !reflect.DeepEqual(got, want) {
+		t.Errorf("waits with seed 42 again = %v, want %v", got, want)
+	}
+	if got := waits(7); reflect.DeepEqual(got, want) {
+		t.Errorf("waits with seed 7 = %v, want them to differ", got)
+	}
+}
@@ -0,0 +1,71 @@
+package auth
+
+import (
+	"context"
+
+	"github.com/ncw/swift/v2"
+	"github.com/pkg/errors"
+)
+
+// ScopeKind is what a token is scoped to
+type ScopeKind string
+
+// Scope kinds
+const (
+	ScopeUnscoped = ScopeKind("unscoped")
+	ScopeProject  = ScopeKind("project")
+	ScopeDomain   = ScopeKind("domain")
+	ScopeSystem   = ScopeKind("system")
+	ScopeTrust    = ScopeKind("trust")
+)
+
+// Scope describes what a token is scoped to
+type Scope struct {
+	Kind ScopeKind
+	Id   string // id of the project, domain or trust or the system name
+	Name string // name of the project or domain
+
+	// Domain of the project if known
+	DomainId   string
+	DomainName string
+}
+
+// ErrScopeMismatch is returned by VerifyScope when the token is not
+// scoped to the expected project
+var ErrScopeMismatch = errors.New("token scope mismatch")
+
+// ScopeReader is an optional interface to read what the token is
+// scoped to
+type ScopeReader interface {
+	Scope() Scope
+}
+
+// ScopeVerifier is an optional interface to check the token was
+// scoped to the project requested
+type ScopeVerifier interface {
+	VerifyScope(expectedProject string) error
+}
+
+// ProjectRef identifies a project by Id, or by Name within a domain
+// given by DomainId or DomainName
+type ProjectRef struct {
+	Id         string
+	Name       string
+	DomainId   string
+	DomainName string
+}
+
+// Rescoper is an optional interface to scope to another project with
+// the current token instead of sending the credentials again
+type Rescoper interface {
+	Rescope(ctx context.Context, c *swift.Connection, project ProjectRef) error
+}
+
+// verifyProject checks that expected is the id or the name of the
+// project the token is scoped to
+func verifyProject(expected, id, name string) error {
+	if expected == "" || expected == id || expected == name {
+		return nil
+	}
+	return errors.Wrapf(ErrScopeMismatch, "expected project %q but token is scoped to %q (id %q)", expected, name, id)
+}
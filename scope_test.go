@@ -0,0 +1,135 @@
+package auth
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/ncw/swift/v2"
+	"github.com/pkg/errors"
+)
+
+// v2UntenantedBody is v2TokenBody without a tenant
+var v2UntenantedBody = strings.Replace(v2TokenBody, `"tenant": {"description": null, "enabled": true, "id": "t1", "name": "tenant"},`, "", 1)
+
+// authenticateWith authenticates a new authenticator of version
+// against a server answering every request with body
+func authenticateWith(t *testing.T, version AuthVersion, body string, opts ...Option) swift.Authenticator {
+	t.Helper()
+	s := newFakeServer(t, func(w http.ResponseWriter, r *http.Request, _ string) {
+		if version == 3 {
+			writeV3Token(w, "token", body)
+		} else {
+			writeJson(w, http.StatusOK, body)
+		}
+	})
+	c := v3Connection(s)
+	if version == 2 {
+		c = v2Connection(s)
+	}
+	a := newAuth(t, c, version, opts...)
+	if err := authenticate(a, c); err != nil {
+		t.Fatalf("auth failed: %v", err)
+	}
+	return a
+}
+
+func TestIsScoped(t *testing.T) {
+	for _, test := range []struct {
+		name    string
+		version AuthVersion
+		body    string
+		want    bool
+	}{
+		{"v3 project", 3, v3TokenBody, true},
+		{"v3 unscoped", 3, v3UnscopedBody, false},
+		{"v2 tenant", 2, v2TokenBody, true},
+		{"v2 no tenant", 2, v2UntenantedBody, false},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			a := authenticateWith(t, test.version, test.body)
+			if got := a.(Scoper).IsScoped(); got != test.want {
+				t.Errorf("want IsScoped %v got %v", test.want, got)
+			}
+		})
+	}
+}
+
+func TestVerifyScope(t *testing.T) {
+	for _, test := range []struct {
+		name     string
+		version  AuthVersion
+		expected string
+		wantErr  bool
+	}{
+		{"v3 name", 3, "project", false},
+		{"v3 id", 3, "a6944d763bf64ee6a275f1263fae0352", false},
+		{"v3 other project", 3, "other", true},
+		{"v2 name", 2, "tenant", false},
+		{"v2 id", 2, "t1", false},
+		{"v2 other tenant", 2, "other", true},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			body := v3TokenBody
+			if test.version == 2 {
+				body = v2TokenBody
+			}
+			a := authenticateWith(t, test.version, body)
+			err := a.(ScopeVerifier).VerifyScope(test.expected)
+			if !test.wantErr {
+				if err != nil {
+					t.Errorf("VerifyScope(%q) = %v", test.expected, err)
+				}
+				return
+			}
+			if !errors.Is(err, ErrScopeMismatch) {
+				t.Fatalf("VerifyScope(%q) = %v, want ErrScopeMismatch", test.expected, err)
+			}
+			if !strings.Contains(err.Error(), `"other"`) {
+				t.Errorf("error %q doesn't quote the expected project", err)
+			}
+		})
+	}
+}
+
+func TestScopeKinds(t *testing.T) {
+	// v3Project is the project scope of v3TokenBody
+	const v3Project = `"project": {
+      "domain": {"id": "default", "name": "Default"},
+      "id": "a6944d763bf64ee6a275f1263fae0352",
+      "name": "project"
+    },`
+	scopedTo := func(scope string) string {
+		return strings.Replace(v3TokenBody, v3Project, scope, 1)
+	}
+	for _, test := range []struct {
+		name    string
+		version AuthVersion
+		body    string
+		want    Scope
+	}{
+		{"v3 project", 3, v3TokenBody, Scope{
+			Kind:       ScopeProject,
+			Id:         "a6944d763bf64ee6a275f1263fae0352",
+			Name:       "project",
+			DomainId:   "default",
+			DomainName: "Default",
+		}},
+		{"v3 domain", 3, scopedTo(`"domain": {"id": "did", "name": "users"},`), Scope{Kind: ScopeDomain, Id: "did", Name: "users"}},
+		{"v3 system", 3, scopedTo(`"system": {"all": true},`), Scope{Kind: ScopeSystem, Id: "all"}},
+		{"v3 trust", 3, scopedTo(v3Project + `"OS-TRUST:trust": {"id": "trust1", "impersonation": false},`), Scope{Kind: ScopeTrust, Id: "trust1"}},
+		{"v3 unscoped", 3, scopedTo(""), Scope{Kind: ScopeUnscoped}},
+		{"v2 tenant", 2, v2TokenBody, Scope{Kind: ScopeProject, Id: "t1", Name: "tenant"}},
+		{"v2 no tenant", 2, v2UntenantedBody, Scope{Kind: ScopeUnscoped}},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			a := authenticateWith(t, test.version, test.body)
+			if got := a.(ScopeReader).Scope(); got != test.want {
+				t.Errorf("scope = %+v, want %+v", got, test.want)
+			}
+			if got, want := a.(Scoper).IsScoped(), test.want.Kind != ScopeUnscoped; got != want {
+				t.Errorf("IsScoped = %v, want %v", got, want)
+			}
+		})
+	}
+}
@@ -0,0 +1,29 @@
+package auth
+
+import (
+	"net/http"
+
+	"github.com/pkg/errors"
+)
+
+// SignRequest adds a signature to an auth request, for example an
+// HMAC of body in a header required by a gateway in front of Keystone
+//
+// body is the request body, nil for requests without one.
+type SignRequest func(req *http.Request, body []byte) error
+
+// WithRequestSigner makes sign run on every auth request just before
+// it is sent
+func WithRequestSigner(sign SignRequest) Option {
+	return func(o *options) {
+		o.signRequest = sign
+	}
+}
+
+// sign signs req with the SignRequest if set
+func (o *options) sign(req *http.Request, body []byte) error {
+	if o.signRequest == nil {
+		return nil
+	}
+	return errors.Wrap(o.signRequest(req, body), "sign request")
+}
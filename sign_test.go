@@ -0,0 +1,78 @@
+package auth
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"testing"
+
+	"github.com/ncw/swift/v2"
+	"github.com/pkg/errors"
+)
+
+// hmacSigner signs requests with an HMAC of the body in X-Signature
+func hmacSigner(key string) SignRequest {
+	return func(req *http.Request, body []byte) error {
+		req.Header.Set("X-Signature", signature(key, body))
+		return nil
+	}
+}
+
+// signature returns the hex HMAC-SHA256 of body with key
+func signature(key string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(key))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func TestRequestSigner(t *testing.T) {
+	s := newFakeServer(t, func(w http.ResponseWriter, r *http.Request, body string) {
+		// The gateway rejects requests not signed over the body sent
+		if r.Header.Get("X-Signature") != signature("key", []byte(body)) {
+			writeJson(w, http.StatusForbidden, `{}`)
+			return
+		}
+		switch r.URL.Path {
+		case "/auth/v1.0":
+			w.Header().Set("X-Auth-Token", "token")
+			w.Header().Set("X-Storage-Url", "http://storage.example.com/v1/AUTH_a")
+			w.WriteHeader(http.StatusNoContent)
+		case "/v2.0/tokens":
+			writeJson(w, http.StatusOK, v2TokenBody)
+		default:
+			writeV3Token(w, "token", v3TokenBody)
+		}
+	})
+	for _, test := range []struct {
+		name    string
+		version AuthVersion
+		c       *swift.Connection
+	}{
+		{"v1", 1, &swift.Connection{AuthUrl: s.URL + "/auth/v1.0", UserName: "user", ApiKey: "key"}},
+		{"v2", 2, v2Connection(s)},
+		{"v3", 3, v3Connection(s)},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			if err := authenticate(newAuth(t, test.c, test.version, WithRequestSigner(hmacSigner("key"))), test.c); err != nil {
+				t.Fatalf("signed auth failed: %v", err)
+			}
+			if err := authenticate(newAuth(t, test.c, test.version, WithRequestSigner(hmacSigner("wrong"))), test.c); err == nil {
+				t.Error("expected auth signed with the wrong key to fail")
+			}
+
+			// A failing signer stops the request being sent
+			before := len(s.recorded())
+			failed := errors.New("no key")
+			err := authenticate(newAuth(t, test.c, test.version, WithRequestSigner(func(*http.Request, []byte) error {
+				return failed
+			})), test.c)
+			if !errors.Is(err, failed) {
+				t.Errorf("err = %v, want the signer's error", err)
+			}
+			if n := len(s.recorded()); n != before {
+				t.Errorf("sent %d requests after the signer failed", n-before)
+			}
+		})
+	}
+}
@@ -0,0 +1,39 @@
+package auth
+
+// Credential forms recorded in a Snapshot
+const (
+	CredentialFormPassword = "password"
+	CredentialFormApiKey   = "apiKey"
+)
+
+// Snapshot is the state of an authenticator which can be persisted
+// and restored to avoid rediscovering it after a restart
+type Snapshot struct {
+	// v2 auth: the credential form known to work
+	CredentialForm string `json:"credentialForm,omitempty"`
+	// v2 auth: the user name and auth url CredentialForm was found
+	// with so it is only trusted for the same user and server
+	//
+	// Nothing derived from the password is kept as snapshots may be
+	// stored anywhere.
+	UserName string `json:"userName,omitempty"`
+	AuthUrl  string `json:"authUrl,omitempty"`
+}
+
+// Snapshotter is an optional interface to save and restore the state
+// of an authenticator
+type Snapshotter interface {
+	Snapshot() Snapshot
+	Restore(Snapshot)
+}
+
+// credentialKey identifies the credentials a credential form is for
+type credentialKey struct {
+	userName string
+	authUrl  string
+}
+
+// key returns the credentialKey the snapshot is for
+func (s *Snapshot) key() credentialKey {
+	return credentialKey{userName: s.UserName, authUrl: s.AuthUrl}
+}
@@ -0,0 +1,68 @@
+package auth
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+// v2FormServer answers v2 auth only for the API key form
+func v2FormServer(t *testing.T) *fakeServer {
+	return newFakeServer(t, func(w http.ResponseWriter, r *http.Request, body string) {
+		if !strings.Contains(body, "apiKeyCredentials") {
+			writeJson(w, http.StatusUnauthorized, `{}`)
+			return
+		}
+		writeJson(w, http.StatusOK, v2TokenBody)
+	})
+}
+
+func TestSnapshotRestoresCredentialForm(t *testing.T) {
+	s := v2FormServer(t)
+	c := v2Connection(s)
+	a := newAuth(t, c, AuthV2)
+	// The short key is tried as a password first then as an API key
+	if err := authenticate(a, c); err == nil {
+		t.Fatal("password form should fail")
+	}
+	if err := authenticate(a, c); err != nil {
+		t.Fatal(err)
+	}
+	snapshot := a.(Snapshotter).Snapshot()
+	if snapshot.CredentialForm != CredentialFormApiKey {
+		t.Fatalf("snapshot = %+v", snapshot)
+	}
+	data, err := json.Marshal(snapshot)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(data), c.ApiKey) || strings.Contains(strings.ToLower(string(data)), "hash") {
+		t.Errorf("snapshot holds something derived from the key: %s", data)
+	}
+
+	restored := newAuth(t, c, AuthV2)
+	restored.(Snapshotter).Restore(snapshot)
+	before := len(s.recorded())
+	if err := authenticate(restored, c); err != nil {
+		t.Fatal(err)
+	}
+	if sent := len(s.recorded()) - before; sent != 1 {
+		t.Errorf("restored auth sent %d requests, want 1", sent)
+	}
+}
+
+func TestSnapshotIgnoredForOtherUser(t *testing.T) {
+	s := v2FormServer(t)
+	c := v2Connection(s)
+	other := v2Connection(s)
+	other.UserName = "other"
+	a := newAuth(t, c, AuthV2)
+	a.(Snapshotter).Restore(Snapshot{CredentialForm: CredentialFormApiKey, UserName: "user", AuthUrl: c.AuthUrl})
+	if err := authenticate(a, other); err == nil {
+		t.Fatal("snapshot for another user should be ignored so the password form is tried first")
+	}
+	if body := s.recorded()[0].Body; !strings.Contains(body, "passwordCredentials") {
+		t.Errorf("first request = %s, want password form", body)
+	}
+}
@@ -0,0 +1,192 @@
+package auth
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+
+	"github.com/pkg/errors"
+)
+
+// WithStreamingCatalog makes v3 auth stream the response keeping only
+// the storage services of the catalog
+//
+// This saves decoding the rest of enormous catalogs at the cost of
+// generality: only the storage endpoints can be listed, the raw
+// response isn't kept and strict decoding doesn't apply. It is off by
+// default.
+func WithStreamingCatalog(enabled bool) Option {
+	return func(o *options) {
+		o.streamingCatalog = enabled
+	}
+}
+
+// readStreamed reads a v3 response into response skipping the
+// services of the catalog which aren't storage types
+//
+// Closes the response when done
+func (o *options) readStreamed(resp *http.Response, response *v3AuthResponse) (err error) {
+	defer drainAndClose(resp.Body, &err)
+	if err = checkJsonContentType(resp); err != nil {
+		return err
+	}
+	dec := json.NewDecoder(resp.Body)
+	if err = expectDelim(dec, '{'); err != nil {
+		return err
+	}
+	for dec.More() {
+		key, err := dec.Token()
+		if err != nil {
+			return err
+		}
+		if key != "token" {
+			if err = skipValue(dec); err != nil {
+				return err
+			}
+			continue
+		}
+		if err = o.streamToken(dec, response); err != nil {
+			return err
+		}
+	}
+	return expectDelim(dec, '}')
+}
+
+// streamToken reads the token object into response streaming its
+// catalog
+func (o *options) streamToken(dec *json.Decoder, response *v3AuthResponse) error {
+	if err := expectDelim(dec, '{'); err != nil {
+		return err
+	}
+	fields := make(map[string]json.RawMessage)
+	for dec.More() {
+		key, err := dec.Token()
+		if err != nil {
+			return err
+		}
+		name, _ := key.(string)
+		if name == "catalog" {
+			if err = o.streamCatalog(dec, response); err != nil {
+				return err
+			}
+			continue
+		}
+		var value json.RawMessage
+		if err = dec.Decode(&value); err != nil {
+			return err
+		}
+		fields[name] = value
+	}
+	if err := expectDelim(dec, '}'); err != nil {
+		return err
+	}
+	// The other token fields are small so decode them as usual
+	rest, err := json.Marshal(fields)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(rest, &response.Token)
+}
+
+// streamCatalog reads the catalog array keeping only the storage
+// services
+func (o *options) streamCatalog(dec *json.Decoder, response *v3AuthResponse) error {
+	if err := expectDelim(dec, '['); err != nil {
+		return err
+	}
+	for dec.More() {
+		entry, keep, err := o.streamCatalogEntry(dec)
+		if err != nil {
+			return err
+		}
+		if keep {
+			response.Token.Catalog = append(response.Token.Catalog, entry)
+		}
+	}
+	return expectDelim(dec, ']')
+}
+
+// streamCatalogEntry reads a catalog service returning whether it is
+// a storage type
+//
+// The endpoints are skipped if the type comes before them and isn't a
+// storage type, otherwise they are decoded once the type is known.
+func (o *options) streamCatalogEntry(dec *json.Decoder) (entry v3CatalogEntry, keep bool, err error) {
+	if err = expectDelim(dec, '{'); err != nil {
+		return entry, false, err
+	}
+	typeSet := false
+	var endpoints json.RawMessage
+	for dec.More() {
+		key, err := dec.Token()
+		if err != nil {
+			return entry, false, err
+		}
+		switch name, _ := key.(string); {
+		case name == "type":
+			err = dec.Decode(&entry.Type)
+			typeSet = true
+		case name == "id":
+			err = dec.Decode(&entry.Id)
+		case name == "name":
+			err = dec.Decode(&entry.Name)
+		case name == "endpoints" && typeSet:
+			if contains(o.storageTypes(), entry.Type) {
+				err = dec.Decode(&entry.Endpoints)
+			} else {
+				err = skipValue(dec)
+			}
+		case name == "endpoints":
+			err = dec.Decode(&endpoints)
+		default:
+			err = skipValue(dec)
+		}
+		if err != nil {
+			return entry, false, err
+		}
+	}
+	if err = expectDelim(dec, '}'); err != nil {
+		return entry, false, err
+	}
+	keep = contains(o.storageTypes(), entry.Type)
+	if keep && endpoints != nil {
+		err = json.Unmarshal(endpoints, &entry.Endpoints)
+	}
+	return entry, keep, err
+}
+
+// expectDelim reads the delimiter delim from dec
+//
+// An empty body returns io.EOF.
+func expectDelim(dec *json.Decoder, delim json.Delim) error {
+	token, err := dec.Token()
+	if err != nil {
+		return err
+	}
+	if token != delim {
+		return errors.Errorf("expecting %q in JSON but got %v", delim, token)
+	}
+	return nil
+}
+
+// skipValue reads past the next JSON value without keeping it
+func skipValue(dec *json.Decoder) error {
+	depth := 0
+	for {
+		token, err := dec.Token()
+		if err == io.EOF {
+			return io.ErrUnexpectedEOF
+		} else if err != nil {
+			return err
+		}
+		switch token {
+		case json.Delim('{'), json.Delim('['):
+			depth++
+		case json.Delim('}'), json.Delim(']'):
+			depth--
+		}
+		if depth == 0 {
+			return nil
+		}
+	}
+}
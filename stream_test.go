@@ -0,0 +1,98 @@
+package auth
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// largeV3Body returns a v3 token response with services services of
+// three endpoints each, one of them the object store
+func largeV3Body(services int) []byte {
+	var catalog []string
+	for i := 0; i < services; i++ {
+		Type := fmt.Sprintf("service-%d", i)
+		if i == services/2 {
+			Type = "object-store"
+		}
+		var endpoints []string
+		for _, iface := range []string{"public", "internal", "admin"} {
+			endpoints = append(endpoints, fmt.Sprintf(`{"id":"%d-%s","interface":"%s","region":"R","region_id":"R","url":"http://%s.example.com/%d"}`, i, iface, iface, iface, i))
+		}
+		catalog = append(catalog, fmt.Sprintf(`{"endpoints":[%s],"id":"s%d","type":"%s","name":"n%d"}`, strings.Join(endpoints, ","), i, Type, i))
+	}
+	return []byte(`{"token":{"methods":["password"],"user":{"domain":{"id":"default","name":"Default"},"id":"u","name":"user"},` +
+		`"expires_at":"2099-11-07T02:58:43.578887Z","issued_at":"2015-11-07T01:58:43.578929Z",` +
+		`"project":{"domain":{"id":"default","name":"Default"},"id":"p","name":"project"},` +
+		`"catalog":[` + strings.Join(catalog, ",") + `]}}`)
+}
+
+// jsonResponse returns a response with body
+func jsonResponse(body []byte) *http.Response {
+	return &http.Response{
+		StatusCode: http.StatusOK,
+		Header:     http.Header{"Content-Type": []string{"application/json"}},
+		Body:       ioutil.NopCloser(bytes.NewReader(body)),
+	}
+}
+
+// storageEntries returns the storage services of response
+func storageEntries(response *v3AuthResponse) []v3CatalogEntry {
+	var entries []v3CatalogEntry
+	for _, entry := range response.Token.Catalog {
+		if entry.Type == "object-store" {
+			entries = append(entries, entry)
+		}
+	}
+	return entries
+}
+
+func TestStreamCatalogMatchesBuffered(t *testing.T) {
+	body := largeV3Body(50)
+	o := newOptions()
+	var streamed, buffered v3AuthResponse
+	if err := o.readStreamed(jsonResponse(body), &streamed); err != nil {
+		t.Fatalf("streamed: %v", err)
+	}
+	if _, err := o.readJson(jsonResponse(body), &buffered); err != nil {
+		t.Fatalf("buffered: %v", err)
+	}
+	if len(streamed.Token.Catalog) != 1 {
+		t.Errorf("want only the storage service streamed got %d services", len(streamed.Token.Catalog))
+	}
+	if !reflect.DeepEqual(storageEntries(&streamed), storageEntries(&buffered)) {
+		t.Errorf("storage services differ:\n%+v\n%+v", storageEntries(&streamed), storageEntries(&buffered))
+	}
+	if streamed.Token.ExpiresAt != buffered.Token.ExpiresAt || streamed.Token.Project.Id != "p" {
+		t.Errorf("token fields differ: %+v", streamed.Token)
+	}
+}
+
+func BenchmarkStreamCatalog(b *testing.B) {
+	body := largeV3Body(1000)
+	o := newOptions()
+	b.Run("streaming", func(b *testing.B) {
+		b.ReportAllocs()
+		b.SetBytes(int64(len(body)))
+		for i := 0; i < b.N; i++ {
+			var response v3AuthResponse
+			if err := o.readStreamed(jsonResponse(body), &response); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+	b.Run("buffered", func(b *testing.B) {
+		b.ReportAllocs()
+		b.SetBytes(int64(len(body)))
+		for i := 0; i < b.N; i++ {
+			var response v3AuthResponse
+			if _, err := o.readJson(jsonResponse(body), &response); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
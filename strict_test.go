@@ -0,0 +1,73 @@
+package auth
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestStrictJsonAcceptsDocumentedV3Response(t *testing.T) {
+	s := newFakeServer(t, func(w http.ResponseWriter, r *http.Request, body string) {
+		writeV3Token(w, "tok", v3TokenBody)
+	})
+	c := v3Connection(s)
+	a := newAuth(t, c, AuthV3, WithStrictJson(true))
+	if err := authenticate(a, c); err != nil {
+		t.Fatalf("strict auth failed: %v", err)
+	}
+	if got, want := a.StorageUrl(false), "http://public.example.com/v1/AUTH_p"; got != want {
+		t.Errorf("StorageUrl = %q, want %q", got, want)
+	}
+	v3 := a.(*v3Auth)
+	if got := v3.Auth.Token.Catalog[1].Name; got != "swift" {
+		t.Errorf("catalog name = %q, want swift", got)
+	}
+}
+
+func TestStrictJsonAcceptsDocumentedV2Response(t *testing.T) {
+	s := newFakeServer(t, func(w http.ResponseWriter, r *http.Request, body string) {
+		writeJson(w, http.StatusOK, v2TokenBody)
+	})
+	c := v2Connection(s)
+	a := newAuth(t, c, AuthV2, WithStrictJson(true))
+	if err := authenticate(a, c); err != nil {
+		t.Fatalf("strict auth failed: %v", err)
+	}
+	if got := a.Token(); got != "v2token" {
+		t.Errorf("Token = %q", got)
+	}
+}
+
+func TestStrictJsonRejectsUnknownField(t *testing.T) {
+	s := newFakeServer(t, func(w http.ResponseWriter, r *http.Request, body string) {
+		writeV3Token(w, "tok", `{"token":{"expires_at":"2099-01-01T00:00:00Z","surprise":1}}`)
+	})
+	c := v3Connection(s)
+	err := authenticate(newAuth(t, c, AuthV3, WithStrictJson(true)), c)
+	if err == nil || !strings.Contains(err.Error(), `unknown field "surprise"`) {
+		t.Fatalf("err = %v, want unknown field", err)
+	}
+	// Lenient by default
+	if err := authenticate(newAuth(t, c, AuthV3), c); err != nil {
+		t.Fatalf("lenient auth failed: %v", err)
+	}
+}
+
+func TestStrictJsonAcceptsVersionsDocument(t *testing.T) {
+	var s *fakeServer
+	s = newFakeServer(t, func(w http.ResponseWriter, r *http.Request, body string) {
+		if r.URL.Path == "/" {
+			writeJson(w, http.StatusMultipleChoices, `{"versions":{"values":[{"id":"v3.14","status":"stable","updated":"2020-04-07T00:00:00Z",
+"links":[{"rel":"self","href":"`+s.URL+`/v3/"}],
+"media-types":[{"base":"application/json","type":"application/vnd.openstack.identity-v3+json"}]}]}}`)
+			return
+		}
+		writeV3Token(w, "tok", v3TokenBody)
+	})
+	c := v3Connection(s)
+	c.AuthUrl = s.URL
+	a := newAuth(t, c, 0, WithStrictJson(true), WithVersionProbe(true))
+	if err := authenticate(a, c); err != nil {
+		t.Fatalf("strict probe failed: %v", err)
+	}
+}
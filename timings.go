@@ -0,0 +1,155 @@
+package auth
+
+import (
+	"crypto/tls"
+	"net/http"
+	"net/http/httptrace"
+	"sync"
+	"time"
+)
+
+// Timings is a breakdown of the time taken by an auth request
+//
+// Phases which didn't happen, for example DNS and Connect on a reused
+// connection, are 0.
+type Timings struct {
+	DNS          time.Duration
+	Connect      time.Duration
+	TLSHandshake time.Duration
+	TTFB         time.Duration // from sending the request to the first response byte
+	Total        time.Duration // from starting the request to the response headers
+}
+
+// TimingsObserver receives the Timings of each auth request
+type TimingsObserver interface {
+	AuthTimings(Timings)
+}
+
+// TimingsReader is an optional interface to read the Timings of the
+// last auth request when a TimingsObserver is set
+type TimingsReader interface {
+	LastTimings() Timings
+}
+
+// WithTimingsObserver traces each auth request and reports its
+// Timings to observer
+//
+// Requests are only traced when an observer is set.
+func WithTimingsObserver(observer TimingsObserver) Option {
+	return func(o *options) {
+		o.timingsObserver = observer
+	}
+}
+
+// AuthDurationReader is an optional interface to read how long the
+// last successful auth request took
+type AuthDurationReader interface {
+	LastAuthDuration() time.Duration
+}
+
+// timingsState holds the Timings of the last request
+type timingsState struct {
+	mu           sync.Mutex
+	last         Timings
+	authDuration time.Duration // of the last successful request
+}
+
+// LastTimings returns the Timings of the last auth request
+func (o *options) LastTimings() Timings {
+	o.timingsState.mu.Lock()
+	defer o.timingsState.mu.Unlock()
+	return o.timingsState.last
+}
+
+// LastAuthDuration returns how long the last successful auth request
+// took from sending it to reading the response headers
+//
+// Only the request issuing the token is measured, not those fetching
+// catalogs, listing projects or validating tokens.
+//
+// It is 0 before the first success.
+func (o *options) LastAuthDuration() time.Duration {
+	o.timingsState.mu.Lock()
+	defer o.timingsState.mu.Unlock()
+	return o.timingsState.authDuration
+}
+
+// setAuthDuration records the duration of a successful auth request
+func (o *options) setAuthDuration(d time.Duration) {
+	o.timingsState.mu.Lock()
+	o.timingsState.authDuration = d
+	o.timingsState.mu.Unlock()
+}
+
+// traceRequest returns r traced if a TimingsObserver is set and a
+// function to call when the response headers have been read
+func (o *options) traceRequest(r *http.Request) (*http.Request, func()) {
+	if o.timingsObserver == nil {
+		return r, func() {}
+	}
+	var (
+		mu                                          sync.Mutex
+		t                                           Timings
+		dnsStart, connectStart, tlsStart, wroteTime time.Time
+	)
+	start := time.Now()
+	since := func(from time.Time) time.Duration {
+		if from.IsZero() {
+			return 0
+		}
+		return time.Since(from)
+	}
+	trace := &httptrace.ClientTrace{
+		DNSStart: func(httptrace.DNSStartInfo) {
+			mu.Lock()
+			dnsStart = time.Now()
+			mu.Unlock()
+		},
+		DNSDone: func(httptrace.DNSDoneInfo) {
+			mu.Lock()
+			t.DNS = since(dnsStart)
+			mu.Unlock()
+		},
+		ConnectStart: func(_, _ string) {
+			mu.Lock()
+			connectStart = time.Now()
+			mu.Unlock()
+		},
+		ConnectDone: func(_, _ string, _ error) {
+			mu.Lock()
+			t.Connect = since(connectStart)
+			mu.Unlock()
+		},
+		TLSHandshakeStart: func() {
+			mu.Lock()
+			tlsStart = time.Now()
+			mu.Unlock()
+		},
+		TLSHandshakeDone: func(tls.ConnectionState, error) {
+			mu.Lock()
+			t.TLSHandshake = since(tlsStart)
+			mu.Unlock()
+		},
+		WroteRequest: func(httptrace.WroteRequestInfo) {
+			mu.Lock()
+			wroteTime = time.Now()
+			mu.Unlock()
+		},
+		GotFirstResponseByte: func() {
+			mu.Lock()
+			t.TTFB = since(wroteTime)
+			mu.Unlock()
+		},
+	}
+	r = r.WithContext(httptrace.WithClientTrace(r.Context(), trace))
+	return r, func() {
+		mu.Lock()
+		t.Total = time.Since(start)
+		timings := t
+		mu.Unlock()
+		o.timingsState.mu.Lock()
+		o.timingsState.last = timings
+		o.timingsState.mu.Unlock()
+		o.timingsObserver.AuthTimings(timings)
+	}
+}
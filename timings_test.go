@@ -0,0 +1,92 @@
+package auth
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/ncw/swift/v2"
+)
+
+func TestLastAuthDurationIsTheTokenRequest(t *testing.T) {
+	const delay = 100 * time.Millisecond
+	s := newFakeServer(t, func(w http.ResponseWriter, r *http.Request, body string) {
+		switch r.URL.Path {
+		case "/auth/v1.0":
+			time.Sleep(delay)
+			w.Header().Set("X-Auth-Token", "token")
+			w.Header().Set("X-Storage-Url", "http://storage.example.com/v1/AUTH_a")
+			w.WriteHeader(http.StatusNoContent)
+		case "/v3/auth/catalog":
+			writeJson(w, http.StatusOK, `{"catalog":[]}`)
+		default:
+			http.NotFound(w, r)
+		}
+	})
+	c := &swift.Connection{AuthUrl: s.URL + "/auth/v1.0", UserName: "user", ApiKey: "key"}
+	a := newAuth(t, c, 1, WithV1Catalog(s.URL+"/v3"))
+	if err := authenticate(a, c); err != nil {
+		t.Fatalf("auth failed: %v", err)
+	}
+	if n := len(s.recorded()); n != 2 {
+		t.Fatalf("want 2 requests got %d", n)
+	}
+	if got := a.(AuthDurationReader).LastAuthDuration(); got < delay {
+		t.Errorf("want the token request duration of at least %v got %v", delay, got)
+	}
+}
+
+// timingsRecorder keeps the Timings it observes
+type timingsRecorder struct {
+	timings []Timings
+}
+
+func (r *timingsRecorder) AuthTimings(timings Timings) {
+	r.timings = append(r.timings, timings)
+}
+
+func TestTimingsBreakdown(t *testing.T) {
+	s := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(10 * time.Millisecond)
+		writeV3Token(w, "token", v3TokenBody)
+	}))
+	defer s.Close()
+	connection := func() *swift.Connection {
+		return &swift.Connection{
+			AuthUrl:   s.URL + "/v3",
+			UserName:  "user",
+			ApiKey:    "secret",
+			Domain:    "Default",
+			Tenant:    "project",
+			Transport: s.Client().Transport.(*http.Transport).Clone(),
+		}
+	}
+
+	c := connection()
+	observer := &timingsRecorder{}
+	a := newAuth(t, c, AuthV3, WithTimingsObserver(observer))
+	if err := authenticate(a, c); err != nil {
+		t.Fatal(err)
+	}
+	if len(observer.timings) != 1 {
+		t.Fatalf("observed %d timings, want 1", len(observer.timings))
+	}
+	got := observer.timings[0]
+	// The server is dialled by IP so there is no DNS lookup
+	if got.Connect <= 0 || got.TLSHandshake <= 0 || got.TTFB < 10*time.Millisecond || got.Total < got.TTFB {
+		t.Errorf("timings %+v, want connect, TLS and TTFB phases", got)
+	}
+	if last := a.(TimingsReader).LastTimings(); last != got {
+		t.Errorf("LastTimings() = %+v, want %+v", last, got)
+	}
+
+	c = connection()
+	a = newAuth(t, c, AuthV3)
+	if err := authenticate(a, c); err != nil {
+		t.Fatal(err)
+	}
+	if last := a.(TimingsReader).LastTimings(); last != (Timings{}) {
+		t.Errorf("timings %+v recorded without an observer", last)
+	}
+}
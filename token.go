@@ -0,0 +1,236 @@
+package auth
+
+import (
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// TokenInfo describes the current token
+type TokenInfo struct {
+	Token     string
+	IssuedAt  time.Time     // zero if not known
+	ExpiresAt time.Time     // zero if not known
+	TTL       time.Duration // time left before ExpiresAt, 0 if not known or expired
+	Scope     Scope
+	Roles     []string // names of the roles the token carries
+}
+
+// TokenInformer is an optional interface to read information about
+// the current token
+type TokenInformer interface {
+	TokenInfo() TokenInfo
+}
+
+// Expirer is an optional interface to check the expiry of the token
+// against the clock
+type Expirer interface {
+	ExpiresIn() time.Duration
+	IsExpired() bool
+}
+
+// ExpiryLocator is an optional interface to read the expiry of the
+// token in UTC or another location rather than the offset used by the
+// auth server
+type ExpiryLocator interface {
+	ExpiresUTC() time.Time
+	ExpiresInLocation(loc *time.Location) time.Time
+}
+
+// ReauthAdvisor is an optional interface to decide whether to
+// authenticate again
+type ReauthAdvisor interface {
+	// NeedsReauth returns true if there is no token, it has
+	// expired or it expires within buffer
+	NeedsReauth(buffer time.Duration) bool
+}
+
+// ClockSkewDetector is an optional interface to check the local clock
+// against the times of the token, as a skewed clock breaks the expiry
+// logic and may cause reauth loops
+type ClockSkewDetector interface {
+	DetectClockSkew() (time.Duration, error)
+}
+
+// ErrClockSkew is returned by DetectClockSkew when the token times
+// show the local clock is skewed
+var ErrClockSkew = errors.New("clock skew")
+
+// clockSkewTolerance is how far a token may appear to be issued in the
+// future before it is put down to clock skew, allowing for the
+// precision of the times
+const clockSkewTolerance = 5 * time.Second
+
+// timeLayouts are the layouts tried in turn to parse token times
+var timeLayouts = []string{
+	time.RFC3339Nano,
+	"2006-01-02T15:04:05.999999999Z0700",
+	"2006-01-02T15:04:05.999999999", // no zone means UTC
+}
+
+// parseTime parses a time from an auth response returning zero if it
+// can't be parsed
+func parseTime(s string) time.Time {
+	if s == "" {
+		return time.Time{}
+	}
+	for _, layout := range timeLayouts {
+		if t, err := time.Parse(layout, s); err == nil {
+			return t
+		}
+	}
+	return time.Time{}
+}
+
+// WithDefaultTTL treats a token whose response has no expiry as
+// expiring ttl after it was obtained
+//
+// Without it such a token has a zero expiry which some callers treat
+// as already expired, causing reauth loops.
+func WithDefaultTTL(ttl time.Duration) Option {
+	return func(o *options) {
+		o.defaultTTL = ttl
+	}
+}
+
+// expiresOrDefault returns expires or, if that is zero and a default
+// TTL is set, the default TTL after obtained
+func (o *options) expiresOrDefault(expires, obtained time.Time) time.Time {
+	if !expires.IsZero() || o.defaultTTL <= 0 || obtained.IsZero() {
+		return expires
+	}
+	return obtained.Add(o.defaultTTL)
+}
+
+// logDefaultTTL logs if the default TTL is used for a token whose
+// expiry is expiresAt
+func (o *options) logDefaultTTL(expiresAt string) {
+	if o.defaultTTL > 0 && parseTime(expiresAt).IsZero() {
+		o.logf("token has no expiry (%q) - using default TTL %v", expiresAt, o.defaultTTL)
+	}
+}
+
+// ttl returns the time left before expires or 0 if expires is zero
+// or past
+func (o *options) ttl(expires time.Time) time.Duration {
+	if expires.IsZero() {
+		return 0
+	}
+	ttl := expires.Sub(o.now())
+	if ttl < 0 {
+		return 0
+	}
+	return ttl
+}
+
+// expired returns true if expires is set and has passed
+func (o *options) expired(expires time.Time) bool {
+	return !expires.IsZero() && !o.now().Before(expires)
+}
+
+// newTokenInfo makes a TokenInfo
+func (o *options) newTokenInfo(token, issuedAt string, expires time.Time, scope Scope, roles []string) TokenInfo {
+	return TokenInfo{
+		Token:     token,
+		IssuedAt:  parseTime(issuedAt),
+		ExpiresAt: expires,
+		TTL:       o.ttl(expires),
+		Scope:     scope,
+		Roles:     roles,
+	}
+}
+
+// ErrNoToken is returned when a successful auth response carries no
+// token
+//
+// Success is judged by the token rather than the status so proxies
+// answering 200 or 203 instead of 201 are accepted.
+var ErrNoToken = errors.New("no token in auth response")
+
+// ErrTokenRejected is returned when the Validator rejects the token
+var ErrTokenRejected = errors.New("token rejected")
+
+// Validator checks a new token against local policy, for example
+// that it carries a role or is scoped to a domain
+type Validator func(TokenInfo) error
+
+// WithValidator makes every successful auth response pass validator
+//
+// An error from validator fails the auth with ErrTokenRejected and
+// isn't retried.
+func WithValidator(validator Validator) Option {
+	return func(o *options) {
+		o.validator = validator
+	}
+}
+
+// validate checks info with the Validator if set
+func (o *options) validate(info TokenInfo) error {
+	if o.validator == nil {
+		return nil
+	}
+	if err := o.validator(info); err != nil {
+		return errors.Wrapf(ErrTokenRejected, "%v", err)
+	}
+	return nil
+}
+
+// WithFreshWindow makes NeedsReauth return false for window after a
+// token is obtained whatever its expiry
+//
+// This stops triggers firing together, such as concurrent 401s,
+// authenticating back to back.
+func WithFreshWindow(window time.Duration) Option {
+	return func(o *options) {
+		o.freshWindow = window
+	}
+}
+
+// needsReauth returns true if token is missing or expires within
+// buffer - a zero expires never expires - unless it was obtained
+// within the fresh window
+func (o *options) needsReauth(token string, expires, obtained time.Time, buffer time.Duration) bool {
+	if token == "" {
+		return true
+	}
+	if o.freshWindow > 0 && !obtained.IsZero() && o.now().Sub(obtained) < o.freshWindow {
+		return false
+	}
+	if expires.IsZero() {
+		return false
+	}
+	return !o.now().Add(buffer).Before(expires)
+}
+
+// inLocation returns t in loc keeping a zero t zero
+func inLocation(t time.Time, loc *time.Location) time.Time {
+	if t.IsZero() {
+		return t
+	}
+	return t.In(loc)
+}
+
+// clockSkew returns how far the clock of the auth server was ahead of
+// the local clock given a token issued and expiring at the times from
+// the server and obtained at the local time
+//
+// The skew also includes the latency of the response so is slightly
+// negative without skew. An error wrapping ErrClockSkew is returned
+// with the skew if the token was issued in the future or had expired
+// when it was obtained.
+func clockSkew(issued, expires, obtained time.Time) (time.Duration, error) {
+	if obtained.IsZero() {
+		return 0, errors.New("no token")
+	}
+	if issued.IsZero() {
+		return 0, errors.New("token issue time not known")
+	}
+	skew := issued.Sub(obtained)
+	if skew > clockSkewTolerance {
+		return skew, errors.Wrapf(ErrClockSkew, "token issued %v in the future", skew)
+	}
+	if !expires.IsZero() && !expires.After(obtained) {
+		return skew, errors.Wrapf(ErrClockSkew, "token expired %v before it was obtained", obtained.Sub(expires))
+	}
+	return skew, nil
+}
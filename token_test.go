@@ -0,0 +1,334 @@
+package auth
+
+import (
+	"fmt"
+	"net/http"
+	"reflect"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/ncw/swift/v2"
+)
+
+func TestTokenInfo(t *testing.T) {
+	mustParse := func(s string) time.Time {
+		tm, err := time.Parse(time.RFC3339Nano, s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return tm
+	}
+	for _, test := range []struct {
+		name    string
+		version AuthVersion
+		body    string
+		want    TokenInfo
+	}{
+		{"v2", 2, v2TokenBody, TokenInfo{
+			Token:     "v2token",
+			IssuedAt:  mustParse("2015-11-07T01:58:43.578929Z"),
+			ExpiresAt: mustParse("2099-11-07T02:58:43Z"),
+			Scope:     Scope{Kind: ScopeProject, Id: "t1", Name: "tenant"},
+			Roles:     []string{"member"},
+		}},
+		{"v3", 3, v3TokenBody, TokenInfo{
+			Token:     "token",
+			IssuedAt:  mustParse("2015-11-07T01:58:43.578929Z"),
+			ExpiresAt: mustParse("2099-11-07T02:58:43.578887Z"),
+			Scope:     Scope{Kind: ScopeProject, Id: "a6944d763bf64ee6a275f1263fae0352", Name: "project", DomainId: "default", DomainName: "Default"},
+			Roles:     []string{"member"},
+		}},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			now := test.want.ExpiresAt.Add(-time.Hour)
+			a := authenticateWith(t, test.version, test.body, WithClock(fixedClock(now)))
+			want := test.want
+			want.TTL = time.Hour
+			got := a.(TokenInformer).TokenInfo()
+			if !reflect.DeepEqual(got, want) {
+				t.Errorf("got %+v\nwant %+v", got, want)
+			}
+			if expires := a.(swift.Expireser).Expires(); !expires.Equal(want.ExpiresAt) {
+				t.Errorf("Expires() = %v, want %v", expires, want.ExpiresAt)
+			}
+			expirer := a.(Expirer)
+			if ttl := expirer.ExpiresIn(); ttl != time.Hour {
+				t.Errorf("ExpiresIn() = %v, want 1h", ttl)
+			}
+			if expirer.IsExpired() {
+				t.Error("IsExpired() = true an hour before expiry")
+			}
+
+			later := authenticateWith(t, test.version, test.body, WithClock(fixedClock(want.ExpiresAt.Add(time.Minute))))
+			if ttl := later.(TokenInformer).TokenInfo().TTL; ttl != 0 {
+				t.Errorf("TTL = %v after expiry, want 0", ttl)
+			}
+			if !later.(Expirer).IsExpired() {
+				t.Error("IsExpired() = false after expiry")
+			}
+		})
+	}
+}
+
+func TestAuditIDs(t *testing.T) {
+	for _, test := range []struct {
+		name       string
+		auditIds   string
+		wantId     string
+		wantParent string
+	}{
+		{"none", `[]`, "", ""},
+		{"one", `["3T2dc1CGQxyJsHdDu1xkcw"]`, "3T2dc1CGQxyJsHdDu1xkcw", ""},
+		{"two", `["3T2dc1CGQxyJsHdDu1xkcw", "parentAudit"]`, "3T2dc1CGQxyJsHdDu1xkcw", "parentAudit"},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			body := strings.Replace(v3TokenBody, `"audit_ids": ["3T2dc1CGQxyJsHdDu1xkcw"]`, `"audit_ids": `+test.auditIds, 1)
+			a := authenticateWith(t, 3, body).(Auditor)
+			if got := a.AuditID(); got != test.wantId {
+				t.Errorf("AuditID() = %q, want %q", got, test.wantId)
+			}
+			if got := a.ParentAuditID(); got != test.wantParent {
+				t.Errorf("ParentAuditID() = %q, want %q", got, test.wantParent)
+			}
+		})
+	}
+}
+
+func TestDefaultTTL(t *testing.T) {
+	now := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	for _, test := range []struct {
+		name    string
+		version AuthVersion
+		body    string
+	}{
+		{"v2", 2, strings.Replace(v2TokenBody, `"expires": "2099-11-07T02:58:43Z",`, "", 1)},
+		{"v3", 3, strings.Replace(v3TokenBody, `"expires_at": "2099-11-07T02:58:43.578887Z",`, "", 1)},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			a := authenticateWith(t, test.version, test.body, WithClock(fixedClock(now)))
+			if got := a.(swift.Expireser).Expires(); !got.IsZero() {
+				t.Errorf("Expires() = %v without a default TTL, want zero", got)
+			}
+
+			logger := &recordingLogger{}
+			a = authenticateWith(t, test.version, test.body, WithClock(fixedClock(now)), WithDefaultTTL(30*time.Minute), WithLogger(logger))
+			if got, want := a.(swift.Expireser).Expires(), now.Add(30*time.Minute); !got.Equal(want) {
+				t.Errorf("Expires() = %v, want %v", got, want)
+			}
+			if a.(Expirer).IsExpired() {
+				t.Error("token without an expiry treated as expired")
+			}
+			if !logger.contains("using default TTL 30m0s") {
+				t.Errorf("default TTL not logged: %q", logger.messages)
+			}
+		})
+	}
+}
+
+func TestRejectedTokenNotStored(t *testing.T) {
+	// rejected returns the body of a token with id "rejected" failing
+	// one of the checks
+	type rejected func(version AuthVersion) string
+	withStorage := func(v2, v3 []string) rejected {
+		return func(version AuthVersion) string {
+			if version == 2 {
+				return v2BodyWithStorage(v2...)
+			}
+			return v3BodyWithStorage(v3...)
+		}
+	}
+	for _, test := range []struct {
+		name     string
+		opts     []Option
+		rejected rejected
+		wantErr  error
+	}{
+		{"validator", []Option{WithValidator(func(info TokenInfo) error {
+			if info.Token == "rejected" {
+				return errors.New("not this one")
+			}
+			return nil
+		})}, withStorage([]string{v2StorageEndpoints}, []string{v3StorageEndpoints}), nil},
+		{"min TTL", []Option{WithMinTTL(10*time.Minute, false), WithClock(fixedClock(ttlNow))}, func(version AuthVersion) string {
+			if version == 2 {
+				return strings.Replace(v2TokenBody, `"2099-11-07T02:58:43Z"`, `"2099-11-07T02:01:00Z"`, 1)
+			}
+			return shortV3Body
+		}, ErrTokenTTLTooShort},
+		{"strict region", []Option{WithStrictRegion(true)}, withStorage(
+			[]string{v2Endpoint("X", "http://x.example.com/v1/AUTH_t1", "http://x.internal/v1/AUTH_t1")},
+			[]string{v3Endpoint("public", "X", "http://x.example.com/v1/AUTH_p")},
+		), nil},
+		{"duplicate", []Option{WithDuplicatePolicy(DuplicateError)}, withStorage(
+			[]string{v2StorageEndpoints, v2StorageEndpoints},
+			[]string{v3StorageEndpoints, v3Endpoint("public", "R", "http://other.example.com/v1/AUTH_p")},
+		), ErrDuplicateEndpoint},
+	} {
+		for _, version := range []AuthVersion{2, 3} {
+			t.Run(fmt.Sprintf("%s/v%d", test.name, version), func(t *testing.T) {
+				var sent int32
+				s := newFakeServer(t, func(w http.ResponseWriter, r *http.Request, _ string) {
+					body, token := v3TokenBody, "token"
+					if version == 2 {
+						body, token = v2TokenBody, "v2token"
+					}
+					if atomic.AddInt32(&sent, 1) > 1 {
+						body, token = test.rejected(version), "rejected"
+					}
+					if version == 2 {
+						writeJson(w, http.StatusOK, strings.Replace(body, `"v2token"`, `"`+token+`"`, 1))
+					} else {
+						writeV3Token(w, token, body)
+					}
+				})
+				c := v3Connection(s)
+				if version == 2 {
+					c = v2Connection(s)
+				}
+				c.Region = "R"
+				a := newAuth(t, c, version, test.opts...)
+				if err := authenticate(a, c); err != nil {
+					t.Fatal(err)
+				}
+				want := a.Token()
+				wantExpires := a.(swift.Expireser).Expires()
+				wantUrl := a.StorageUrl(false)
+
+				err := authenticate(a, c)
+				if err == nil {
+					t.Fatal("expected the second token to be rejected")
+				}
+				if test.wantErr != nil && !errors.Is(err, test.wantErr) {
+					t.Errorf("err = %v, want %v", err, test.wantErr)
+				}
+				if got := a.Token(); got != want {
+					t.Errorf("token = %q after the rejection, want %q", got, want)
+				}
+				if got := a.(swift.Expireser).Expires(); !got.Equal(wantExpires) {
+					t.Errorf("expires = %v after the rejection, want %v", got, wantExpires)
+				}
+				if got := a.StorageUrl(false); got != wantUrl {
+					t.Errorf("storage url = %q after the rejection, want %q", got, wantUrl)
+				}
+			})
+		}
+	}
+}
+
+func TestFreshWindow(t *testing.T) {
+	for _, test := range []struct {
+		name     string
+		opts     []Option
+		wantSent int
+	}{
+		{"no window", nil, 3},
+		{"window", []Option{WithFreshWindow(5 * time.Second)}, 2},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			s := newFakeServer(t, func(w http.ResponseWriter, r *http.Request, _ string) {
+				writeV3Token(w, "token", shortV3Body)
+			})
+			c := v3Connection(s)
+			clock := &manualClock{now: ttlNow}
+			a := newAuth(t, c, AuthV3, append(test.opts, WithClock(clock))...)
+			if err := authenticate(a, c); err != nil {
+				t.Fatal(err)
+			}
+			clock.Advance(10 * time.Second)
+
+			// Two requests get a 401 together and reauth in turn if
+			// the token, expiring within the buffer, needs it
+			var mu sync.Mutex
+			var wg sync.WaitGroup
+			for i := 0; i < 2; i++ {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					mu.Lock()
+					defer mu.Unlock()
+					if a.(ReauthAdvisor).NeedsReauth(5 * time.Minute) {
+						if err := authenticate(a, c); err != nil {
+							t.Error(err)
+						}
+					}
+				}()
+			}
+			wg.Wait()
+			if n := len(s.recorded()); n != test.wantSent {
+				t.Errorf("sent %d requests, want %d", n, test.wantSent)
+			}
+		})
+	}
+}
+
+func TestExpiresInLocation(t *testing.T) {
+	for _, test := range []struct {
+		name    string
+		version AuthVersion
+		body    string
+	}{
+		{"v2", 2, strings.Replace(v2TokenBody, `"2099-11-07T02:58:43Z"`, `"2099-11-07T04:58:43+02:00"`, 1)},
+		{"v3", 3, strings.Replace(v3TokenBody, `"2099-11-07T02:58:43.578887Z"`, `"2099-11-07T04:58:43+02:00"`, 1)},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			a := authenticateWith(t, test.version, test.body)
+			utc := time.Date(2099, 11, 7, 2, 58, 43, 0, time.UTC)
+			// Expires keeps the offset Keystone used
+			expires := a.(swift.Expireser).Expires()
+			if _, offset := expires.Zone(); offset != 2*60*60 || !expires.Equal(utc) {
+				t.Errorf("expires = %v, want %v at +02:00", expires, utc)
+			}
+			located := a.(ExpiryLocator)
+			if got := located.ExpiresUTC(); got != utc {
+				t.Errorf("expires UTC = %v, want %v", got, utc)
+			}
+			west := time.FixedZone("EST", -5*60*60)
+			if got, want := located.ExpiresInLocation(west), utc.In(west); got != want || got.Hour() != 21 {
+				t.Errorf("expires in EST = %v, want %v", got, want)
+			}
+		})
+	}
+}
+
+func TestDetectClockSkew(t *testing.T) {
+	issued := time.Date(2015, 11, 7, 1, 58, 43, 578929000, time.UTC)
+	for _, test := range []struct {
+		name     string
+		now      time.Time // the local time the token is obtained
+		wantSkew time.Duration
+		wantErr  bool
+	}{
+		{"in sync", issued.Add(time.Second), -time.Second, false},
+		{"within tolerance", issued.Add(-2 * time.Second), 2 * time.Second, false},
+		{"issued in the future", issued.Add(-10 * time.Minute), 10 * time.Minute, true},
+		{"expired when obtained", time.Date(2100, 1, 1, 0, 0, 0, 0, time.UTC), issued.Sub(time.Date(2100, 1, 1, 0, 0, 0, 0, time.UTC)), true},
+	} {
+		for _, version := range []AuthVersion{2, 3} {
+			t.Run(fmt.Sprintf("%s/v%d", test.name, version), func(t *testing.T) {
+				body := v3TokenBody
+				if version == 2 {
+					body = v2TokenBody
+				}
+				a := authenticateWith(t, version, body, WithClock(fixedClock(test.now)))
+				skew, err := a.(ClockSkewDetector).DetectClockSkew()
+				if skew != test.wantSkew {
+					t.Errorf("skew = %v, want %v", skew, test.wantSkew)
+				}
+				if test.wantErr != errors.Is(err, ErrClockSkew) {
+					t.Errorf("err = %v, want ErrClockSkew %v", err, test.wantErr)
+				}
+			})
+		}
+	}
+
+	// There's nothing to compare before auth
+	a := newAuth(t, &swift.Connection{AuthUrl: "https://auth.example.com/v3"}, 3)
+	if _, err := a.(ClockSkewDetector).DetectClockSkew(); err == nil || errors.Is(err, ErrClockSkew) {
+		t.Errorf("err = %v before auth, want an error other than ErrClockSkew", err)
+	}
+}
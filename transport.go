@@ -0,0 +1,189 @@
+package auth
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/ncw/swift/v2"
+	"github.com/pkg/errors"
+)
+
+// WithConnectTimeout sets the dial and TLS handshake timeout of the
+// transport used for authentication
+//
+// The overall time allowed for authentication is set separately by
+// New or WithAuthTimeout.
+func WithConnectTimeout(timeout time.Duration) Option {
+	return func(o *options) {
+		o.connectTimeout = timeout
+	}
+}
+
+// WithAuthTimeout sets the overall time allowed for an authentication
+// request overriding the timeout passed to New
+func WithAuthTimeout(timeout time.Duration) Option {
+	return func(o *options) {
+		o.authTimeout = timeout
+	}
+}
+
+// authTimeoutKey is the context key of the auth timeout override
+type authTimeoutKey struct{}
+
+// ContextWithAuthTimeout returns a copy of ctx which makes auth
+// requests made with it use timeout instead of the configured one
+//
+// This lets interactive and batch operations use different timeouts.
+func ContextWithAuthTimeout(ctx context.Context, timeout time.Duration) context.Context {
+	return context.WithValue(ctx, authTimeoutKey{}, timeout)
+}
+
+// requestTimeout returns the auth timeout from ctx if set, otherwise
+// timeout
+func requestTimeout(ctx context.Context, timeout time.Duration) time.Duration {
+	if override, ok := ctx.Value(authTimeoutKey{}).(time.Duration); ok && override > 0 {
+		return override
+	}
+	return timeout
+}
+
+// WithHTTP2 makes the auth transport attempt HTTP/2 even if a custom
+// dialer or TLS config would otherwise disable it
+//
+// It is off by default.
+func WithHTTP2(enabled bool) Option {
+	return func(o *options) {
+		o.forceHTTP2 = enabled
+	}
+}
+
+// WithKeepAlives controls whether the auth transport reuses
+// connections
+//
+// It is enabled by default. Disable it where a load balancer in front
+// of Keystone fails stale keep-alive connections, so each auth request
+// uses a fresh connection.
+func WithKeepAlives(enabled bool) Option {
+	return func(o *options) {
+		o.noKeepAlives = !enabled
+	}
+}
+
+// WithConnectionPool sets the idle connection pool of the auth
+// transport
+//
+// Zero values leave the defaults of the transport being copied.
+func WithConnectionPool(maxIdleConns, maxIdleConnsPerHost int, idleConnTimeout time.Duration) Option {
+	return func(o *options) {
+		o.maxIdleConns = maxIdleConns
+		o.maxIdleConnsPerHost = maxIdleConnsPerHost
+		o.idleConnTimeout = idleConnTimeout
+	}
+}
+
+// ownTransport returns true if options require the package to build
+// its own transport for authentication
+func (o *options) ownTransport() bool {
+	return o.connectTimeout > 0 || o.forceHTTP2 || o.noKeepAlives ||
+		o.maxIdleConns > 0 || o.maxIdleConnsPerHost > 0 || o.idleConnTimeout > 0
+}
+
+// transport returns the RoundTripper used to authenticate c
+//
+// If no transport options are set this is the connection's transport,
+// otherwise a transport is built from the connection's (or the
+// default) transport with the options applied. One is built for each
+// transport used by the connections and then reused.
+//
+// The options can only be applied to an *http.Transport so any other
+// transport on the connection is an error rather than being bypassed.
+func (o *options) transport(c *swift.Connection) (http.RoundTripper, error) {
+	if !o.ownTransport() {
+		return c.Transport, nil
+	}
+	base := c.Transport
+	if base == nil {
+		base = http.DefaultTransport
+	}
+	bt, ok := base.(*http.Transport)
+	if !ok {
+		return nil, errors.Errorf("transport options need the connection's Transport to be an *http.Transport but it is %T", base)
+	}
+	o.transportMu.Lock()
+	defer o.transportMu.Unlock()
+	if t, ok := o.authTransports[bt]; ok {
+		return t, nil
+	}
+	if o.authTransports == nil {
+		o.authTransports = make(map[*http.Transport]*http.Transport)
+	}
+	t := o.newTransport(bt)
+	o.authTransports[bt] = t
+	return t, nil
+}
+
+// newTransport builds a transport for authentication based on base
+func (o *options) newTransport(base *http.Transport) *http.Transport {
+	t := base.Clone()
+	if o.connectTimeout > 0 {
+		t.DialContext = (&net.Dialer{
+			Timeout:   o.connectTimeout,
+			KeepAlive: 30 * time.Second,
+		}).DialContext
+		t.TLSHandshakeTimeout = o.connectTimeout
+	}
+	if o.forceHTTP2 {
+		t.ForceAttemptHTTP2 = true
+	}
+	if o.noKeepAlives {
+		t.DisableKeepAlives = true
+	}
+	if o.maxIdleConns > 0 {
+		t.MaxIdleConns = o.maxIdleConns
+	}
+	if o.maxIdleConnsPerHost > 0 {
+		t.MaxIdleConnsPerHost = o.maxIdleConnsPerHost
+	}
+	if o.idleConnTimeout > 0 {
+		t.IdleConnTimeout = o.idleConnTimeout
+	}
+	return t
+}
+
+// WithFallbackTransports sets transports tried in order when the auth
+// request fails with a network error, for example a direct transport
+// behind a transport using a proxy
+//
+// Replies from the auth server, including rejections, don't trigger a
+// fallback.
+func WithFallbackTransports(transports ...http.RoundTripper) Option {
+	return func(o *options) {
+		o.fallbackTransports = transports
+	}
+}
+
+// roundTrip sends r with transport then with the fallback transports
+// while it fails with a network error
+func (o *options) roundTrip(r *http.Request, transport http.RoundTripper) (*http.Response, error) {
+	cli := http.Client{Transport: transport}
+	resp, err := cli.Do(r)
+	for _, fallback := range o.fallbackTransports {
+		if err == nil || r.Context().Err() != nil {
+			break
+		}
+		o.logf("auth request failed, trying fallback transport: %v", err)
+		if r.GetBody != nil {
+			body, bodyErr := r.GetBody()
+			if bodyErr != nil {
+				break
+			}
+			r = r.Clone(r.Context())
+			r.Body = body
+		}
+		cli = http.Client{Transport: fallback}
+		resp, err = cli.Do(r)
+	}
+	return resp, err
+}
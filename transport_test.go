@@ -0,0 +1,306 @@
+package auth
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/ncw/swift/v2"
+)
+
+// countingTransport counts the requests it passes to http.DefaultTransport
+type countingTransport struct {
+	calls int32
+}
+
+func (t *countingTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	atomic.AddInt32(&t.calls, 1)
+	return http.DefaultTransport.RoundTrip(r)
+}
+
+// dialCounter returns an *http.Transport counting its dials
+func dialCounter(count *int32) *http.Transport {
+	t := http.DefaultTransport.(*http.Transport).Clone()
+	t.DialContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+		atomic.AddInt32(count, 1)
+		return (&net.Dialer{}).DialContext(ctx, network, addr)
+	}
+	return t
+}
+
+func TestTransportUsesConnectionRoundTripper(t *testing.T) {
+	s := newFakeServer(t, func(w http.ResponseWriter, r *http.Request, body string) {
+		writeV3Token(w, "tok", v3TokenBody)
+	})
+	c := v3Connection(s)
+	rt := &countingTransport{}
+	c.Transport = rt
+	if err := authenticate(newAuth(t, c, AuthV3), c); err != nil {
+		t.Fatal(err)
+	}
+	if rt.calls != 1 {
+		t.Errorf("connection transport called %d times, want 1", rt.calls)
+	}
+}
+
+func TestTransportOptionsRejectWrappingRoundTripper(t *testing.T) {
+	s := newFakeServer(t, func(w http.ResponseWriter, r *http.Request, body string) {
+		writeV3Token(w, "tok", v3TokenBody)
+	})
+	c := v3Connection(s)
+	rt := &countingTransport{}
+	c.Transport = rt
+	err := authenticate(newAuth(t, c, AuthV3, WithKeepAlives(false)), c)
+	if err == nil || !strings.Contains(err.Error(), "*http.Transport") {
+		t.Fatalf("err = %v, want transport error", err)
+	}
+	if len(s.recorded()) != 0 {
+		t.Errorf("request sent bypassing the connection's transport")
+	}
+}
+
+func TestTransportBuiltPerConnectionTransport(t *testing.T) {
+	s := newFakeServer(t, func(w http.ResponseWriter, r *http.Request, body string) {
+		writeV3Token(w, "tok", v3TokenBody)
+	})
+	var dials1, dials2 int32
+	c1 := v3Connection(s)
+	c1.Transport = dialCounter(&dials1)
+	c2 := v3Connection(s)
+	c2.Transport = dialCounter(&dials2)
+	a := newAuth(t, c1, AuthV3, WithKeepAlives(false))
+	if err := authenticate(a, c1); err != nil {
+		t.Fatal(err)
+	}
+	if err := authenticate(a, c2); err != nil {
+		t.Fatal(err)
+	}
+	if err := authenticate(a, c1); err != nil {
+		t.Fatal(err)
+	}
+	// Keep-alives are off so each request dials
+	if dials1 != 2 || dials2 != 1 {
+		t.Errorf("dials = %d, %d, want 2, 1", dials1, dials2)
+	}
+	v3 := a.(*v3Auth)
+	if n := len(v3.authTransports); n != 2 {
+		t.Errorf("built %d transports, want 2", n)
+	}
+	for base, built := range v3.authTransports {
+		if !built.DisableKeepAlives || base.DisableKeepAlives {
+			t.Errorf("keep-alives option not applied to a copy only")
+		}
+	}
+}
+
+// slowHandler replies only once the client has gone away
+func slowHandler(w http.ResponseWriter, r *http.Request, body string) {
+	select {
+	case <-r.Context().Done():
+	case <-time.After(5 * time.Second):
+	}
+}
+
+func TestAuthTimeoutStopsSlowServer(t *testing.T) {
+	s := newFakeServer(t, slowHandler)
+	c := v3Connection(s)
+	a := newAuth(t, c, AuthV3, WithAuthTimeout(50*time.Millisecond))
+	start := time.Now()
+	err := authenticate(a, c)
+	if err == nil {
+		t.Fatal("auth against a slow server succeeded")
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("auth took %v, want it cut off by the 50ms timeout", elapsed)
+	}
+}
+
+func TestContextAuthTimeoutStopsSlowServer(t *testing.T) {
+	s := newFakeServer(t, slowHandler)
+	c := v3Connection(s)
+	a := newAuth(t, c, AuthV3)
+	ctx := ContextWithAuthTimeout(context.Background(), 50*time.Millisecond)
+	start := time.Now()
+	if _, err := a.Request(ctx, c); err == nil {
+		t.Fatal("auth against a slow server succeeded")
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("auth took %v, want it cut off by the 50ms context timeout", elapsed)
+	}
+}
+
+func TestContextAuthTimeoutOverridesConfigured(t *testing.T) {
+	// The server answers after 200ms
+	s := newFakeServer(t, func(w http.ResponseWriter, r *http.Request, body string) {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-time.After(200 * time.Millisecond):
+		}
+		if strings.HasPrefix(r.URL.Path, "/v2.0") {
+			writeJson(w, http.StatusOK, v2TokenBody)
+		} else {
+			writeV3Token(w, "token", v3TokenBody)
+		}
+	})
+	for _, test := range []struct {
+		name       string
+		configured time.Duration
+		override   time.Duration // 0 for none
+		wantErr    bool
+	}{
+		{"configured long", 5 * time.Second, 0, false},
+		{"configured short", 50 * time.Millisecond, 0, true},
+		{"override shortens", 5 * time.Second, 50 * time.Millisecond, true},
+		{"override lengthens", 50 * time.Millisecond, 5 * time.Second, false},
+	} {
+		for _, version := range []AuthVersion{2, 3} {
+			t.Run(fmt.Sprintf("%s/v%d", test.name, version), func(t *testing.T) {
+				c := v3Connection(s)
+				if version == 2 {
+					c = v2Connection(s)
+				}
+				a := newAuth(t, c, version, WithAuthTimeout(test.configured))
+				ctx := context.Background()
+				if test.override > 0 {
+					ctx = ContextWithAuthTimeout(ctx, test.override)
+				}
+				_, err := a.Request(ctx, c)
+				if (err != nil) != test.wantErr {
+					t.Errorf("err = %v, want error %v", err, test.wantErr)
+				}
+			})
+		}
+	}
+}
+
+func TestConnectTimeoutStopsStalledHandshake(t *testing.T) {
+	// A listener accepting connections but never answering the TLS
+	// handshake
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var conns []net.Conn
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			conns = append(conns, conn)
+		}
+	}()
+	defer func() {
+		l.Close()
+		<-done
+		for _, conn := range conns {
+			conn.Close()
+		}
+	}()
+
+	c := &swift.Connection{
+		AuthUrl:  "https://" + l.Addr().String() + "/v3",
+		UserName: "user",
+		ApiKey:   "secret",
+		Domain:   "Default",
+		Tenant:   "project",
+	}
+	a := newAuth(t, c, AuthV3, WithConnectTimeout(50*time.Millisecond))
+	start := time.Now()
+	err = authenticate(a, c)
+	if err == nil {
+		t.Fatal("auth against a stalled handshake succeeded")
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("auth took %v, want it cut off by the 50ms connect timeout", elapsed)
+	}
+	if !strings.Contains(err.Error(), "handshake timeout") {
+		t.Errorf("err = %v, want a TLS handshake timeout", err)
+	}
+}
+
+func TestHTTP2Negotiation(t *testing.T) {
+	protos := make(chan string, 1)
+	s := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		protos <- r.Proto
+		writeV3Token(w, "tok", v3TokenBody)
+	}))
+	s.EnableHTTP2 = true
+	s.StartTLS()
+	defer s.Close()
+
+	for _, test := range []struct {
+		name string
+		opts []Option
+		want string
+	}{
+		{"default", nil, "HTTP/1.1"},
+		{"forced", []Option{WithHTTP2(true)}, "HTTP/2.0"},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			// A custom TLS config disables HTTP/2 unless forced
+			transport := http.DefaultTransport.(*http.Transport).Clone()
+			transport.TLSClientConfig = s.Client().Transport.(*http.Transport).TLSClientConfig.Clone()
+			transport.ForceAttemptHTTP2 = false
+			c := &swift.Connection{
+				AuthUrl:   s.URL + "/v3",
+				UserName:  "user",
+				ApiKey:    "secret",
+				Domain:    "Default",
+				Tenant:    "project",
+				Transport: transport,
+			}
+			if err := authenticate(newAuth(t, c, AuthV3, test.opts...), c); err != nil {
+				t.Fatal(err)
+			}
+			if got := <-protos; got != test.want {
+				t.Errorf("negotiated %s, want %s", got, test.want)
+			}
+		})
+	}
+}
+
+func TestConnectionPoolOptions(t *testing.T) {
+	base := http.DefaultTransport.(*http.Transport)
+	for _, test := range []struct {
+		name                    string
+		opts                    []Option
+		maxIdle, maxIdlePerHost int
+		idleTimeout             time.Duration
+	}{
+		{"configured", []Option{WithConnectionPool(50, 10, 30*time.Second)}, 50, 10, 30 * time.Second},
+		{"zero keeps defaults", []Option{WithConnectionPool(0, 10, 0)}, base.MaxIdleConns, 10, base.IdleConnTimeout},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			s := newFakeServer(t, func(w http.ResponseWriter, r *http.Request, body string) {
+				writeV3Token(w, "tok", v3TokenBody)
+			})
+			c := v3Connection(s)
+			a := newAuth(t, c, AuthV3, test.opts...)
+			if err := authenticate(a, c); err != nil {
+				t.Fatal(err)
+			}
+			rt, err := a.(*v3Auth).transport(c)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got := rt.(*http.Transport)
+			if got == base {
+				t.Fatal("default transport modified in place")
+			}
+			if got.MaxIdleConns != test.maxIdle || got.MaxIdleConnsPerHost != test.maxIdlePerHost || got.IdleConnTimeout != test.idleTimeout {
+				t.Errorf("pool %d/%d/%v, want %d/%d/%v", got.MaxIdleConns, got.MaxIdleConnsPerHost, got.IdleConnTimeout,
+					test.maxIdle, test.maxIdlePerHost, test.idleTimeout)
+			}
+		})
+	}
+}
@@ -0,0 +1,52 @@
+package auth
+
+import (
+	"context"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// ErrTokenTTLTooShort is returned when the token from the auth server
+// expires sooner than the minimum set with WithMinTTL
+var ErrTokenTTLTooShort = errors.New("token expires too soon")
+
+// WithMinTTL requires a new token to have at least min left before it
+// expires
+//
+// If reauth is set a token which expires too soon is replaced by
+// authenticating once more, otherwise or if that doesn't help the
+// error is ErrTokenTTLTooShort. Tokens without an expiry are
+// accepted.
+func WithMinTTL(min time.Duration, reauth bool) Option {
+	return func(o *options) {
+		o.minTTL = min
+		o.minTTLReauth = reauth
+	}
+}
+
+// checkTTL returns an error if a token expiring at expires doesn't
+// have the minimum TTL left
+func (o *options) checkTTL(expires time.Time) error {
+	if o.minTTL <= 0 || expires.IsZero() {
+		return nil
+	}
+	if ttl := o.ttl(expires); ttl < o.minTTL {
+		return errors.Wrapf(ErrTokenTTLTooShort, "%v left but need %v", ttl, o.minTTL)
+	}
+	return nil
+}
+
+// withMinTTL authenticates with attempt using withRetries once more
+// if the token read was rejected for expiring too soon and reauth is
+// set
+//
+// The minimum TTL is checked with checkTTL as the response is read.
+func (o *options) withMinTTL(ctx context.Context, attempt func(ctx context.Context) error) error {
+	err := o.withRetries(ctx, attempt)
+	if !o.minTTLReauth || !errors.Is(err, ErrTokenTTLTooShort) {
+		return err
+	}
+	o.logf("%v: authenticating again", err)
+	return o.withRetries(ctx, attempt)
+}
@@ -0,0 +1,61 @@
+package auth
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// shortV3Body is v3TokenBody expiring a minute after ttlNow
+var shortV3Body = strings.Replace(v3TokenBody, `"expires_at": "2099-11-07T02:58:43.578887Z"`, `"expires_at": "2099-11-07T02:01:00Z"`, 1)
+
+// ttlNow is the time of the clock for the min TTL tests
+var ttlNow = time.Date(2099, 11, 7, 2, 0, 0, 0, time.UTC)
+
+func TestMinTTL(t *testing.T) {
+	for _, test := range []struct {
+		name      string
+		bodies    []string // answered in turn, the last repeated
+		reauth    bool
+		wantErr   bool
+		wantToken string
+		wantSent  int
+	}{
+		{"long enough", []string{v3TokenBody}, false, false, "token1", 1},
+		{"too short", []string{shortV3Body}, false, true, "", 1},
+		{"reauth gets a longer token", []string{shortV3Body, v3TokenBody}, true, false, "token2", 2},
+		{"reauth still too short", []string{shortV3Body}, true, true, "", 2},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			var sent int32
+			s := newFakeServer(t, func(w http.ResponseWriter, r *http.Request, body string) {
+				n := int(atomic.AddInt32(&sent, 1))
+				i := n - 1
+				if i >= len(test.bodies) {
+					i = len(test.bodies) - 1
+				}
+				writeV3Token(w, fmt.Sprintf("token%d", n), test.bodies[i])
+			})
+			c := v3Connection(s)
+			a := newAuth(t, c, AuthV3, WithMinTTL(10*time.Minute, test.reauth), WithClock(fixedClock(ttlNow)))
+			err := authenticate(a, c)
+			if test.wantErr {
+				if !errors.Is(err, ErrTokenTTLTooShort) {
+					t.Errorf("err = %v, want ErrTokenTTLTooShort", err)
+				}
+			} else if err != nil {
+				t.Fatal(err)
+			} else if got := a.Token(); got != test.wantToken {
+				t.Errorf("token = %q, want %q", got, test.wantToken)
+			}
+			if n := len(s.recorded()); n != test.wantSent {
+				t.Errorf("sent %d requests, want %d", n, test.wantSent)
+			}
+		})
+	}
+}